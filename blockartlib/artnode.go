@@ -8,12 +8,15 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"../crypto"
 )
 
 type ArtNode struct {
 	client    *rpc.Client      // RPC client to connect to the InkMiner
 	privKey   ecdsa.PrivateKey // Pub/priv key pair of this ArtNode
 	minerAddr string
+	tip       uint32 // ink tip paid on each operation, see SetTip
 }
 
 type Point struct {
@@ -46,6 +49,7 @@ func (a *ArtNode) AddShape(validateNum uint8, shapeType ShapeType, shapeSvgStrin
 		PubKey:      a.privKey.PublicKey,
 		ValidateNum: validateNum,
 		Id:          time.Now().Unix(),
+		Tip:         a.tip,
 	}
 
 	args.ADD.Shape = shape
@@ -135,6 +139,7 @@ func (a *ArtNode) DeleteShape(validateNum uint8, shapeHash string) (inkRemaining
 		PubKey:      a.privKey.PublicKey,
 		ValidateNum: validateNum,
 		Id:          time.Now().Unix(),
+		Tip:         a.tip,
 	}
 	args.DELETE.ShapeHash = shapeHash
 
@@ -161,6 +166,11 @@ func (a *ArtNode) DeleteShape(validateNum uint8, shapeHash string) (inkRemaining
 	return resp, nil
 }
 
+// Sets the ink tip paid to miners on each later operation.
+func (a *ArtNode) SetTip(tip uint32) {
+	a.tip = tip
+}
+
 // Retrieves hashes contained by a specific block.
 // Can return the following errors:
 // - DisconnectedError
@@ -232,6 +242,128 @@ func (a *ArtNode) GetChildren(blockHash string) (blockHashes []string, err error
 	return
 }
 
+// Returns the hashes of operations that were confirmed but have since been
+// orphaned by a reorg.
+// Can return the following errors:
+// - DisconnectedError
+func (a *ArtNode) GetReorged() (opHashes []string, err error) {
+	// Simple RPC call to check if we can reach the InkMiner
+	var req string
+	var success bool
+	err = a.client.Call("InkMinerRPC.TestConnection", req, &success)
+	if err != nil {
+		return nil, DisconnectedError(a.minerAddr)
+	}
+
+	publicKey, err := crypto.MarshalPublic(&a.privKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp []string
+
+	err = a.client.Call("InkMinerRPC.GetReorged", publicKey, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// Returns a proof that the operation for the shape is in a block. Check it
+// with VerifyOperationProof.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidShapeHashError
+func (a *ArtNode) GetOperationProof(shapeHash string) (proof OperationProof, err error) {
+	// Simple RPC call to check if we can reach the InkMiner
+	var req string
+	var success bool
+	err = a.client.Call("InkMinerRPC.TestConnection", req, &success)
+	if err != nil {
+		return OperationProof{}, DisconnectedError(a.minerAddr)
+	}
+
+	err = a.client.Call("InkMinerRPC.GetOperationProof", shapeHash, &proof)
+	if err != nil {
+		return OperationProof{}, err
+	}
+
+	return proof, nil
+}
+
+// Returns a proof of this art node's ink level after a block. Check it with
+// VerifyInkProof.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidBlockHashError
+func (a *ArtNode) GetInkProof(blockHash string) (proof StateProof, err error) {
+	publicKey, err := crypto.MarshalPublic(&a.privKey.PublicKey)
+	if err != nil {
+		return StateProof{}, err
+	}
+	return a.getStateProof(blockHash, StateInk, publicKey)
+}
+
+// Returns a proof that a shape is on the canvas after a block. Check it with
+// VerifyShapeProof.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidBlockHashError
+// - InvalidShapeHashError
+func (a *ArtNode) GetShapeProof(shapeHash string, blockHash string) (proof StateProof, err error) {
+	return a.getStateProof(blockHash, StateShapes, shapeHash)
+}
+
+func (a *ArtNode) getStateProof(blockHash string, m StateMap, key string) (proof StateProof, err error) {
+	// Simple RPC call to check if we can reach the InkMiner
+	var req string
+	var success bool
+	err = a.client.Call("InkMinerRPC.TestConnection", req, &success)
+	if err != nil {
+		return StateProof{}, DisconnectedError(a.minerAddr)
+	}
+
+	args := GetStateProofRequest{
+		BlockHash: blockHash,
+		Map:       m,
+		Key:       key,
+	}
+	err = a.client.Call("InkMinerRPC.GetStateProof", args, &proof)
+	if err != nil {
+		return StateProof{}, err
+	}
+
+	return proof, nil
+}
+
+// Waits for a previously submitted operation to be confirmed again.
+// Can return the following errors:
+// - DisconnectedError
+// - InvalidShapeHashError
+func (a *ArtNode) WaitForConfirmation(validateNum uint8, opHash string) (blockHash string, err error) {
+	// Simple RPC call to check if we can reach the InkMiner
+	var req string
+	var success bool
+	err = a.client.Call("InkMinerRPC.TestConnection", req, &success)
+	if err != nil {
+		return "", DisconnectedError(a.minerAddr)
+	}
+
+	args := WaitForConfirmationRequest{
+		OpHash:      opHash,
+		ValidateNum: validateNum,
+	}
+	var resp string
+
+	err = a.client.Call("InkMinerRPC.WaitForConfirmation", args, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	return resp, nil
+}
+
 // Closes the canvas/connection to the BlockArt network.
 // - DisconnectedError
 func (a *ArtNode) CloseCanvas() (inkRemaining uint32, err error) {
@@ -8,34 +8,45 @@ import (
 	"strconv"
 )
 
+// BlockHeader is the part of a block that's hashed and mined. It commits to
+// the operations in the body through MerkleRoot and to the canvas they leave
+// through StateRoot.
+type BlockHeader struct {
+	PrevBlock  string          // Hash of the previous block
+	BlockNum   int             // Block number
+	PubKey     ecdsa.PublicKey // Public key of the InkMiner that mined this block
+	Timestamp  int64           // When the block was made, in Unix seconds
+	MerkleRoot string          // Root of the Merkle tree of Records, see MerkleRoot
+	StateRoot  string          // Root of the canvas state after the block, see StateRoot
+	Nonce      uint32
+}
+
 type Block struct {
-	PrevBlock string          // Hash of the previous block
-	BlockNum  int             // Block number
-	Records   []Operation     // Set of operation records
-	PubKey    ecdsa.PublicKey // Public key of the InkMiner that mined this block
-	Nonce     uint32
+	BlockHeader
+	Records []Operation // Set of operation records
 }
 
-func (b Block) HashNoNonce() ([]byte, error) {
-	b.Nonce = 0
+func (h BlockHeader) HashNoNonce() ([]byte, error) {
+	h.Nonce = 0
 	hash := md5.New()
-	if err := json.NewEncoder(hash).Encode(b); err != nil {
+	if err := json.NewEncoder(hash).Encode(h); err != nil {
 		return nil, err
 	}
 	return hash.Sum(nil), nil
 }
 
-func (b Block) HashApplyNonce(noNonceHash []byte) (string, error) {
+func (h BlockHeader) HashApplyNonce(noNonceHash []byte) (string, error) {
 	hash := md5.New()
 	hash.Write(noNonceHash)
-	hash.Write([]byte(strconv.Itoa(int(b.Nonce))))
+	hash.Write([]byte(strconv.Itoa(int(h.Nonce))))
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-func (b Block) Hash() (string, error) {
-	noNonceHash, err := b.HashNoNonce()
+// Hash returns the hash of the block. Only the header is hashed.
+func (h BlockHeader) Hash() (string, error) {
+	noNonceHash, err := h.HashNoNonce()
 	if err != nil {
 		return "", err
 	}
-	return b.HashApplyNonce(noNonceHash)
+	return h.HashApplyNonce(noNonceHash)
 }
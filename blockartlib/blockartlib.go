@@ -9,6 +9,7 @@ package blockartlib
 
 import (
 	"crypto/ecdsa"
+	"crypto/tls"
 	"fmt"
 	"net/rpc"
 
@@ -73,6 +74,13 @@ type MinerNetSettings struct {
 	PoWDifficultyOpBlock   uint8
 	PoWDifficultyNoOpBlock uint8
 
+	// Consensus limits on each block: the number of operations, the total
+	// size of their encodings and the total number of vertices in their
+	// shapes. Blocks over any of them are invalid. 0 means no limit.
+	MaxBlockOps      uint32
+	MaxBlockBytes    uint32
+	MaxBlockVertices uint32
+
 	// Canvas settings
 	CanvasSettings CanvasSettings
 }
@@ -151,12 +159,21 @@ func (e InvalidBlockHashError) Error() string {
 	return fmt.Sprintf("BlockArt: Invalid block hash [%s]", string(e))
 }
 
+// Contains why the proof didn't verify.
+type InvalidProofError string
+
+func (e InvalidProofError) Error() string {
+	return fmt.Sprintf("BlockArt: Invalid proof [%s]", string(e))
+}
+
 // </ERROR DEFINITIONS>
 ////////////////////////////////////////////////////////////////////////////////////////////
 
 // Represents a canvas in the system.
 type Canvas interface {
-	// Adds a new shape to the canvas.
+	// Adds a new shape to the canvas. Returns once the shape is validateNum
+	// blocks deep on the longest chain. A reorg can still orphan that block
+	// later, callers that care should poll GetReorged.
 	// Can return the following errors:
 	// - DisconnectedError
 	// - InsufficientInkError
@@ -175,7 +192,8 @@ type Canvas interface {
 	// - DisconnectedError
 	GetInk() (inkRemaining uint32, err error)
 
-	// Removes a shape from the canvas.
+	// Removes a shape from the canvas. Like AddShape, the deletion can be
+	// orphaned by a reorg after this returns, see GetReorged.
 	// Can return the following errors:
 	// - DisconnectedError
 	// - ShapeOwnerError
@@ -189,6 +207,12 @@ type Canvas interface {
 	// - InvalidBlockHashError
 	GetShapes(blockHash string) (shapeHashes []string, err error)
 
+	// Sets the ink tip paid to the miner of the block with each later
+	// AddShape or DeleteShape. Operations with a higher tip per byte are
+	// mined first. The tip is taken on top of the ink the shape costs so
+	// AddShape returns InsufficientInkError if both can't be covered.
+	SetTip(tip uint32)
+
 	// Returns the block hash of the genesis block.
 	// Can return the following errors:
 	// - DisconnectedError
@@ -200,6 +224,44 @@ type Canvas interface {
 	// - InvalidBlockHashError
 	GetChildren(blockHash string) (blockHashes []string, err error)
 
+	// Returns the hashes of this art node's operations (from AddShape or
+	// DeleteShape) that were confirmed but whose block has since been orphaned
+	// by a reorg of the blockchain. They will be mined again automatically,
+	// use WaitForConfirmation to wait for them.
+	// Can return the following errors:
+	// - DisconnectedError
+	GetReorged() (opHashes []string, err error)
+
+	// Returns a proof that the operation that added or deleted the shape is
+	// in a block, preferring the longest chain. It can be checked without
+	// trusting the miner with VerifyOperationProof.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidShapeHashError
+	GetOperationProof(shapeHash string) (proof OperationProof, err error)
+
+	// Returns a proof of this art node's ink level after the block. It can be
+	// checked without trusting the miner with VerifyInkProof.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidBlockHashError
+	GetInkProof(blockHash string) (proof StateProof, err error)
+
+	// Returns a proof that the shape is on the canvas after the block. It
+	// can be checked without trusting the miner with VerifyShapeProof.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidBlockHashError
+	// - InvalidShapeHashError
+	GetShapeProof(shapeHash string, blockHash string) (proof StateProof, err error)
+
+	// Waits for a previously submitted operation to be validateNum blocks
+	// deep on the canonical chain again and returns the block it's in.
+	// Can return the following errors:
+	// - DisconnectedError
+	// - InvalidShapeHashError
+	WaitForConfirmation(validateNum uint8, opHash string) (blockHash string, err error)
+
 	// Closes the canvas/connection to the BlockArt network.
 	// - DisconnectedError
 	CloseCanvas() (inkRemaining uint32, err error)
@@ -220,6 +282,27 @@ func OpenCanvas(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, sett
 	if err != nil {
 		return nil, CanvasSettings{}, DisconnectedError(minerAddr)
 	}
+	return openCanvas(client, minerAddr, privKey)
+}
+
+// OpenCanvasTLS is like OpenCanvas but connects to a miner that has TLS on.
+// The art node proves it has privKey during the TLS handshake.
+//
+// Can return the following errors:
+// - DisconnectedError
+func OpenCanvasTLS(minerAddr string, privKey ecdsa.PrivateKey) (canvas Canvas, setting CanvasSettings, err error) {
+	config, err := crypto.TLSConfig(&privKey)
+	if err != nil {
+		return nil, CanvasSettings{}, err
+	}
+	conn, err := tls.Dial("tcp", minerAddr, config)
+	if err != nil {
+		return nil, CanvasSettings{}, DisconnectedError(minerAddr)
+	}
+	return openCanvas(rpc.NewClient(conn), minerAddr, privKey)
+}
+
+func openCanvas(client *rpc.Client, minerAddr string, privKey ecdsa.PrivateKey) (Canvas, CanvasSettings, error) {
 	artNode := &ArtNode{
 		client:    client,
 		privKey:   privKey,
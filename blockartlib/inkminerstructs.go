@@ -2,8 +2,10 @@ package blockartlib
 
 import (
 	"crypto/ecdsa"
+	"encoding/json"
 	"fmt"
 	"math/big"
+	"strings"
 
 	crypto "../crypto"
 )
@@ -16,6 +18,11 @@ type Operation struct {
 	PubKey      ecdsa.PublicKey // Public key of the ArtNode that created this operation
 	ValidateNum uint8           //  Number of blocks that must follow the block with this operation in the blockchain
 	Id          int64           // Unique ID for this Operation (to prevent replay attacks), given by a timestamp
+	// Tip is ink paid to the miner of the block with this operation on top
+	// of the ink the shape costs. Miners mine the operations with the
+	// highest tip per byte first. It's left out of the encoding when it's
+	// zero so operations without one hash the same as before it existed.
+	Tip uint32 `json:",omitempty"`
 
 	// These fields are only used for specific operations.
 
@@ -46,6 +53,19 @@ func (s Shape) SvgString() string {
 	return fmt.Sprintf(`<%s d="%s" stroke="%s" fill="%s"/>`, s.Type, s.Svg, s.Stroke, s.Fill)
 }
 
+// NumVertices counts the vertices in the shape's path, one per command like
+// ComputeVertices. It doesn't parse the path so it's safe on invalid shapes.
+func (s Shape) NumVertices() int {
+	n := 0
+	for _, field := range strings.Fields(s.Svg) {
+		switch field {
+		case "M", "m", "L", "l", "H", "h", "V", "v", "Z", "z":
+			n++
+		}
+	}
+	return n
+}
+
 func (s Shape) Valid() error {
 	if s.Svg == "" || s.Fill == "" || s.Stroke == "" {
 		return fmt.Errorf("one of Svg, Fill, Stroke is empty: %+v", s)
@@ -79,6 +99,18 @@ type InitConnectionRequest struct {
 	PublicKey string
 }
 
+type WaitForConfirmationRequest struct {
+	OpHash      string
+	ValidateNum uint8
+}
+
+type GetStateProofRequest struct {
+	// BlockHash is the block to prove the state after.
+	BlockHash string
+	Map       StateMap
+	Key       string
+}
+
 func (o Operation) Hash() (string, error) {
 	o.OpSig = OpSig{}
 	return crypto.Hash(o)
@@ -100,6 +132,24 @@ func (o Operation) Sign(key ecdsa.PrivateKey) (Operation, error) {
 	return o, nil
 }
 
+// Size returns the number of bytes in the encoding of the operation.
+func (o Operation) Size() (int, error) {
+	data, err := json.Marshal(o)
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// Vertices returns the number of vertices in the shape an operation adds, the
+// geometric complexity it adds to a block. It's 0 for other operations.
+func (o Operation) Vertices() int {
+	if o.OpType != ADD {
+		return 0
+	}
+	return o.ADD.Shape.NumVertices()
+}
+
 func (o Operation) PubKeyString() (string, error) {
 	key, err := crypto.MarshalPublic(&o.PubKey)
 	if err != nil {
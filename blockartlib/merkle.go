@@ -0,0 +1,168 @@
+package blockartlib
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+// The Merkle tree of a block's operations. Leaves are the SHA-256 of each
+// operation's encoding, signature included, and each node is the SHA-256 of
+// its two children. The leaves and nodes are prefixed differently so a node
+// can't pass for a leaf. A node without a sibling moves up a level unchanged.
+const (
+	merkleLeafPrefix = 0
+	merkleNodePrefix = 1
+)
+
+func merkleLeaf(op Operation) ([]byte, error) {
+	data, err := json.Marshal(op)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+func merkleNode(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// merkleLevels returns every level of the tree, from the leaves up to the
+// root.
+func merkleLevels(ops []Operation) ([][][]byte, error) {
+	level := make([][]byte, 0, len(ops))
+	for _, op := range ops {
+		leaf, err := merkleLeaf(op)
+		if err != nil {
+			return nil, err
+		}
+		level = append(level, leaf)
+	}
+
+	levels := [][][]byte{level}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for j := 0; j < len(level); j += 2 {
+			if j+1 == len(level) {
+				next = append(next, level[j])
+			} else {
+				next = append(next, merkleNode(level[j], level[j+1]))
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels, nil
+}
+
+// MerkleRoot returns the root of the Merkle tree of the operations, or "" if
+// there aren't any.
+func MerkleRoot(ops []Operation) (string, error) {
+	if len(ops) == 0 {
+		return "", nil
+	}
+	levels, err := merkleLevels(ops)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(levels[len(levels)-1][0]), nil
+}
+
+// OperationProof proves that an operation is in the block with the header.
+type OperationProof struct {
+	Header    BlockHeader
+	Operation Operation
+	// Index is the index of the operation in the block's records and Count
+	// is the number of records.
+	Index int
+	Count int
+	// Path is the hashes of the siblings on the way from the operation's leaf
+	// to the root.
+	Path []string
+}
+
+// NewOperationProof returns the proof that the operation at index is in the
+// block.
+func NewOperationProof(block Block, index int) (OperationProof, error) {
+	if index < 0 || index >= len(block.Records) {
+		return OperationProof{}, fmt.Errorf("operation index %d out of range, the block has %d", index, len(block.Records))
+	}
+	levels, err := merkleLevels(block.Records)
+	if err != nil {
+		return OperationProof{}, err
+	}
+
+	proof := OperationProof{
+		Header:    block.BlockHeader,
+		Operation: block.Records[index],
+		Index:     index,
+		Count:     len(block.Records),
+	}
+	for _, level := range levels[:len(levels)-1] {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof.Path = append(proof.Path, hex.EncodeToString(level[sibling]))
+		}
+		index /= 2
+	}
+	return proof, nil
+}
+
+// VerifyOperationProof checks that the proof shows the operation with the
+// shape hash is in the block and returns the block's hash. It doesn't check
+// that the block is on the longest chain, the caller has to trust the hash
+// for that.
+// Can return the following errors:
+// - InvalidProofError
+func VerifyOperationProof(shapeHash string, proof OperationProof) (blockHash string, err error) {
+	if hash, err := proof.Operation.Hash(); err != nil || hash != shapeHash {
+		return "", InvalidProofError("operation isn't " + shapeHash)
+	}
+	if proof.Index < 0 || proof.Index >= proof.Count {
+		return "", InvalidProofError(fmt.Sprintf("index %d out of range, the block has %d", proof.Index, proof.Count))
+	}
+
+	hash, err := merkleLeaf(proof.Operation)
+	if err != nil {
+		return "", InvalidProofError(err.Error())
+	}
+	path := proof.Path
+	for index, n := proof.Index, proof.Count; n > 1; index, n = index/2, (n+1)/2 {
+		if index%2 == 0 && index+1 == n {
+			// No sibling, the node moves up unchanged.
+			continue
+		}
+		if len(path) == 0 {
+			return "", InvalidProofError("path too short")
+		}
+		sibling, err := hex.DecodeString(path[0])
+		if err != nil {
+			return "", InvalidProofError(err.Error())
+		}
+		path = path[1:]
+		if index%2 == 0 {
+			hash = merkleNode(hash, sibling)
+		} else {
+			hash = merkleNode(sibling, hash)
+		}
+	}
+	if len(path) != 0 {
+		return "", InvalidProofError("path too long")
+	}
+	if hex.EncodeToString(hash) != proof.Header.MerkleRoot {
+		return "", InvalidProofError("root doesn't match the block header")
+	}
+
+	blockHash, err = proof.Header.Hash()
+	if err != nil {
+		return "", InvalidProofError(err.Error())
+	}
+	return blockHash, nil
+}
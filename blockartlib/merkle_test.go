@@ -0,0 +1,89 @@
+package blockartlib
+
+import (
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+func TestOperationProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		block := Block{BlockHeader: BlockHeader{PrevBlock: "prev", BlockNum: 1}}
+		for j := 0; j < n; j++ {
+			op := Operation{OpType: ADD, Id: int64(j)}
+			op.ADD.Shape = TestShape(5, j)
+			block.Records = append(block.Records, op)
+		}
+		root, err := MerkleRoot(block.Records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.MerkleRoot = root
+		blockHash, err := block.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for j, op := range block.Records {
+			name := fmt.Sprintf("%d of %d", j, n)
+			shapeHash, err := op.Hash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			proof, err := NewOperationProof(block, j)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := VerifyOperationProof(shapeHash, proof); err != nil || got != blockHash {
+				t.Fatalf("%s: VerifyOperationProof(...) = %q, %v; wanted %q", name, got, err, blockHash)
+			}
+
+			// Proofs for another operation, position or block don't verify.
+			other := (j + 1) % n
+			otherHash, err := block.Records[other].Hash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n > 1 {
+				if _, err := VerifyOperationProof(otherHash, proof); err == nil {
+					t.Errorf("%s: proof verified for operation %d", name, other)
+				}
+				moved := proof
+				moved.Index = other
+				if _, err := VerifyOperationProof(shapeHash, moved); err == nil {
+					t.Errorf("%s: proof verified at index %d", name, other)
+				}
+				tampered := proof
+				tampered.Path = append([]string{fmt.Sprintf("%064x", 0)}, proof.Path[1:]...)
+				if _, err := VerifyOperationProof(shapeHash, tampered); err == nil {
+					t.Errorf("%s: proof verified with a tampered path", name)
+				}
+			}
+			wrongRoot := proof
+			wrongRoot.Header.MerkleRoot = otherHash
+			if _, err := VerifyOperationProof(shapeHash, wrongRoot); err == nil {
+				t.Errorf("%s: proof verified against the wrong root", name)
+			}
+		}
+	}
+}
+
+func TestMerkleRootCommitsToSignatures(t *testing.T) {
+	op := Operation{OpType: ADD, Id: 1}
+	op.ADD.Shape = TestShape(5, 0)
+	before, err := MerkleRoot([]Operation{op})
+	if err != nil {
+		t.Fatal(err)
+	}
+	op.OpSig = OpSig{R: big.NewInt(1), S: big.NewInt(1)}
+	after, err := MerkleRoot([]Operation{op})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before == after {
+		t.Fatal("expected the signature to change the Merkle root")
+	}
+	if root, _ := MerkleRoot(nil); root != "" {
+		t.Fatalf("MerkleRoot(nil) = %q; wanted \"\"", root)
+	}
+}
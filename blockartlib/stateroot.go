@@ -0,0 +1,250 @@
+package blockartlib
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"../crypto"
+)
+
+// StateMap is one of the maps of the canvas state a block's StateRoot commits
+// to.
+type StateMap int
+
+const (
+	// StateShapes maps shape hashes to the Shape on the canvas, including the
+	// white shapes left by deletes.
+	StateShapes StateMap = iota
+	// StateOwners maps shape hashes to the public key of their owner.
+	StateOwners
+	// StateInk maps public keys to their ink level.
+	StateInk
+	// StateOperations maps operation hashes to the BlockNum they were
+	// committed in.
+	StateOperations
+
+	// NumStateMaps is the number of maps in the state.
+	NumStateMaps
+)
+
+// The state root commits to the maps of the canvas state. Each map is a hash
+// array mapped trie like the miners keep it in: trie nodes hash their bitmap
+// and their children in order, and keys whose 64 bit hashes collide share a
+// node past the last level whose children are sorted. Each kind of hash has
+// its own prefix so one can't pass for another.
+const (
+	stateLeafPrefix = iota
+	stateNodePrefix
+	stateCollisionPrefix
+	stateRootPrefix
+)
+
+// EncodeStateValue returns the encoding of a value in the state that's hashed:
+// the JSON of a Shape, the bytes of an owner, and big endian ink levels and
+// BlockNums.
+func EncodeStateValue(value interface{}) []byte {
+	switch v := value.(type) {
+	case Shape:
+		// Shapes are all strings so they always encode.
+		data, _ := json.Marshal(v)
+		return data
+	case string:
+		return []byte(v)
+	case uint32:
+		var buf [4]byte
+		binary.BigEndian.PutUint32(buf[:], v)
+		return buf[:]
+	case int:
+		var buf [8]byte
+		binary.BigEndian.PutUint64(buf[:], uint64(v))
+		return buf[:]
+	default:
+		panic(fmt.Sprintf("unknown state value %T", value))
+	}
+}
+
+// DecodeStateValue decodes a value of the map encoded by EncodeStateValue.
+func DecodeStateValue(m StateMap, data []byte) (interface{}, error) {
+	switch m {
+	case StateShapes:
+		var shape Shape
+		if err := json.Unmarshal(data, &shape); err != nil {
+			return nil, err
+		}
+		return shape, nil
+	case StateOwners:
+		return string(data), nil
+	case StateInk:
+		if len(data) != 4 {
+			return nil, fmt.Errorf("ink level is %d bytes, wanted 4", len(data))
+		}
+		return binary.BigEndian.Uint32(data), nil
+	case StateOperations:
+		if len(data) != 8 {
+			return nil, fmt.Errorf("BlockNum is %d bytes, wanted 8", len(data))
+		}
+		return int(binary.BigEndian.Uint64(data)), nil
+	default:
+		return nil, fmt.Errorf("unknown state map %d", m)
+	}
+}
+
+// StateLeafHash returns the hash of a key and its encoded value.
+func StateLeafHash(key string, value []byte) []byte {
+	var length [binary.MaxVarintLen64]byte
+	h := sha256.New()
+	h.Write([]byte{stateLeafPrefix})
+	h.Write(length[:binary.PutUvarint(length[:], uint64(len(key)))])
+	h.Write([]byte(key))
+	h.Write(value)
+	return h.Sum(nil)
+}
+
+// StateNodeHash returns the hash of a trie node from its bitmap and the hashes
+// of its children. A bitmap of 0 is a collision node, whose children are
+// hashed in sorted order. The root of an empty map is the hash of a node
+// without children.
+func StateNodeHash(bitmap uint32, children [][]byte) []byte {
+	h := sha256.New()
+	if bitmap == 0 {
+		sorted := append([][]byte(nil), children...)
+		sort.Slice(sorted, func(a, b int) bool { return bytes.Compare(sorted[a], sorted[b]) < 0 })
+		h.Write([]byte{stateCollisionPrefix})
+		for _, child := range sorted {
+			h.Write(child)
+		}
+		return h.Sum(nil)
+	}
+
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], bitmap)
+	h.Write([]byte{stateNodePrefix})
+	h.Write(buf[:])
+	for _, child := range children {
+		h.Write(child)
+	}
+	return h.Sum(nil)
+}
+
+// StateRoot returns the state root from the roots of each StateMap in order.
+func StateRoot(mapRoots [][]byte) string {
+	h := sha256.New()
+	h.Write([]byte{stateRootPrefix})
+	for _, root := range mapRoots {
+		h.Write(root)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// StateProof proves the value of a key in the canvas state after a block.
+type StateProof struct {
+	Header BlockHeader
+	// MapRoots are the roots of each StateMap, the header's StateRoot is
+	// their StateRoot.
+	MapRoots []string
+	Map      StateMap
+	Key      string
+	Value    []byte
+	// Path is the nodes from the one holding the key's entry up to the root
+	// of the map.
+	Path []StateProofNode
+}
+
+// StateProofNode is a trie node on the path of a StateProof.
+type StateProofNode struct {
+	// Bitmap is 0 for collision nodes, see StateNodeHash.
+	Bitmap   uint32
+	Children []string
+	// Index is the child on the path.
+	Index int
+}
+
+// verify checks that the proof is for the key in the map and that it leads to
+// the header's state root. It returns the block's hash.
+func (p StateProof) verify(m StateMap, key string) (string, error) {
+	if p.Map != m || p.Key != key {
+		return "", InvalidProofError(fmt.Sprintf("proof is for %q in map %d", p.Key, p.Map))
+	}
+	if len(p.MapRoots) != int(NumStateMaps) {
+		return "", InvalidProofError(fmt.Sprintf("proof has %d map roots, wanted %d", len(p.MapRoots), NumStateMaps))
+	}
+
+	hash := StateLeafHash(key, p.Value)
+	for _, node := range p.Path {
+		if node.Bitmap != 0 && bits.OnesCount32(node.Bitmap) != len(node.Children) {
+			return "", InvalidProofError("node bitmap doesn't match its children")
+		}
+		if node.Index < 0 || node.Index >= len(node.Children) || node.Children[node.Index] != hex.EncodeToString(hash) {
+			return "", InvalidProofError("path doesn't lead to the entry")
+		}
+		children := make([][]byte, len(node.Children))
+		for j, child := range node.Children {
+			var err error
+			if children[j], err = hex.DecodeString(child); err != nil {
+				return "", InvalidProofError(err.Error())
+			}
+		}
+		hash = StateNodeHash(node.Bitmap, children)
+	}
+	if hex.EncodeToString(hash) != p.MapRoots[m] {
+		return "", InvalidProofError("path doesn't lead to the map root")
+	}
+
+	roots := make([][]byte, len(p.MapRoots))
+	for j, root := range p.MapRoots {
+		var err error
+		if roots[j], err = hex.DecodeString(root); err != nil {
+			return "", InvalidProofError(err.Error())
+		}
+	}
+	if StateRoot(roots) != p.Header.StateRoot {
+		return "", InvalidProofError("map roots don't match the block header")
+	}
+
+	blockHash, err := p.Header.Hash()
+	if err != nil {
+		return "", InvalidProofError(err.Error())
+	}
+	return blockHash, nil
+}
+
+// VerifyInkProof checks that the proof shows the key's ink level after the
+// block and returns it with the block's hash. Like VerifyOperationProof, the
+// caller has to trust the hash.
+// Can return the following errors:
+// - InvalidProofError
+func VerifyInkProof(pubKey ecdsa.PublicKey, proof StateProof) (ink uint32, blockHash string, err error) {
+	key, err := crypto.MarshalPublic(&pubKey)
+	if err != nil {
+		return 0, "", InvalidProofError(err.Error())
+	}
+	if blockHash, err = proof.verify(StateInk, key); err != nil {
+		return 0, "", err
+	}
+	if len(proof.Value) != 4 {
+		return 0, "", InvalidProofError("ink level isn't 4 bytes")
+	}
+	return binary.BigEndian.Uint32(proof.Value), blockHash, nil
+}
+
+// VerifyShapeProof checks that the proof shows the shape is on the canvas
+// after the block and returns it with the block's hash. Like
+// VerifyOperationProof, the caller has to trust the hash.
+// Can return the following errors:
+// - InvalidProofError
+func VerifyShapeProof(shapeHash string, proof StateProof) (shape Shape, blockHash string, err error) {
+	if blockHash, err = proof.verify(StateShapes, shapeHash); err != nil {
+		return Shape{}, "", err
+	}
+	if err := json.Unmarshal(proof.Value, &shape); err != nil {
+		return Shape{}, "", InvalidProofError(err.Error())
+	}
+	return shape, blockHash, nil
+}
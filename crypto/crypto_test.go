@@ -1,7 +1,10 @@
 package crypto
 
 import (
+	"crypto/ecdsa"
+	"crypto/tls"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"testing"
@@ -91,3 +94,53 @@ func TestLoadPrivateDirect(t *testing.T) {
 		t.Errorf("%q != %q", pubKey, pubKey2)
 	}
 }
+
+func TestTLSConfig(t *testing.T) {
+	clientKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverKey, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConfig, err := TLSConfig(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConfig, err := TLSConfig(serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, b := net.Pipe()
+	client := tls.Client(a, clientConfig)
+	server := tls.Server(b, serverConfig)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Handshake()
+	}()
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		conn *tls.Conn
+		want *ecdsa.PublicKey
+	}{
+		{client, &serverKey.PublicKey},
+		{server, &clientKey.PublicKey},
+	} {
+		key, err := PeerKey(c.conn.ConnectionState())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.X.Cmp(c.want.X) != 0 || key.Y.Cmp(c.want.Y) != 0 {
+			t.Fatalf("got key %+v; wanted %+v", key, c.want)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"math/big"
+	"time"
+)
+
+// TLSConfig returns a TLS config that presents a self signed certificate for
+// key and requires the other side to present one too. There's no certificate
+// authority, the TLS handshake only proves that each side has the private key
+// for the certificate it presented. Callers check that the key is the one
+// they expected with PeerKey.
+func TLSConfig(key *ecdsa.PrivateKey) (*tls.Config, error) {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template := x509.Certificate{
+		SerialNumber: serial,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{der},
+			PrivateKey:  key,
+		}},
+		ClientAuth: tls.RequireAnyClientCert,
+		// The certificates are self signed, the key is checked instead.
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			_, err := certKey(rawCerts)
+			return err
+		},
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// PeerKey returns the ECDSA public key the other side of a TLS connection
+// proved it has.
+func PeerKey(state tls.ConnectionState) (*ecdsa.PublicKey, error) {
+	if !state.HandshakeComplete {
+		return nil, errors.New("TLS handshake isn't complete")
+	}
+	var rawCerts [][]byte
+	for _, cert := range state.PeerCertificates {
+		rawCerts = append(rawCerts, cert.Raw)
+	}
+	return certKey(rawCerts)
+}
+
+func certKey(rawCerts [][]byte) (*ecdsa.PublicKey, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("no certificate presented")
+	}
+	cert, err := x509.ParseCertificate(rawCerts[0])
+	if err != nil {
+		return nil, err
+	}
+	key, ok := cert.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("certificate key isn't an ECDSA key")
+	}
+	return key, nil
+}
@@ -2,35 +2,135 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
+	"strings"
 
-	"./crypto"
 	"./inkminer"
 )
 
+var (
+	configFile = flag.String("config", "", "JSON config file, flags override values in it")
+
+	serverAddr     = flag.String("server", "", "address of the server")
+	publicKeyFile  = flag.String("public-key", "", "public key file")
+	privateKeyFile = flag.String("private-key", "", "private key file")
+
+	listenAddr  = flag.String("listen", inkminer.DefaultListenAddr, "host:port to listen on, IPv6 hosts go in brackets")
+	advertise   = flag.String("advertise", "", "host or host:port other miners should connect to, detected if empty")
+	adminAddr   = flag.String("admin", "", "host:port to serve unauthenticated admin calls on, should be a loopback address")
+	useTLS      = flag.Bool("tls", false, "use TLS for all connections, peers and art nodes have to prove their keys")
+	bootstrap   = flag.String("bootstrap", "", "comma separated list of peers to connect to")
+	maxInbound  = flag.Int("max-inbound", inkminer.DefaultMaxInbound, "maximum number of peers that connect to this miner")
+	maxOutbound = flag.Int("max-outbound", inkminer.DefaultMaxOutbound, "maximum number of peers this miner connects to")
+	banDuration = flag.Duration("ban-duration", inkminer.DefaultBanDuration, "how long misbehaving peers are banned for")
+	timeout     = flag.Duration("timeout", inkminer.DefaultTimeout, "how long network calls to other miners can take")
+
+	maxMempool    = flag.Int("max-mempool", inkminer.DefaultMaxMempool, "maximum number of operations waiting to be mined")
+	mempoolQuota  = flag.Int("mempool-quota", inkminer.DefaultMempoolQuota, "maximum number of operations from one public key waiting to be mined")
+	mempoolExpiry = flag.Duration("mempool-expiry", inkminer.DefaultMempoolExpiry, "how long an operation can wait to be mined")
+
+	maxBlockOps   = flag.Int("max-block-ops", inkminer.DefaultMaxBlockOps, "maximum number of operations in a mined block")
+	maxBlockBytes = flag.Int("max-block-bytes", inkminer.DefaultMaxBlockBytes, "maximum total size of the operations in a mined block")
+
+	miningThreads = flag.Int("mining-threads", 1, "number of threads to mine with")
+	blockDelay    = flag.Duration("block-delay", 0, "delay before mining each block")
+	stateCacheMB  = flag.Int("state-cache-mb", inkminer.DefaultStateCacheSize>>20, "megabytes of memory for recently used canvas states")
+	fastSync      = flag.Bool("fast-sync", false, "bootstrap from a peer's verified snapshot instead of replaying every block")
+
+	dataDir  = flag.String("data-dir", "", "directory to keep data in across restarts")
+	logLevel = flag.String("log-level", inkminer.LogInfo, "log level: info or silent")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ink-miner [flags] [<server addr> <public key file> <private key file>]\n")
+	flag.PrintDefaults()
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	args := flag.Args()
-	if len(args) != 3 {
-		log.Fatal("inkminer <server addr> <public key file> <private key file>")
+	config := inkminer.DefaultConfig()
+	if *configFile != "" {
+		var err error
+		config, err = inkminer.LoadConfig(*configFile)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	serverAddr := args[0]
-	pubKeyFile := args[1]
-	privKeyFile := args[2]
+	// Only flags that were set override the config file.
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "server":
+			config.ServerAddr = *serverAddr
+		case "public-key":
+			config.PublicKeyFile = *publicKeyFile
+		case "private-key":
+			config.PrivateKeyFile = *privateKeyFile
+		case "listen":
+			config.ListenAddr = *listenAddr
+		case "advertise":
+			config.AdvertiseAddr = *advertise
+		case "admin":
+			config.AdminAddr = *adminAddr
+		case "tls":
+			config.TLS = *useTLS
+		case "bootstrap":
+			config.Bootstrap = strings.Split(*bootstrap, ",")
+		case "max-inbound":
+			config.MaxInbound = *maxInbound
+		case "max-outbound":
+			config.MaxOutbound = *maxOutbound
+		case "ban-duration":
+			config.BanDuration = banDuration.String()
+		case "timeout":
+			config.Timeout = timeout.String()
+		case "max-mempool":
+			config.MaxMempool = *maxMempool
+		case "mempool-quota":
+			config.MempoolQuota = *mempoolQuota
+		case "mempool-expiry":
+			config.MempoolExpiry = mempoolExpiry.String()
+		case "max-block-ops":
+			config.MaxBlockOps = *maxBlockOps
+		case "max-block-bytes":
+			config.MaxBlockBytes = *maxBlockBytes
+		case "mining-threads":
+			config.MiningThreads = *miningThreads
+		case "block-delay":
+			config.BlockDelay = blockDelay.String()
+		case "state-cache-mb":
+			config.StateCacheMB = *stateCacheMB
+		case "fast-sync":
+			config.FastSync = *fastSync
+		case "data-dir":
+			config.DataDir = *dataDir
+		case "log-level":
+			config.LogLevel = *logLevel
+		}
+	})
 
-	privKey, err := crypto.LoadPrivate(pubKeyFile, privKeyFile)
-	if err != nil {
-		log.Fatal(err)
+	// The old positional form is still supported.
+	switch args := flag.Args(); len(args) {
+	case 0:
+	case 3:
+		config.ServerAddr = args[0]
+		config.PublicKeyFile = args[1]
+		config.PrivateKeyFile = args[2]
+	default:
+		usage()
+		os.Exit(2)
 	}
 
-	m, err := inkminer.New(privKey)
+	m, err := inkminer.NewFromConfig(config)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := m.Listen(serverAddr); err != nil {
+	if err := m.Listen(config.ServerAddr); err != nil {
 		log.Fatal(err)
 	}
 }
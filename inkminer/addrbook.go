@@ -0,0 +1,222 @@
+package inkminer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	server "../server"
+)
+
+// MaxAddrBook is the maximum number of addresses remembered. The addresses
+// seen longest ago are forgotten first.
+const MaxAddrBook = 5000
+
+// MaxGetAddrs is the maximum number of addresses returned by GetAddrs.
+const MaxGetAddrs = 1000
+
+// AddrTTL is how long an address is shared with peers after it was last seen.
+const AddrTTL = 3 * time.Hour
+
+// AddrInfo is a peer address and when it was last seen online.
+type AddrInfo struct {
+	Addr     string
+	LastSeen time.Time
+}
+
+// peersFile is the contents of the file the address book is saved to. The
+// settings are saved too so the miner can start without the server.
+type peersFile struct {
+	Settings *server.MinerNetSettings `json:"settings,omitempty"`
+	Addrs    []AddrInfo               `json:"addrs"`
+}
+
+// SetPeersFile sets the file the address book is saved to and loads any
+// addresses and settings already saved in it. A missing file is ignored.
+func (i *InkMiner) SetPeersFile(path string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.mu.peersFile = path
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var f peersFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	for _, info := range f.Addrs {
+		i.noteAddrLocked(info.Addr, info.LastSeen)
+	}
+	i.mu.savedSettings = f.Settings
+	return nil
+}
+
+// AddBootstrapPeers adds addresses that are always tried when looking for
+// peers, even if the server is unavailable.
+func (i *InkMiner) AddBootstrapPeers(addrs ...string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.mu.bootstrap = append(i.mu.bootstrap, addrs...)
+}
+
+// savePeersFile writes the address book and settings to the peers file if one
+// is set and anything changed.
+func (i *InkMiner) savePeersFile() error {
+	i.mu.Lock()
+	path := i.mu.peersFile
+	if path == "" || !i.mu.addrsDirty {
+		i.mu.Unlock()
+		return nil
+	}
+	f := peersFile{Addrs: i.addrsLocked(MaxAddrBook, time.Time{})}
+	if i.settings.GenesisBlockHash != "" {
+		settings := i.settings
+		f.Settings = &settings
+	}
+	i.mu.addrsDirty = false
+	i.mu.Unlock()
+
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file and rename it so a crash doesn't leave a
+	// partially written file.
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// noteAddrLocked records that addr was seen at the given time. It must be
+// locked before calling!
+func (i *InkMiner) noteAddrLocked(addr string, seen time.Time) {
+	if addr == "" || addr == i.addr {
+		return
+	}
+	if now := time.Now(); seen.After(now) {
+		seen = now
+	}
+	if last, ok := i.mu.addrs[addr]; ok && !seen.After(last) {
+		return
+	}
+
+	if _, ok := i.mu.addrs[addr]; !ok && len(i.mu.addrs) >= MaxAddrBook {
+		var oldest string
+		for a, last := range i.mu.addrs {
+			if oldest == "" || last.Before(i.mu.addrs[oldest]) {
+				oldest = a
+			}
+		}
+		delete(i.mu.addrs, oldest)
+	}
+	i.mu.addrs[addr] = seen
+	i.mu.addrsDirty = true
+}
+
+func (i *InkMiner) noteAddr(addr string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.noteAddrLocked(addr, time.Now())
+}
+
+// addrsLocked returns up to n addresses seen after since, most recently seen
+// first. Banned addresses are skipped. It must be locked before calling!
+func (i *InkMiner) addrsLocked(n int, since time.Time) []AddrInfo {
+	var addrs []AddrInfo
+	for addr, seen := range i.mu.addrs {
+		if seen.Before(since) || i.bannedLocked(addr) {
+			continue
+		}
+		addrs = append(addrs, AddrInfo{Addr: addr, LastSeen: seen})
+	}
+	sort.Slice(addrs, func(a, b int) bool {
+		return addrs[a].LastSeen.After(addrs[b].LastSeen)
+	})
+	if len(addrs) > n {
+		addrs = addrs[:n]
+	}
+	return addrs
+}
+
+type GetAddrsRequest struct{}
+
+type GetAddrsResponse struct {
+	Addrs []AddrInfo
+}
+
+// GetAddrs returns the addresses of peers this miner has seen recently.
+func (i *InkMinerRPC) GetAddrs(req GetAddrsRequest, resp *GetAddrsResponse) error {
+	i.i.mu.Lock()
+	defer i.i.mu.Unlock()
+
+	resp.Addrs = i.i.addrsLocked(MaxGetAddrs, time.Now().Add(-AddrTTL))
+	return nil
+}
+
+// exchangeAddrs asks a random peer for the addresses it knows about.
+func (i *InkMiner) exchangeAddrs() error {
+	peers := i.peerList("addrs")
+	if len(peers) == 0 {
+		return nil
+	}
+	p := peers[rand.Intn(len(peers))]
+
+	var resp GetAddrsResponse
+	if err := p.rpc.Call("InkMinerRPC.GetAddrs", GetAddrsRequest{}, &resp); err != nil {
+		return err
+	}
+	if len(resp.Addrs) > MaxGetAddrs {
+		i.misbehaving(p.address, PenaltyProtocol, "too many addresses")
+		return nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, info := range resp.Addrs {
+		i.noteAddrLocked(info.Addr, info.LastSeen)
+	}
+	return nil
+}
+
+// candidateAddrs returns addresses to try connecting to: the bootstrap peers
+// followed by the address book, most recently seen first. Connected and
+// banned peers are skipped.
+func (i *InkMiner) candidateAddrs() []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var addrs []string
+	seen := make(map[string]bool)
+	add := func(addr string) {
+		if seen[addr] || addr == i.addr || i.bannedLocked(addr) {
+			return
+		}
+		if _, ok := i.mu.peers[addr]; ok {
+			return
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+	for _, addr := range i.mu.bootstrap {
+		add(addr)
+	}
+	for _, info := range i.addrsLocked(MaxAddrBook, time.Time{}) {
+		add(info.Addr)
+	}
+	return addrs
+}
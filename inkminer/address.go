@@ -0,0 +1,85 @@
+package inkminer
+
+import (
+	"net"
+	"strconv"
+)
+
+// DefaultListenAddr listens on all interfaces on a random port.
+const DefaultListenAddr = ":0"
+
+// outboundProbes are the addresses used to find the IP of the interface with
+// a route to the internet. Nothing is sent to them.
+var outboundProbes = []string{"8.8.8.8:80", "[2001:4860:4860::8888]:80"}
+
+// SetListenAddr sets the host:port the miner binds to. The host can be an IPv4
+// or IPv6 address or empty for all interfaces, port 0 picks a random port. It
+// must be called before Listen.
+func (i *InkMiner) SetListenAddr(addr string) error {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.mu.listenAddr = addr
+	return nil
+}
+
+// SetAdvertiseAddr sets the address other miners are told to connect to. It's
+// either a host, in which case the listen port is used, or a host:port when
+// the miner is behind a port forward. It must be called before Listen.
+func (i *InkMiner) SetAdvertiseAddr(addr string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.mu.advertiseAddr = addr
+}
+
+// getOutboundIP sets up a UDP connection (but doesn't send anything) and uses
+// the local IP addressed assigned.
+func getOutboundIP() (net.IP, error) {
+	var err error
+	for _, probe := range outboundProbes {
+		var conn net.Conn
+		conn, err = net.Dial("udp", probe)
+		if err != nil {
+			continue
+		}
+		defer conn.Close()
+
+		return conn.LocalAddr().(*net.UDPAddr).IP, nil
+	}
+	return nil, err
+}
+
+// resolveAdvertiseAddr works out the address to advertise for a listener
+// bound to listenAddr. The configured advertise address is used if there is
+// one, then the bound host if it's a specific address, then the IP of the
+// outbound interface and finally loopback if there's no network at all.
+func (i *InkMiner) resolveAdvertiseAddr(listenAddr net.Addr) string {
+	i.mu.Lock()
+	advertise := i.mu.advertiseAddr
+	i.mu.Unlock()
+
+	port := strconv.Itoa(listenAddr.(*net.TCPAddr).Port)
+
+	if advertise != "" {
+		if _, _, err := net.SplitHostPort(advertise); err == nil {
+			return advertise
+		}
+		return net.JoinHostPort(advertise, port)
+	}
+
+	if ip := listenAddr.(*net.TCPAddr).IP; ip != nil && !ip.IsUnspecified() {
+		return net.JoinHostPort(ip.String(), port)
+	}
+
+	ip, err := getOutboundIP()
+	if err != nil {
+		i.log.Printf("failed to find outbound IP, advertising loopback: %s", err)
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+	return net.JoinHostPort(ip.String(), port)
+}
@@ -0,0 +1,157 @@
+package inkminer
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// BanThreshold is how far a peer's score can drop before it's banned.
+const BanThreshold = 100
+
+// DefaultBanDuration is how long misbehaving peers are banned for by default.
+const DefaultBanDuration = 24 * time.Hour
+
+// Penalties subtracted from a peer's score.
+const (
+	// PenaltyInvalid is for sending blocks or operations that fail
+	// validation.
+	PenaltyInvalid = 50
+	// PenaltyProtocol is for requests that break the protocol, such as too
+	// many items or repeated Hellos.
+	PenaltyProtocol = 20
+	// PenaltyTimeout is for failing to respond in time.
+	PenaltyTimeout = 10
+)
+
+// Ban is a peer that has been banned for misbehaving.
+type Ban struct {
+	Addr  string
+	Until time.Time
+}
+
+// SetBanDuration sets how long misbehaving peers are banned for.
+func (i *InkMiner) SetBanDuration(d time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.mu.banDuration = d
+}
+
+// misbehaving lowers the score of the peer at addr and bans and disconnects
+// it if it drops below the threshold.
+func (i *InkMiner) misbehaving(addr string, penalty int, reason string) {
+	i.mu.Lock()
+	if i.bannedLocked(addr) {
+		i.mu.Unlock()
+		return
+	}
+	i.mu.scores[addr] -= penalty
+	score := i.mu.scores[addr]
+	p := i.mu.peers[addr]
+	if score > -BanThreshold {
+		i.mu.Unlock()
+		i.log.Printf("peer %s misbehaving (score %d): %s", addr, score, reason)
+		return
+	}
+
+	delete(i.mu.scores, addr)
+	i.mu.bans[addr] = time.Now().Add(i.mu.banDuration)
+	i.mu.Unlock()
+
+	i.log.Printf("banning peer %s: %s", addr, reason)
+	if p != nil {
+		if err := i.removePeer(p); err != nil {
+			i.log.Printf("failed to remove peer: %s", err)
+		}
+	}
+}
+
+// behaving slowly restores the score of a peer that is responding correctly
+// so occasional failures don't add up to a ban.
+func (i *InkMiner) behaving(addr string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.mu.scores[addr] < 0 {
+		i.mu.scores[addr]++
+	}
+	if i.mu.scores[addr] == 0 {
+		delete(i.mu.scores, addr)
+	}
+}
+
+// bannedLocked returns whether the address is banned. Expired bans are
+// removed. It must be locked before calling!
+func (i *InkMiner) bannedLocked(addr string) bool {
+	until, ok := i.mu.bans[addr]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(i.mu.bans, addr)
+		return false
+	}
+	return true
+}
+
+func (i *InkMiner) banned(addr string) bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.bannedLocked(addr)
+}
+
+// Bans returns the currently banned peers.
+func (i *InkMiner) Bans() []Ban {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var bans []Ban
+	for addr := range i.mu.bans {
+		if i.bannedLocked(addr) {
+			bans = append(bans, Ban{Addr: addr, Until: i.mu.bans[addr]})
+		}
+	}
+	sort.Slice(bans, func(a, b int) bool {
+		return bans[a].Addr < bans[b].Addr
+	})
+	return bans
+}
+
+// ClearBan unbans the peer at addr, or all peers if addr is "".
+func (i *InkMiner) ClearBan(addr string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if addr == "" {
+		i.mu.bans = make(map[string]time.Time)
+		return
+	}
+	delete(i.mu.bans, addr)
+}
+
+type GetBansRequest struct{}
+
+type ClearBanRequest struct {
+	// Addr is the peer to unban or "" to unban all peers.
+	Addr string
+}
+
+// GetBans returns the banned peers.
+func (a *AdminRPC) GetBans(req GetBansRequest, resp *[]Ban) error {
+	*resp = a.i.Bans()
+	return nil
+}
+
+// ClearBan unbans a peer.
+func (a *AdminRPC) ClearBan(req ClearBanRequest, resp *bool) error {
+	a.i.ClearBan(req.Addr)
+	*resp = true
+	return nil
+}
+
+// bannedError is returned to banned peers.
+func bannedError(addr string) error {
+	return fmt.Errorf("peer %s is banned", addr)
+}
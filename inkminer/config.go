@@ -0,0 +1,262 @@
+package inkminer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"../crypto"
+)
+
+// Log levels.
+const (
+	// LogInfo logs everything.
+	LogInfo = "info"
+	// LogSilent disables logging.
+	LogSilent = "silent"
+)
+
+// Config is the configuration of a miner. It's loaded from a JSON file and
+// can be overridden by flags in ink-miner.go.
+type Config struct {
+	// ServerAddr is the address of the server. It's only optional if
+	// DataDir has the settings from a previous run.
+	ServerAddr     string `json:"server-addr"`
+	PublicKeyFile  string `json:"public-key-file"`
+	PrivateKeyFile string `json:"private-key-file"`
+
+	// ListenAddr is the host:port to listen on and AdvertiseAddr is the host
+	// or host:port other miners should connect to, see SetAdvertiseAddr.
+	ListenAddr    string `json:"listen-addr"`
+	AdvertiseAddr string `json:"advertise-addr"`
+	// AdminAddr is the host:port to serve admin calls on without
+	// authentication, "" to disable it. It should be a loopback address.
+	AdminAddr string `json:"admin-addr"`
+	TLS       bool   `json:"tls"`
+
+	// Bootstrap peers are always tried when looking for peers.
+	Bootstrap   []string `json:"bootstrap"`
+	MaxInbound  int      `json:"max-inbound"`
+	MaxOutbound int      `json:"max-outbound"`
+	// BanDuration is how long misbehaving peers are banned for, e.g. "24h".
+	BanDuration string `json:"ban-duration"`
+	// Timeout is how long network calls to other miners can take, e.g.
+	// "2s".
+	Timeout string `json:"timeout"`
+
+	// MaxMempool and MempoolQuota limit the number of operations waiting to
+	// be mined in total and from each public key. MempoolExpiry is how long
+	// they can wait, e.g. "1h".
+	MaxMempool    int    `json:"max-mempool"`
+	MempoolQuota  int    `json:"mempool-quota"`
+	MempoolExpiry string `json:"mempool-expiry"`
+
+	// MaxBlockOps and MaxBlockBytes limit the number of operations and
+	// their total encoded size in the blocks we mine.
+	MaxBlockOps   int `json:"max-block-ops"`
+	MaxBlockBytes int `json:"max-block-bytes"`
+
+	MiningThreads int `json:"mining-threads"`
+	// BlockDelay is how long to wait before mining each block, e.g. "10s".
+	// It limits CPU use while testing.
+	BlockDelay string `json:"block-delay"`
+	// StateCacheMB is the memory budget for recently used canvas states in
+	// megabytes, see SetStateCacheSize.
+	StateCacheMB int `json:"state-cache-mb"`
+	// FastSync bootstraps the miner from a peer's snapshot when it's far
+	// behind, see SetFastSync.
+	FastSync bool `json:"fast-sync"`
+
+	// DataDir is where the miner keeps the blockchain and peers across
+	// restarts, "" to keep nothing.
+	DataDir  string `json:"data-dir"`
+	LogLevel string `json:"log-level"`
+}
+
+// DefaultConfig returns the config used for anything that isn't set.
+func DefaultConfig() Config {
+	return Config{
+		ListenAddr:    DefaultListenAddr,
+		MaxInbound:    DefaultMaxInbound,
+		MaxOutbound:   DefaultMaxOutbound,
+		BanDuration:   DefaultBanDuration.String(),
+		Timeout:       DefaultTimeout.String(),
+		MaxMempool:    DefaultMaxMempool,
+		MempoolQuota:  DefaultMempoolQuota,
+		MempoolExpiry: DefaultMempoolExpiry.String(),
+		MaxBlockOps:   DefaultMaxBlockOps,
+		MaxBlockBytes: DefaultMaxBlockBytes,
+		MiningThreads: 1,
+		BlockDelay:    "0s",
+		StateCacheMB:  DefaultStateCacheSize >> 20,
+		LogLevel:      LogInfo,
+	}
+}
+
+// LoadConfig reads the config file at path on top of the defaults.
+func LoadConfig(path string) (Config, error) {
+	config := DefaultConfig()
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Config{}, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return Config{}, fmt.Errorf("invalid config file %s: %s", path, err)
+	}
+	return config, nil
+}
+
+// ConfigError is returned when a config value is invalid.
+type ConfigError string
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("InkMiner: invalid config [%s]", string(e))
+}
+
+func checkDuration(name, value string) (time.Duration, error) {
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, ConfigError(fmt.Sprintf("%s: %s", name, err))
+	}
+	if d < 0 {
+		return 0, ConfigError(fmt.Sprintf("%s must not be negative: %s", name, value))
+	}
+	return d, nil
+}
+
+func checkHostPort(name, value string) error {
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		return ConfigError(fmt.Sprintf("%s: %s", name, err))
+	}
+	return nil
+}
+
+// Validate returns a ConfigError describing the first invalid value.
+func (c Config) Validate() error {
+	if c.PublicKeyFile == "" || c.PrivateKeyFile == "" {
+		return ConfigError("public-key-file and private-key-file are required")
+	}
+	if c.ServerAddr == "" && c.DataDir == "" {
+		return ConfigError("server-addr is required unless data-dir has the settings from a previous run")
+	}
+	if c.ServerAddr != "" {
+		if err := checkHostPort("server-addr", c.ServerAddr); err != nil {
+			return err
+		}
+	}
+	if err := checkHostPort("listen-addr", c.ListenAddr); err != nil {
+		return err
+	}
+	if c.AdminAddr != "" {
+		if err := checkHostPort("admin-addr", c.AdminAddr); err != nil {
+			return err
+		}
+	}
+	for _, addr := range c.Bootstrap {
+		if err := checkHostPort("bootstrap", addr); err != nil {
+			return err
+		}
+	}
+	if c.MaxInbound < 0 || c.MaxOutbound < 0 {
+		return ConfigError("max-inbound and max-outbound must not be negative")
+	}
+	if c.MiningThreads < 1 {
+		return ConfigError(fmt.Sprintf("mining-threads must be at least 1: %d", c.MiningThreads))
+	}
+	if c.MaxMempool < 1 || c.MempoolQuota < 1 {
+		return ConfigError("max-mempool and mempool-quota must be at least 1")
+	}
+	if d, err := checkDuration("mempool-expiry", c.MempoolExpiry); err != nil {
+		return err
+	} else if d == 0 {
+		return ConfigError("mempool-expiry must be positive")
+	}
+	if c.MaxBlockOps < 1 || c.MaxBlockBytes < 1 {
+		return ConfigError("max-block-ops and max-block-bytes must be at least 1")
+	}
+	if c.StateCacheMB < 0 {
+		return ConfigError("state-cache-mb must not be negative")
+	}
+	if _, err := checkDuration("ban-duration", c.BanDuration); err != nil {
+		return err
+	}
+	if d, err := checkDuration("timeout", c.Timeout); err != nil {
+		return err
+	} else if d == 0 {
+		return ConfigError("timeout must be positive")
+	}
+	if _, err := checkDuration("block-delay", c.BlockDelay); err != nil {
+		return err
+	}
+	if c.LogLevel != LogInfo && c.LogLevel != LogSilent {
+		return ConfigError(fmt.Sprintf("log-level must be %q or %q: %q", LogInfo, LogSilent, c.LogLevel))
+	}
+	return nil
+}
+
+// NewFromConfig validates the config, loads the keys and returns a miner set
+// up with it. Call Listen with config.ServerAddr to start it.
+func NewFromConfig(config Config) (*InkMiner, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+
+	privKey, err := crypto.LoadPrivate(config.PublicKeyFile, config.PrivateKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load keys: %s", err)
+	}
+
+	i, err := New(privKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate already checked the durations.
+	banDuration, _ := time.ParseDuration(config.BanDuration)
+	timeout, _ := time.ParseDuration(config.Timeout)
+	blockDelay, _ := time.ParseDuration(config.BlockDelay)
+	mempoolExpiry, _ := time.ParseDuration(config.MempoolExpiry)
+
+	if err := i.SetListenAddr(config.ListenAddr); err != nil {
+		return nil, err
+	}
+	i.SetAdvertiseAddr(config.AdvertiseAddr)
+	if err := i.SetTLS(config.TLS); err != nil {
+		return nil, err
+	}
+	i.AddBootstrapPeers(config.Bootstrap...)
+	i.SetPeerLimits(config.MaxInbound, config.MaxOutbound)
+	i.SetBanDuration(banDuration)
+	i.SetMempoolLimits(config.MaxMempool, config.MempoolQuota, mempoolExpiry)
+	i.SetBlockLimits(config.MaxBlockOps, config.MaxBlockBytes)
+	i.timeout = timeout
+	i.miningThreads = config.MiningThreads
+	i.blockDelay = blockDelay
+	i.SetStateCacheSize(int64(config.StateCacheMB) << 20)
+	i.SetFastSync(config.FastSync)
+	i.adminAddr = config.AdminAddr
+	if config.LogLevel == LogSilent {
+		i.log.SetOutput(ioutil.Discard)
+	}
+
+	if config.DataDir != "" {
+		if err := os.MkdirAll(config.DataDir, 0700); err != nil {
+			return nil, err
+		}
+		if err := i.SetPeersFile(filepath.Join(config.DataDir, "peers.json")); err != nil {
+			return nil, err
+		}
+		store, err := OpenFileBlockStore(filepath.Join(config.DataDir, "blocks.log"))
+		if err != nil {
+			return nil, err
+		}
+		i.SetBlockStore(store)
+	}
+
+	return i, nil
+}
@@ -0,0 +1,142 @@
+package inkminer
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"../crypto"
+)
+
+func TestConfigValidate(t *testing.T) {
+	valid := DefaultConfig()
+	valid.ServerAddr = "127.0.0.1:1234"
+	valid.PublicKeyFile = "public.key"
+	valid.PrivateKeyFile = "private.key"
+	if err := valid.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		name   string
+		change func(c *Config)
+	}{
+		{"no keys", func(c *Config) { c.PrivateKeyFile = "" }},
+		{"no server or data dir", func(c *Config) { c.ServerAddr = "" }},
+		{"bad server", func(c *Config) { c.ServerAddr = "localhost" }},
+		{"bad listen", func(c *Config) { c.ListenAddr = "1234" }},
+		{"bad admin", func(c *Config) { c.AdminAddr = "admin" }},
+		{"bad bootstrap", func(c *Config) { c.Bootstrap = []string{"127.0.0.1:1", "peer"} }},
+		{"negative peers", func(c *Config) { c.MaxOutbound = -1 }},
+		{"no threads", func(c *Config) { c.MiningThreads = 0 }},
+		{"bad ban duration", func(c *Config) { c.BanDuration = "forever" }},
+		{"zero timeout", func(c *Config) { c.Timeout = "0s" }},
+		{"negative block delay", func(c *Config) { c.BlockDelay = "-1s" }},
+		{"bad log level", func(c *Config) { c.LogLevel = "debug" }},
+	}
+	for _, c := range cases {
+		config := valid
+		c.change(&config)
+		err := config.Validate()
+		if _, ok := err.(ConfigError); !ok {
+			t.Errorf("%s: expected ConfigError; got %v", c.name, err)
+		}
+	}
+
+	noServer := valid
+	noServer.ServerAddr = ""
+	noServer.DataDir = "data"
+	if err := noServer.Validate(); err != nil {
+		t.Errorf("expected a data dir to be enough; got %v", err)
+	}
+}
+
+func TestNewFromConfig(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privKey, err := crypto.MarshalPrivate(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := crypto.MarshalPublic(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "inkminer-TestNewFromConfig")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	publicPath := filepath.Join(dir, "public.key")
+	privatePath := filepath.Join(dir, "private.key")
+	if err := ioutil.WriteFile(publicPath, []byte(pubKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(privatePath, []byte(privKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	configPath := filepath.Join(dir, "config.json")
+	body := `{
+		"server-addr": "127.0.0.1:1234",
+		"public-key-file": "` + publicPath + `",
+		"private-key-file": "` + privatePath + `",
+		"bootstrap": ["127.0.0.1:2000"],
+		"max-inbound": 3,
+		"timeout": "5s",
+		"mining-threads": 2,
+		"data-dir": "` + filepath.Join(dir, "data") + `",
+		"log-level": "silent"
+	}`
+	if err := ioutil.WriteFile(configPath, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := LoadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Values missing from the file keep their defaults.
+	if config.MaxOutbound != DefaultMaxOutbound {
+		t.Errorf("expected the default max-outbound %d; got %d", DefaultMaxOutbound, config.MaxOutbound)
+	}
+
+	im, err := NewFromConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if im.publicKey != pubKey {
+		t.Errorf("expected the key from the config to be loaded")
+	}
+	if im.timeout != 5*time.Second {
+		t.Errorf("expected a timeout of 5s; got %s", im.timeout)
+	}
+	if im.miningThreads != 2 {
+		t.Errorf("expected 2 mining threads; got %d", im.miningThreads)
+	}
+	im.mu.Lock()
+	maxInbound, bootstrap, peersFile := im.mu.maxInbound, im.mu.bootstrap, im.mu.peersFile
+	im.mu.Unlock()
+	if maxInbound != 3 {
+		t.Errorf("expected max-inbound 3; got %d", maxInbound)
+	}
+	if len(bootstrap) != 1 || bootstrap[0] != "127.0.0.1:2000" {
+		t.Errorf("expected the bootstrap peer; got %v", bootstrap)
+	}
+	if peersFile != filepath.Join(dir, "data", "peers.json") {
+		t.Errorf("expected the peers file in the data dir; got %q", peersFile)
+	}
+
+	if err := ioutil.WriteFile(configPath, []byte(`{"timeout": 5}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfig(configPath); err == nil {
+		t.Errorf("expected an error for a malformed config file")
+	}
+}
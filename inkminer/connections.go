@@ -0,0 +1,280 @@
+package inkminer
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/rpc"
+	"sort"
+	"strings"
+)
+
+// Default connection limits.
+const (
+	DefaultMaxInbound  = 16
+	DefaultMaxOutbound = 8
+)
+
+// Inbound peers protected from eviction.
+const (
+	// ProtectByScore is the number of best behaved peers that are never
+	// evicted.
+	ProtectByScore = 2
+	// ProtectLongLived is the number of longest connected peers that are
+	// never evicted.
+	ProtectLongLived = 4
+)
+
+// SetPeerLimits sets the maximum number of inbound and outbound peers.
+func (i *InkMiner) SetPeerLimits(maxInbound, maxOutbound int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.mu.maxInbound = maxInbound
+	i.mu.maxOutbound = maxOutbound
+}
+
+// countPeersLocked returns the number of inbound and outbound peers. It must
+// be locked before calling!
+func (i *InkMiner) countPeersLocked() (inbound, outbound int) {
+	for _, p := range i.mu.peers {
+		if p.inbound {
+			inbound++
+		} else {
+			outbound++
+		}
+	}
+	return inbound, outbound
+}
+
+// netGroup returns the part of the address used to tell whether peers are on
+// the same network: the /16 for IPv4 and the host otherwise.
+func netGroup(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		return fmt.Sprintf("%d.%d", ip[0], ip[1])
+	}
+	return host
+}
+
+// evictionCandidateLocked picks an inbound peer to drop to make room for a new
+// one or returns nil if all of them are worth keeping. The best behaved and
+// longest connected peers are protected and then the newest peer from the
+// most common network is picked so we stay connected to many networks. It must
+// be locked before calling!
+func (i *InkMiner) evictionCandidateLocked() *peer {
+	var candidates []*peer
+	for _, p := range i.mu.peers {
+		if p.inbound {
+			candidates = append(candidates, p)
+		}
+	}
+
+	protect := func(n int, less func(a, b *peer) bool) {
+		sort.Slice(candidates, func(a, b int) bool {
+			return less(candidates[a], candidates[b])
+		})
+		if n > len(candidates) {
+			n = len(candidates)
+		}
+		candidates = candidates[n:]
+	}
+	protect(ProtectByScore, func(a, b *peer) bool {
+		if sa, sb := i.mu.scores[a.address], i.mu.scores[b.address]; sa != sb {
+			return sa > sb
+		}
+		return a.connected.Before(b.connected)
+	})
+	protect(ProtectLongLived, func(a, b *peer) bool {
+		return a.connected.Before(b.connected)
+	})
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	groups := make(map[string][]*peer)
+	for _, p := range candidates {
+		group := netGroup(p.address)
+		groups[group] = append(groups[group], p)
+	}
+	var evict []*peer
+	for _, group := range groups {
+		if len(group) > len(evict) || (len(group) == len(evict) && newestPeer(group).connected.After(newestPeer(evict).connected)) {
+			evict = group
+		}
+	}
+	return newestPeer(evict)
+}
+
+func newestPeer(peers []*peer) *peer {
+	var newest *peer
+	for _, p := range peers {
+		if newest == nil || p.connected.After(newest.connected) {
+			newest = p
+		}
+	}
+	return newest
+}
+
+// handleConn serves a new connection. Connections from other miners are
+// multiplexed so they can be used in both directions, anything else is an art
+// node.
+func (i *InkMiner) handleConn(conn net.Conn) {
+	conn, identity, err := i.secureConn(conn, false)
+	if err != nil {
+		i.log.Printf("TLS handshake failed: %s", err)
+		return
+	}
+
+	ok, r := isPeerConn(conn)
+	if !ok {
+		conn := bufferedConn{Conn: conn, r: r}
+		if identity == "" {
+			i.rs.ServeConn(conn)
+			return
+		}
+		rs := rpc.NewServer()
+		if err := rs.Register(&InkMinerRPC{i: i, identity: identity}); err != nil {
+			i.log.Printf("failed to register RPC: %s", err)
+			conn.Close()
+			return
+		}
+		rs.ServeConn(conn)
+		return
+	}
+
+	m := newMuxConn(conn, r)
+	i.servePeerConn(m, m.stream(dialerStream), identity)
+}
+
+// AdminRPC has the calls that manage the miner. It's only served on the admin
+// address, see serveAdmin.
+type AdminRPC struct {
+	i *InkMiner
+}
+
+// serveAdmin serves RPCs on the admin address, including AdminRPC. Callers
+// are trusted as the owner of the miner so the address should only be
+// reachable locally.
+func (i *InkMiner) serveAdmin() error {
+	if i.adminAddr == "" {
+		return nil
+	}
+
+	l, err := net.Listen("tcp", i.adminAddr)
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	i.mu.adminL = l
+	i.mu.Unlock()
+
+	rs := rpc.NewServer()
+	if err := rs.Register(&InkMinerRPC{i: i, identity: i.publicKey}); err != nil {
+		l.Close()
+		return err
+	}
+	if err := rs.Register(&AdminRPC{i: i}); err != nil {
+		l.Close()
+		return err
+	}
+
+	i.log.Printf("serving admin calls on %s", l.Addr())
+	go rs.Accept(l)
+	return nil
+}
+
+// servePeerConn serves RPCs from a peer on the stream. The RPC server knows
+// which connection the calls come from so Hello can attach the peer to it.
+func (i *InkMiner) servePeerConn(m *muxConn, s *muxStream, identity string) {
+	rs := rpc.NewServer()
+	if err := rs.Register(&InkMinerRPC{i: i, conn: m, identity: identity}); err != nil {
+		i.log.Printf("failed to register peer RPC: %s", err)
+		m.Close()
+		return
+	}
+	rs.ServeConn(s)
+}
+
+// acceptPeer adds the peer that dialed us over m. If we already have a
+// connection to the peer, the one opened by the miner with the lower address
+// is kept so both sides settle on the same connection.
+func (i *InkMiner) acceptPeer(address string, m *muxConn, handshake Handshake) (*peer, error) {
+	if address == i.addr {
+		return nil, fmt.Errorf("can't connect to self")
+	}
+	if i.banned(address) {
+		return nil, bannedError(address)
+	}
+
+	i.mu.Lock()
+	var drop []*peer
+	if existing, ok := i.mu.peers[address]; ok {
+		if !existing.inbound && strings.Compare(i.addr, address) < 0 {
+			i.mu.Unlock()
+			return nil, fmt.Errorf("already connected to %s", address)
+		}
+		delete(i.mu.peers, address)
+		drop = append(drop, existing)
+	}
+	if inbound, _ := i.countPeersLocked(); inbound >= i.mu.maxInbound {
+		evict := i.evictionCandidateLocked()
+		if evict == nil {
+			i.mu.Unlock()
+			return nil, fmt.Errorf("too many inbound peers")
+		}
+		delete(i.mu.peers, evict.address)
+		drop = append(drop, evict)
+	}
+	p := newPeer(address, rpc.NewClient(m.stream(acceptorStream)))
+	p.conn = m
+	p.inbound = true
+	p.negotiate(handshake)
+	i.mu.peers[address] = p
+	i.mu.Unlock()
+
+	for _, old := range drop {
+		i.log.Printf("dropping peer %s for %s", old, p)
+		if err := old.close(); err != nil {
+			i.log.Printf("failed to close peer: %s", err)
+		}
+	}
+
+	i.startPeer(p)
+	return p, nil
+}
+
+// connPeer returns the peer attached to the connection, nil if it hasn't
+// said Hello yet.
+func (i *InkMiner) connPeer(m *muxConn) *peer {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, p := range i.mu.peers {
+		if p.conn == m {
+			return p
+		}
+	}
+	return nil
+}
+
+// startPeer starts the background work for a newly connected peer.
+func (i *InkMiner) startPeer(p *peer) {
+	i.noteAddr(p.address)
+	go i.sendLoop(p)
+	go i.peerHeartBeat(p)
+	go i.sync()
+}
+
+// bufferedConn is a connection whose reads go through a buffered reader.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,102 @@
+package inkminer
+
+import (
+	"math/big"
+
+	"../blockartlib"
+)
+
+// blockMeta is the fork choice bookkeeping kept for every block in the
+// blockchain.
+type blockMeta struct {
+	// seen is the order the block was received in. Used to break ties between
+	// chains with the same amount of work.
+	seen uint64
+	// depth is the number of blocks between genesis and this block.
+	depth int
+	// work is the cumulative proof of work from genesis up to and including
+	// this block.
+	work *big.Int
+}
+
+// blockDifficulty returns the number of zeros required at the end of the hash
+// of the block. It only needs the header since blocks without operations are
+// the ones without a Merkle root, so headers from a snapshot can be checked
+// too.
+func (i *InkMiner) blockDifficulty(header blockartlib.BlockHeader) uint8 {
+	if header.MerkleRoot == "" {
+		return i.settings.PoWDifficultyNoOpBlock
+	}
+	return i.settings.PoWDifficultyOpBlock
+}
+
+// blockWork returns the expected number of hashes required to mine the block.
+// Each zero is a hex digit so that's 16^difficulty.
+func (i *InkMiner) blockWork(header blockartlib.BlockHeader) *big.Int {
+	return new(big.Int).Lsh(big.NewInt(1), 4*uint(i.blockDifficulty(header)))
+}
+
+// betterHead returns whether block a should be preferred over block b as the
+// head of the chain. The chain with the most work wins, then the block we saw
+// first and finally the lowest hash so every call picks the same block.
+func betterHead(aHash string, a blockMeta, bHash string, b blockMeta) bool {
+	if c := a.work.Cmp(b.work); c != 0 {
+		return c > 0
+	}
+	if a.seen != b.seen {
+		return a.seen < b.seen
+	}
+	return aHash < bHash
+}
+
+// headMetaLocked returns the metadata for the current head. It must be locked
+// before calling!
+func (i *InkMiner) headMetaLocked() blockMeta {
+	if m, ok := i.mu.meta[i.mu.head]; ok {
+		return m
+	}
+	// The head is the genesis block.
+	return blockMeta{work: big.NewInt(0)}
+}
+
+// addBlockMetaLocked records the fork choice metadata for a new block and
+// moves the head to it if it's better than the current head. It returns
+// whether the head moved. state is the state after the block. The block must
+// have been validated and its parent must already be in the blockchain. It
+// must be locked before calling!
+func (i *InkMiner) addBlockMetaLocked(hash string, block blockartlib.Block, state State) bool {
+	return i.moveHeadLocked(hash, block, state, i.recordBlockMetaLocked(hash, block.BlockHeader))
+}
+
+// recordBlockMetaLocked records the fork choice metadata for a new block
+// without moving the head. The parent's metadata must already be recorded. It
+// must be locked before calling!
+func (i *InkMiner) recordBlockMetaLocked(hash string, header blockartlib.BlockHeader) blockMeta {
+	parent := blockMeta{work: big.NewInt(0)}
+	if header.PrevBlock != i.settings.GenesisBlockHash {
+		parent = i.mu.meta[header.PrevBlock]
+	}
+
+	i.mu.seen++
+	m := blockMeta{
+		seen:  i.mu.seen,
+		depth: parent.depth + 1,
+		work:  new(big.Int).Add(parent.work, i.blockWork(header)),
+	}
+	i.mu.meta[hash] = m
+	return m
+}
+
+// moveHeadLocked moves the head to the block with the metadata m if it's
+// better than the current head and returns whether it moved. It must be
+// locked before calling!
+func (i *InkMiner) moveHeadLocked(hash string, block blockartlib.Block, state State, m blockMeta) bool {
+	if !betterHead(hash, m, i.mu.head, i.headMetaLocked()) {
+		return false
+	}
+	i.mu.head = hash
+	i.mu.currentHead = block
+	i.setHeadState(hash, block, state)
+	i.setMainChainLocked(hash, m.depth)
+	return true
+}
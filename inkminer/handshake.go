@@ -0,0 +1,134 @@
+package inkminer
+
+import (
+	"fmt"
+
+	"../crypto"
+)
+
+// ProtocolVersion is the version of the miner to miner protocol. It's bumped
+// whenever a change isn't compatible with older miners.
+const ProtocolVersion = 1
+
+// MinProtocolVersion is the oldest protocol version we can talk to.
+const MinProtocolVersion = 1
+
+// SoftwareVersion is the version of this build. It can be set with
+// -ldflags "-X ...inkminer.SoftwareVersion=...".
+var SoftwareVersion = "dev"
+
+// Capabilities are the optional protocol features this miner supports.
+var Capabilities = []string{"inv", "headers", "addrs", "snapshot"}
+
+// Handshake identifies the network and protocol a miner is running. It's
+// exchanged in Hello so miners from other networks or incompatible builds
+// aren't peered with.
+type Handshake struct {
+	ProtocolVersion  int
+	SoftwareVersion  string
+	GenesisBlockHash string
+	// SettingsHash is a hash of the network settings that affect which blocks
+	// are valid.
+	SettingsHash string
+	Capabilities []string
+}
+
+// IncompatiblePeerError is returned when a peer is on a different network or
+// runs an incompatible protocol version.
+type IncompatiblePeerError string
+
+func (e IncompatiblePeerError) Error() string {
+	return fmt.Sprintf("InkMiner: incompatible peer [%s]", string(e))
+}
+
+// settingsHash hashes the settings all miners on a network have to agree on.
+// Settings that only affect a single miner, like the heartbeat, are left out.
+func (i *InkMiner) settingsHash() (string, error) {
+	return crypto.Hash(struct {
+		GenesisBlockHash       string
+		InkPerOpBlock          uint32
+		InkPerNoOpBlock        uint32
+		PoWDifficultyOpBlock   uint8
+		PoWDifficultyNoOpBlock uint8
+		CanvasXMax             uint32
+		CanvasYMax             uint32
+		MaxBlockOps            uint32
+		MaxBlockBytes          uint32
+		MaxBlockVertices       uint32
+	}{
+		i.settings.GenesisBlockHash,
+		i.settings.InkPerOpBlock,
+		i.settings.InkPerNoOpBlock,
+		i.settings.PoWDifficultyOpBlock,
+		i.settings.PoWDifficultyNoOpBlock,
+		i.settings.CanvasSettings.CanvasXMax,
+		i.settings.CanvasSettings.CanvasYMax,
+		i.settings.MaxBlockOps,
+		i.settings.MaxBlockBytes,
+		i.settings.MaxBlockVertices,
+	})
+}
+
+// handshake returns this miner's handshake.
+func (i *InkMiner) handshake() (Handshake, error) {
+	settingsHash, err := i.settingsHash()
+	if err != nil {
+		return Handshake{}, err
+	}
+	return Handshake{
+		ProtocolVersion:  ProtocolVersion,
+		SoftwareVersion:  SoftwareVersion,
+		GenesisBlockHash: i.settings.GenesisBlockHash,
+		SettingsHash:     settingsHash,
+		Capabilities:     Capabilities,
+	}, nil
+}
+
+// checkHandshake returns an IncompatiblePeerError if we can't peer with a
+// miner that sent h.
+func (i *InkMiner) checkHandshake(h Handshake) error {
+	if h.ProtocolVersion < MinProtocolVersion {
+		return IncompatiblePeerError(fmt.Sprintf("protocol version %d is older than %d", h.ProtocolVersion, MinProtocolVersion))
+	}
+	if h.GenesisBlockHash != i.settings.GenesisBlockHash {
+		return IncompatiblePeerError(fmt.Sprintf("genesis block %s, wanted %s", h.GenesisBlockHash, i.settings.GenesisBlockHash))
+	}
+	settingsHash, err := i.settingsHash()
+	if err != nil {
+		return err
+	}
+	if h.SettingsHash != settingsHash {
+		return IncompatiblePeerError(fmt.Sprintf("settings hash %s, wanted %s", h.SettingsHash, settingsHash))
+	}
+	return nil
+}
+
+// negotiate records the protocol version and capabilities both sides support
+// on the peer.
+func (p *peer) negotiate(h Handshake) {
+	p.version = h.ProtocolVersion
+	if p.version > ProtocolVersion {
+		p.version = ProtocolVersion
+	}
+	p.softwareVersion = h.SoftwareVersion
+
+	p.capabilities = nil
+	for _, theirs := range h.Capabilities {
+		for _, ours := range Capabilities {
+			if theirs == ours {
+				p.capabilities = append(p.capabilities, ours)
+				break
+			}
+		}
+	}
+}
+
+// hasCapability returns whether both sides support the capability.
+func (p *peer) hasCapability(capability string) bool {
+	for _, c := range p.capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
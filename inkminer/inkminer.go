@@ -2,12 +2,13 @@ package inkminer
 
 import (
 	"crypto/ecdsa"
+	"crypto/tls"
 	"log"
 	"net"
 	"net/rpc"
 	"os"
-	"strconv"
 	"sync"
+	"time"
 
 	blockartlib "../blockartlib"
 	colors "../colors"
@@ -27,6 +28,28 @@ type InkMiner struct {
 	stopper  *stopper.Stopper
 	log      *log.Logger
 
+	// These are set by NewFromConfig before Listen is called.
+	timeout       time.Duration // how long network calls to other miners can take
+	miningThreads int
+	blockDelay    time.Duration // how long to wait before mining each block
+	adminAddr     string        // address to serve unauthenticated admin calls on
+	store         BlockStore    // where validated blocks are kept across restarts
+
+	// states of the canvas at a given block, only snapshots and recently used
+	// states are kept. It has its own lock.
+	states *stateCache
+
+	// head is the current head and its state. It's updated whenever the head
+	// moves so read only calls can use it without locking mu or calculating
+	// the state. If both are locked, mu is locked first.
+	head struct {
+		sync.RWMutex
+
+		hash  string
+		block blockartlib.Block
+		state State
+	}
+
 	// newOpChan should be used to notify the mining loop about new operations
 	newOpChan chan blockartlib.Operation
 	// newBlockChan should be used to notify the mining loop about new blocks
@@ -36,21 +59,93 @@ type InkMiner struct {
 	mu struct {
 		sync.Mutex
 
-		l     net.Listener
-		peers map[string]*peer
+		l net.Listener
+		// listenAddr is the address to bind to and advertiseAddr is the
+		// address given to other miners, see SetAdvertiseAddr
+		listenAddr    string
+		advertiseAddr string
+		// adminL is the admin listener, nil if there isn't one
+		adminL net.Listener
+		peers  map[string]*peer
+		// maxInbound and maxOutbound limit the number of peers that dialed
+		// us and that we dialed
+		maxInbound  int
+		maxOutbound int
 
 		// blockchain is a map between blockhash and the block
 		blockchain map[string]blockartlib.Block
+		// shapeIndex maps operation hashes, which are also the hashes of
+		// the shapes they draw, to the blocks they're in
+		shapeIndex map[string]*shapeEntry
+		// blockOps are the operation hashes of each block in order
+		blockOps map[string][]string
 		// all operations that haven't been added to the current block chain
-		mempool map[string]blockartlib.Operation
+		// and mined operations that could still be reorged out
+		mempool map[string]mempoolEntry
+		// mempoolByKey is the number of operations in the mempool from each
+		// public key and mempoolPending is the total, not counting mined
+		// operations
+		mempoolByKey   map[string]int
+		mempoolPending int
+		maxMempool     int
+		mempoolQuota   int
+		mempoolExpiry  time.Duration
+		// maxBlockOps and maxBlockBytes limit the blocks we mine, see
+		// SetBlockLimits
+		maxBlockOps   int
+		maxBlockBytes int
 		// currentHead is the block that InkMiner is mining on
 		currentHead blockartlib.Block
-		// states of the canvas at a given block
-		states map[string]State
-		// opErrors counts the first BlockNum a transaction errors on.
+		// head is the hash of currentHead
+		head string
+		// meta is the fork choice metadata for every block in blockchain
+		meta map[string]blockMeta
+		// mainChain is the hashes of the blocks on the chain ending at head,
+		// mainChain[d-1] is the block at depth d
+		mainChain []string
+		// syncing is whether a sync with our peers is running
+		syncing bool
+		// fastSync is whether to bootstrap from a peer's snapshot when we're
+		// far behind, see SetFastSync
+		fastSync bool
+		// seen is the number of blocks (including orphans) that have been
+		// received
+		seen uint64
+		// orphans are valid nonce blocks whose parent we don't have yet
+		orphans map[string]orphan
+		// orphansByParent maps a missing parent hash to the orphans waiting on
+		// it
+		orphansByParent map[string][]string
+		// addrs is the address book, when each known peer address was last
+		// seen
+		addrs      map[string]time.Time
+		addrsDirty bool
+		// peersFile is where the address book is saved, "" if it isn't
+		peersFile string
+		// savedSettings are the settings loaded from peersFile
+		savedSettings *server.MinerNetSettings
+		// bootstrap peers are always tried when looking for peers
+		bootstrap []string
+		// tlsConfig is used for all connections if TLS is on
+		tlsConfig *tls.Config
+		// peerKeys are the keys peers at each address have proven they have,
+		// marshalled with elliptic.Marshal
+		peerKeys map[string][]byte
+		// scores of peers that have misbehaved, peers are banned once their
+		// score drops to -BanThreshold
+		scores map[string]int
+		// bans is when each banned peer's ban expires
+		bans        map[string]time.Time
+		banDuration time.Duration
+		// requested is when each missing block was last requested from peers
+		requested map[string]time.Time
+		// opErrors counts the first BlockNum a transaction errors on and
+		// the last error.
 		opErrors map[string]opError
 
-		validateNumMap map[string]ValidateNumWaiter
+		validateNumMap map[string][]ValidateNumWaiter
+		// confirmations of operations that art nodes have waited on
+		confirmations map[string]confirmation
 
 		// closed is whether the miner is closed, mostly used for tests
 		closed bool
@@ -58,24 +153,27 @@ type InkMiner struct {
 }
 
 func (i *InkMiner) currentHead() blockartlib.Block {
-	i.mu.Lock()
-	defer i.mu.Unlock()
-
-	return i.mu.currentHead
+	_, block, _ := i.headState()
+	return block
 }
 
-// getOutboundIP sets up a UDP connection (but doesn't send anything) and uses
-// the local IP addressed assigned.
-func getOutboundIP() string {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer conn.Close()
+// headState returns the hash, block and state of the current head without
+// locking mu.
+func (i *InkMiner) headState() (string, blockartlib.Block, State) {
+	i.head.RLock()
+	defer i.head.RUnlock()
+
+	return i.head.hash, i.head.block, i.head.state
+}
 
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
+// setHeadState records the new head and its state.
+func (i *InkMiner) setHeadState(hash string, block blockartlib.Block, state State) {
+	i.head.Lock()
+	defer i.head.Unlock()
 
-	return localAddr.IP.String()
+	i.head.hash = hash
+	i.head.block = block
+	i.head.state = state
 }
 
 func New(privKey *ecdsa.PrivateKey) (*InkMiner, error) {
@@ -83,13 +181,38 @@ func New(privKey *ecdsa.PrivateKey) (*InkMiner, error) {
 		stopper:      stopper.New(),
 		newOpChan:    make(chan blockartlib.Operation, 1),
 		newBlockChan: make(chan blockartlib.Block, 1),
+
+		timeout:       DefaultTimeout,
+		miningThreads: 1,
+		store:         NewMemoryBlockStore(),
 	}
 
-	i.mu.states = make(map[string]State)
+	i.states = newStateCache(DefaultStateCacheSize)
 	i.mu.blockchain = make(map[string]blockartlib.Block)
-	i.mu.mempool = make(map[string]blockartlib.Operation)
+	i.mu.shapeIndex = make(map[string]*shapeEntry)
+	i.mu.blockOps = make(map[string][]string)
+	i.mu.meta = make(map[string]blockMeta)
+	i.mu.orphans = make(map[string]orphan)
+	i.mu.orphansByParent = make(map[string][]string)
+	i.mu.requested = make(map[string]time.Time)
+	i.mu.mempool = make(map[string]mempoolEntry)
+	i.mu.mempoolByKey = make(map[string]int)
+	i.mu.maxMempool = DefaultMaxMempool
+	i.mu.mempoolQuota = DefaultMempoolQuota
+	i.mu.mempoolExpiry = DefaultMempoolExpiry
+	i.mu.maxBlockOps = DefaultMaxBlockOps
+	i.mu.maxBlockBytes = DefaultMaxBlockBytes
+	i.mu.listenAddr = DefaultListenAddr
 	i.mu.peers = make(map[string]*peer)
-	i.mu.validateNumMap = make(map[string]ValidateNumWaiter)
+	i.mu.maxInbound = DefaultMaxInbound
+	i.mu.maxOutbound = DefaultMaxOutbound
+	i.mu.addrs = make(map[string]time.Time)
+	i.mu.scores = make(map[string]int)
+	i.mu.peerKeys = make(map[string][]byte)
+	i.mu.bans = make(map[string]time.Time)
+	i.mu.banDuration = DefaultBanDuration
+	i.mu.validateNumMap = make(map[string][]ValidateNumWaiter)
+	i.mu.confirmations = make(map[string]confirmation)
 	i.mu.opErrors = make(map[string]opError)
 
 	i.privKey = privKey
@@ -111,7 +234,7 @@ func New(privKey *ecdsa.PrivateKey) (*InkMiner, error) {
 }
 
 func (i *InkMiner) RPC() *InkMinerRPC {
-	return &InkMinerRPC{i}
+	return &InkMinerRPC{i: i}
 }
 
 func (i *InkMiner) BlockPoolSize() int {
@@ -129,8 +252,11 @@ func (i *InkMiner) MemPoolSize() int {
 }
 
 func (i *InkMiner) Listen(serverAddr string) error {
-	localIP := getOutboundIP()
-	l, err := net.Listen("tcp", ":0")
+	i.mu.Lock()
+	listenAddr := i.mu.listenAddr
+	i.mu.Unlock()
+
+	l, err := net.Listen("tcp", listenAddr)
 	if err != nil {
 		return err
 	}
@@ -139,45 +265,54 @@ func (i *InkMiner) Listen(serverAddr string) error {
 	i.mu.l = l
 	i.mu.Unlock()
 
-	localAddr := localIP + ":" + strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	localAddr := i.resolveAdvertiseAddr(l.Addr())
 	i.addr = localAddr
 
 	i.log.SetPrefix(colors.Green(i.addr) + " ")
 	i.log.Printf("InkMiner listening on %s", localAddr)
 
-	client, err := dialRPC(serverAddr)
+	resp, err := i.register(serverAddr, localAddr)
 	if err != nil {
-		return err
-	}
-	i.client = client
-
-	tcpAddr, err := net.ResolveTCPAddr("tcp", localAddr)
-	if err != nil {
-		return err
-	}
-
-	req := server.MinerInfo{
-		Key:     i.privKey.PublicKey,
-		Address: tcpAddr,
-	}
-	var resp server.MinerNetSettings
-	if err := client.Call("RServer.Register", req, &resp); err != nil {
-		return err
+		// After the first join the server is optional, we can use the
+		// settings we saved and find peers from the address book.
+		i.mu.Lock()
+		saved := i.mu.savedSettings
+		i.mu.Unlock()
+		if saved == nil {
+			return err
+		}
+		i.log.Printf("failed to register with server, using saved settings: %s", err)
+		resp = *saved
 	}
 
 	i.mu.Lock()
 	i.settings = resp
+	i.mu.addrsDirty = true
 	// Set currentHead to a dummy block initially so we can return saneish
 	// results. This might be a terrible idea.
 	i.mu.currentHead = blockartlib.Block{
-		PrevBlock: i.settings.GenesisBlockHash,
-		BlockNum:  1,
-		PubKey:    i.privKey.PublicKey,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: i.settings.GenesisBlockHash,
+			BlockNum:  1,
+			PubKey:    i.privKey.PublicKey,
+		},
 	}
+	i.mu.head = i.settings.GenesisBlockHash
+	i.setHeadState(i.mu.head, i.mu.currentHead, NewState())
 	i.mu.Unlock()
 
+	if err := i.restoreBlocks(); err != nil {
+		return err
+	}
+
+	if err := i.serveAdmin(); err != nil {
+		return err
+	}
+
 	go i.peerDiscoveryLoop()
-	go i.heartbeatLoop()
+	if i.client != nil {
+		go i.heartbeatLoop()
+	}
 
 	if err := i.startMining(); err != nil {
 		return err
@@ -196,13 +331,46 @@ func (i *InkMiner) Listen(serverAddr string) error {
 			continue
 		}
 		i.log.Printf("New connection from: %s", conn.RemoteAddr())
-		go i.rs.ServeConn(conn)
+		go i.handleConn(conn)
 	}
 
 	return nil
 }
 
+// register registers the miner with the server and returns the network
+// settings.
+func (i *InkMiner) register(serverAddr, localAddr string) (server.MinerNetSettings, error) {
+	var resp server.MinerNetSettings
+
+	client, err := dialRPC(serverAddr, i.timeout)
+	if err != nil {
+		return resp, err
+	}
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", localAddr)
+	if err != nil {
+		client.Close()
+		return resp, err
+	}
+
+	req := server.MinerInfo{
+		Key:     i.privKey.PublicKey,
+		Address: tcpAddr,
+	}
+	if err := client.Call("RServer.Register", req, &resp); err != nil {
+		client.Close()
+		return resp, err
+	}
+
+	i.client = client
+	return resp, nil
+}
+
 func (i *InkMiner) Close() error {
+	if err := i.savePeersFile(); err != nil {
+		i.log.Printf("failed to save peers file: %s", err)
+	}
+
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
@@ -213,12 +381,24 @@ func (i *InkMiner) Close() error {
 
 	i.log.Printf("closing...")
 
-	if err := i.client.Close(); err != nil {
-		return err
+	if i.client != nil {
+		if err := i.client.Close(); err != nil {
+			return err
+		}
 	}
 
 	i.stopper.Stop()
 
+	if err := i.store.Close(); err != nil {
+		return err
+	}
+
+	if i.mu.adminL != nil {
+		if err := i.mu.adminL.Close(); err != nil {
+			return err
+		}
+	}
+
 	return i.mu.l.Close()
 }
 
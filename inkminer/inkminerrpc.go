@@ -10,6 +10,12 @@ import (
 
 type InkMinerRPC struct {
 	i *InkMiner
+	// conn is the peer connection the calls are coming from, nil for art
+	// nodes.
+	conn *muxConn
+	// identity is the public key the caller proved it has over TLS, "" if
+	// the connection isn't using TLS.
+	identity string
 }
 
 func (i *InkMinerRPC) TestConnection(req *string, resp *bool) error {
@@ -19,7 +25,7 @@ func (i *InkMinerRPC) TestConnection(req *string, resp *bool) error {
 
 func (i *InkMinerRPC) InitConnection(req blockartlib.InitConnectionRequest, resp *server.CanvasSettings) error {
 	// Confirm that this is the right public key for this InkMiner
-	if req.PublicKey != i.i.publicKey {
+	if !i.authorized(req.PublicKey) {
 		return blockartlib.DisconnectedError(i.i.Addr())
 	}
 	*resp = i.i.settings.CanvasSettings
@@ -31,22 +37,15 @@ func (i *InkMiner) testOperation(op blockartlib.Operation) error {
 		return err
 	}
 
-	block := i.currentHead()
-	blockHash, err := block.Hash()
-	if err != nil {
-		return err
-	}
-
-	state, err := i.CalculateState(block)
-	if err != nil {
-		return err
-	}
+	blockHash, block, state := i.headState()
 
 	testBlock := blockartlib.Block{
-		PrevBlock: blockHash,
-		BlockNum:  block.BlockNum + 1,
-		PubKey:    i.privKey.PublicKey,
-		Records:   []blockartlib.Operation{op},
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: blockHash,
+			BlockNum:  block.BlockNum + 1,
+			PubKey:    i.privKey.PublicKey,
+		},
+		Records: []blockartlib.Operation{op},
 	}
 	if _, err := i.TransformState(state, testBlock); err != nil {
 		return err
@@ -74,10 +73,7 @@ func (i *InkMinerRPC) AddShape(req *blockartlib.Operation, resp *blockartlib.Add
 		return err
 	}
 
-	state, err := i.i.CalculateState(i.i.currentHead())
-	if err != nil {
-		return err
-	}
+	_, _, state := i.i.headState()
 
 	pubKey, err := req.PubKeyString()
 	if err != nil {
@@ -86,41 +82,33 @@ func (i *InkMinerRPC) AddShape(req *blockartlib.Operation, resp *blockartlib.Add
 
 	*resp = blockartlib.AddShapeResponse{
 		BlockHash:    blockHash,
-		InkRemaining: state.inkLevels[pubKey],
+		InkRemaining: state.inkLevel(pubKey),
 	}
 	return nil
 }
 
 func (i *InkMinerRPC) GetSvgString(req *string, resp *string) error {
-	tryBlocks := []blockartlib.Block{i.i.currentHead()}
-	i.i.mu.Lock()
-	for _, block := range i.i.mu.blockchain {
-		tryBlocks = append(tryBlocks, block)
+	// Most shapes are on the canvas at the head.
+	_, _, head := i.i.headState()
+	if shape, ok := head.shape(*req); ok {
+		*resp = shape.SvgString()
+		return nil
 	}
-	i.i.mu.Unlock()
-
-	for _, block := range tryBlocks {
-		state, err := i.i.CalculateState(block)
-		if err != nil {
-			i.i.log.Printf("CalculateState error: %+v", err)
-			continue
-		}
 
-		if shape, ok := state.shapes[*req]; ok {
-			*resp = shape.SvgString()
-			return nil
-		}
+	i.i.mu.Lock()
+	shape, ok := i.i.shapeLocked(*req)
+	i.i.mu.Unlock()
+	if !ok {
+		return blockartlib.InvalidShapeHashError(*req)
 	}
-	return blockartlib.InvalidShapeHashError(*req)
+	*resp = shape.SvgString()
+	return nil
 }
 
 func (i *InkMinerRPC) GetInk(req *string, resp *uint32) error {
-	state, err := i.i.CalculateState(i.i.currentHead())
-	if err != nil {
-		return err
-	}
+	_, _, state := i.i.headState()
 
-	*resp = state.inkLevels[i.i.publicKey]
+	*resp = state.inkLevel(i.i.publicKey)
 	return nil
 }
 
@@ -141,17 +129,14 @@ func (i *InkMinerRPC) DeleteShape(req *blockartlib.Operation, resp *uint32) erro
 		return err
 	}
 
-	state, err := i.i.CalculateState(i.i.currentHead())
-	if err != nil {
-		return err
-	}
+	_, _, state := i.i.headState()
 
 	pubKey, err := req.PubKeyString()
 	if err != nil {
 		return err
 	}
 
-	*resp = state.inkLevels[pubKey]
+	*resp = state.inkLevel(pubKey)
 	return nil
 }
 
@@ -161,21 +146,16 @@ func (i *InkMinerRPC) GetShapes(req *string, resp *blockartlib.GetShapesResponse
 		return nil
 	}
 
-	block, ok := i.i.GetBlock(*req)
+	i.i.mu.Lock()
+	defer i.i.mu.Unlock()
+
+	hashes, ok := i.i.mu.blockOps[*req]
 	if !ok {
 		return blockartlib.InvalidBlockHashError(*req)
 	}
-
-	getShapesResponse := blockartlib.GetShapesResponse{}
-	for i := 0; i < len(block.Records); i++ {
-		op := block.Records[i]
-		hash, err := op.Hash()
-		if err != nil {
-			return err
-		}
-		getShapesResponse.ShapeHashes = append(getShapesResponse.ShapeHashes, hash)
+	*resp = blockartlib.GetShapesResponse{
+		ShapeHashes: append([]string(nil), hashes...),
 	}
-	*resp = getShapesResponse
 	return nil
 }
 
@@ -204,21 +184,41 @@ func (i *InkMinerRPC) GetChildrenBlocks(req *string, resp *blockartlib.GetChildr
 	return blockartlib.InvalidBlockHashError(*req)
 }
 
-func (i *InkMiner) waitForValidateNum(opHash string, validateNum uint8) (string, error) {
-	validateNumWaiter := ValidateNumWaiter{
-		done:        make(chan string),
-		err:         make(chan error),
-		validateNum: validateNum,
+// GetReorged returns the hashes of operations submitted by the given public key
+// that were confirmed but have since been orphaned by a reorg. They're still in
+// the mempool and will be mined again, use WaitForConfirmation to wait for them
+// to be confirmed again.
+func (i *InkMinerRPC) GetReorged(req *string, resp *[]string) error {
+	*resp = i.i.reorged(*req)
+	return nil
+}
+
+// WaitForConfirmation waits for a previously submitted operation to be
+// ValidateNum blocks deep on the canonical chain and returns the block it's in.
+func (i *InkMinerRPC) WaitForConfirmation(req *blockartlib.WaitForConfirmationRequest, resp *string) error {
+	// Mined operations are dropped from the mempool once they're buried deep
+	// enough but stay in the shape index.
+	i.i.mu.Lock()
+	_, pending := i.i.mu.mempool[req.OpHash]
+	_, mined := i.i.mu.shapeIndex[req.OpHash]
+	i.i.mu.Unlock()
+	if !pending && !mined {
+		return blockartlib.InvalidShapeHashError(req.OpHash)
+	}
+
+	blockHash, err := i.i.waitForValidateNum(req.OpHash, req.ValidateNum)
+	if err != nil {
+		return err
 	}
+	*resp = blockHash
+	return nil
+}
 
-	defer func() {
-		close(validateNumWaiter.done)
-		close(validateNumWaiter.err)
-	}()
+func (i *InkMiner) waitForValidateNum(opHash string, validateNum uint8) (string, error) {
+	validateNumWaiter := i.addValidateNumWaiter(opHash, validateNum)
 
-	i.mu.Lock()
-	i.mu.validateNumMap[opHash] = validateNumWaiter
-	i.mu.Unlock()
+	// The operation might already be confirmed.
+	i.updateHeadConfirmations()
 
 	select {
 	case <-i.stopper.ShouldStop():
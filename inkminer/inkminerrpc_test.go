@@ -1,8 +1,15 @@
 package inkminer
 
 import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"../blockartlib"
 	"../crypto"
@@ -17,48 +24,42 @@ func setup() (inkMinerRPC InkMinerRPC, err error) {
 	if err != nil {
 		return InkMinerRPC{}, err
 	}
-	inkMiner.mu.states = make(map[string]State)
+	inkMiner.states = newStateCache(DefaultStateCacheSize)
 
 	block1 := blockartlib.Block{
-		PrevBlock: "1234",
-		Nonce:     2,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: "1234",
+			Nonce:     2,
+		},
 	}
 	block1Hash, err := block1.Hash()
 	if err != nil {
 		return InkMinerRPC{}, err
 	}
-	state1 := State{
-		shapes:      make(map[string]blockartlib.Shape),
-		shapeOwners: make(map[string]string),
-		inkLevels:   make(map[string]uint32),
-	}
-	inkMiner.mu.states[block1Hash] = state1
+	state1 := NewState()
+	inkMiner.states.put(block1Hash, state1)
 	block2 := blockartlib.Block{
-		PrevBlock: block1Hash,
-		Nonce:     3,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: block1Hash,
+			Nonce:     3,
+		},
 	}
 	block2Hash, err := block2.Hash()
 	if err != nil {
 		return InkMinerRPC{}, err
 	}
-	state2 := State{
-		shapes:      make(map[string]blockartlib.Shape),
-		shapeOwners: make(map[string]string),
-		inkLevels:   make(map[string]uint32),
-	}
-	inkMiner.mu.states[block2Hash] = state2
+	state2 := NewState()
+	inkMiner.states.put(block2Hash, state2)
 	block3 := blockartlib.Block{
-		PrevBlock: block2Hash,
-		Nonce:     3,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: block2Hash,
+			Nonce:     3,
+		},
 	}
 	if err != nil {
 		return InkMinerRPC{}, err
 	}
-	state3 := State{
-		shapes:      make(map[string]blockartlib.Shape),
-		shapeOwners: make(map[string]string),
-		inkLevels:   make(map[string]uint32),
-	}
+	state3 := NewState()
 	shape := blockartlib.Shape{
 		Svg: "M 0 0 H 20 V 20 H -20 Z",
 	}
@@ -81,25 +82,40 @@ func setup() (inkMinerRPC InkMinerRPC, err error) {
 	block3.Records = append(block3.Records, op2)
 	block3Hash, err := block3.Hash()
 
-	state3.shapes[shapeHash] = shape
-	state3.inkLevels[inkMiner.publicKey] = 50
+	state3.setShape(shapeHash, shape)
+	state3.setInkLevel(inkMiner.publicKey, 50)
 
 	block4 := blockartlib.Block{
-		PrevBlock: block2Hash,
-		Nonce:     14,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: block2Hash,
+			Nonce:     14,
+		},
 	}
 	block4Hash, err := block4.Hash()
 	if err != nil {
 		return InkMinerRPC{}, err
 	}
 
-	inkMiner.mu.states[block3Hash] = state3
+	inkMiner.states.put(block3Hash, state3)
 	inkMiner.mu.currentHead = block3
+	inkMiner.setHeadState(block3Hash, block3, state3)
 	inkMiner.mu.blockchain = make(map[string]blockartlib.Block)
 	inkMiner.mu.blockchain[block1Hash] = block1
 	inkMiner.mu.blockchain[block2Hash] = block2
 	inkMiner.mu.blockchain[block3Hash] = block3
 	inkMiner.mu.blockchain[block4Hash] = block4
+	for hash, block := range inkMiner.mu.blockchain {
+		// The operations aren't signed so only their hashes are indexed.
+		var ops []indexedOp
+		for _, op := range block.Records {
+			opHash, err := op.Hash()
+			if err != nil {
+				return InkMinerRPC{}, err
+			}
+			ops = append(ops, indexedOp{hash: opHash})
+		}
+		inkMiner.indexBlockLocked(hash, ops)
+	}
 	inkMiner.settings.GenesisBlockHash = "1234"
 	inkMinerRPC = InkMinerRPC{
 		i: inkMiner,
@@ -203,8 +219,10 @@ func TestGetChildrenBlocks(t *testing.T) {
 	}
 	// Block with only one branch
 	block1 := blockartlib.Block{
-		PrevBlock: "1234",
-		Nonce:     2,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: "1234",
+			Nonce:     2,
+		},
 	}
 	block1Hash, err := block1.Hash()
 	if err != nil {
@@ -216,8 +234,10 @@ func TestGetChildrenBlocks(t *testing.T) {
 	}
 	// Block with two branches
 	block2 := blockartlib.Block{
-		PrevBlock: block1Hash,
-		Nonce:     3,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: block1Hash,
+			Nonce:     3,
+		},
 	}
 	block2Hash, err := block2.Hash()
 	if err != nil {
@@ -228,3 +248,788 @@ func TestGetChildrenBlocks(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestGetBlocks(t *testing.T) {
+	i, err := setup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := i.i.mu.currentHead.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var resp GetBlocksResponse
+	req := GetBlocksRequest{Hashes: []string{hash, "doesn't exist"}}
+	if err := i.GetBlocks(req, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Blocks) != 1 {
+		t.Fatalf("GetBlocks(...) = %+v; wanted 1 block", resp.Blocks)
+	}
+	if got, _ := resp.Blocks[0].Hash(); got != hash {
+		t.Fatalf("GetBlocks(...) = %q; wanted %q", got, hash)
+	}
+
+	req.Hashes = make([]string, MaxGetBlocks+1)
+	if err := i.GetBlocks(req, &resp); err == nil {
+		t.Fatalf("expected error requesting too many blocks")
+	}
+}
+
+func TestGetHeaders(t *testing.T) {
+	im := generateTestInkMiner(t)
+	im.settings.PoWDifficultyOpBlock = 2
+
+	genesis := im.settings.GenesisBlockHash
+	chain := []string{genesis}
+	for j := 1; j <= 30; j++ {
+		chain = append(chain, testAddBlock(t, im, chain[j-1], j))
+	}
+
+	im.mu.Lock()
+	locator := im.blockLocatorLocked()
+	im.mu.Unlock()
+	if locator[0] != chain[30] || locator[len(locator)-1] != genesis {
+		t.Fatalf("locator should go from head to genesis: %+v", locator)
+	}
+	if len(locator) >= 20 {
+		t.Fatalf("locator should be sparse, got %d hashes", len(locator))
+	}
+
+	getHeaders := func(locator ...string) []string {
+		t.Helper()
+
+		var resp GetHeadersResponse
+		if err := im.RPC().GetHeaders(GetHeadersRequest{Locator: locator}, &resp); err != nil {
+			t.Fatal(err)
+		}
+		var hashes []string
+		for _, header := range resp.Headers {
+			hash, err := header.Hash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			hashes = append(hashes, hash)
+		}
+		return hashes
+	}
+
+	assertHashes := func(got, want []string) {
+		t.Helper()
+
+		if len(got) != len(want) {
+			t.Fatalf("got %d headers; wanted %d", len(got), len(want))
+		}
+		for j := range got {
+			if got[j] != want[j] {
+				t.Fatalf("%d. got %q; wanted %q", j, got[j], want[j])
+			}
+		}
+	}
+
+	assertHashes(getHeaders(genesis), chain[1:])
+	assertHashes(getHeaders("unknown", chain[20], genesis), chain[21:])
+	assertHashes(getHeaders(chain[30], genesis), nil)
+
+	// A heavier fork from block 25 replaces the end of the main chain.
+	op, _ := testAddOp(t, im.privKey, 1, blockartlib.TestShape(5, 0))
+	fork := testAddBlock(t, im, chain[25], 26, op)
+	assertHashes(getHeaders(chain[28], chain[25], genesis), []string{fork})
+	assertHashes(getHeaders(genesis)[:25], chain[1:26])
+
+	if err := im.RPC().GetHeaders(GetHeadersRequest{Locator: make([]string, MaxLocator+1)}, &GetHeadersResponse{}); err == nil {
+		t.Fatalf("expected error for long locator")
+	}
+
+	// Headers are checked for work and linkage before bodies are requested.
+	var resp GetHeadersResponse
+	if err := im.RPC().GetHeaders(GetHeadersRequest{Locator: []string{chain[20]}}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	hashes, err := im.checkHeaders(resp.Headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertHashes(hashes, getHeaders(chain[20]))
+	if _, err := im.checkHeaders(resp.Headers[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := im.checkHeaders(append(resp.Headers[:1:1], resp.Headers[2:]...)); err == nil {
+		t.Fatal("expected an error for headers that don't chain")
+	}
+	unknown := resp.Headers[0]
+	unknown.PrevBlock = "unknown"
+	if _, err := im.checkHeaders([]blockartlib.BlockHeader{unknown}); err == nil {
+		t.Fatal("expected an error for headers after an unknown block")
+	}
+	// A made up header with operations doesn't have the work.
+	madeUp := blockartlib.BlockHeader{PrevBlock: chain[30], BlockNum: 31, MerkleRoot: "root"}
+	for {
+		hash, err := madeUp.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numZeros(hash) != int(im.settings.PoWDifficultyOpBlock) {
+			break
+		}
+		madeUp.Nonce++
+	}
+	if _, err := im.checkHeaders([]blockartlib.BlockHeader{madeUp}); err == nil || !strings.Contains(err.Error(), "nonce") {
+		t.Fatalf("expected a nonce error: %+v", err)
+	}
+}
+
+func TestKnownInventory(t *testing.T) {
+	k := newKnownInventory()
+	if !k.add("a") {
+		t.Fatalf("a should be new")
+	}
+	if k.add("a") {
+		t.Fatalf("a should already be known")
+	}
+	for j := 0; j < MaxKnownInventory; j++ {
+		k.add(fmt.Sprint(j))
+	}
+	if k.has("a") {
+		t.Fatalf("a should have been forgotten")
+	}
+	if !k.has(fmt.Sprint(MaxKnownInventory - 1)) {
+		t.Fatalf("newest hash should be known")
+	}
+}
+
+func TestWantInventory(t *testing.T) {
+	im := generateTestInkMiner(t)
+
+	block := im.TestMine(t, blockartlib.Block{
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: im.settings.GenesisBlockHash,
+			BlockNum:  1,
+			PubKey:    im.privKey.PublicKey,
+		},
+	})
+	if _, err := im.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	blockHash, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks, ops := im.wantInventory([]string{blockHash, "b"}, []string{"op"})
+	if len(blocks) != 1 || blocks[0] != "b" || len(ops) != 1 || ops[0] != "op" {
+		t.Fatalf("should only want unknown items: %+v %+v", blocks, ops)
+	}
+
+	// Already requested from another peer.
+	blocks, ops = im.wantInventory([]string{"b"}, []string{"op"})
+	if len(blocks) != 0 || len(ops) != 0 {
+		t.Fatalf("shouldn't request items twice: %+v %+v", blocks, ops)
+	}
+
+	// Announced items are only fetched from the peer on the calling
+	// connection, never from an address the caller gives.
+	if err := im.RPC().Inv(InvRequest{Blocks: []string{"c"}}, &InvResponse{}); err == nil {
+		t.Fatal("expected error for Inv without a peer connection")
+	}
+	conn, other := net.Pipe()
+	defer other.Close()
+	m := newMuxConn(conn, conn)
+	defer m.Close()
+	rpc := &InkMinerRPC{i: im, conn: m}
+	if err := rpc.Inv(InvRequest{Blocks: []string{"c"}}, &InvResponse{}); err == nil {
+		t.Fatal("expected error for Inv before Hello")
+	}
+	if n := im.NumPeers(); n != 0 {
+		t.Fatalf("Inv added %d peers", n)
+	}
+
+	p := newPeer("peer", nil)
+	p.conn = m
+	im.mu.Lock()
+	im.mu.peers[p.address] = p
+	im.mu.Unlock()
+	// The block is already known so nothing is fetched.
+	if err := rpc.Inv(InvRequest{Blocks: []string{blockHash}}, &InvResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if !p.known.has(blockHash) {
+		t.Fatal("announced items should be known to the calling peer")
+	}
+
+	// Too many items are scored against the calling peer.
+	if err := rpc.Inv(InvRequest{Blocks: make([]string, MaxInventory+1)}, &InvResponse{}); err == nil {
+		t.Fatalf("expected error for too many items")
+	}
+	im.mu.Lock()
+	score := im.mu.scores[p.address]
+	im.mu.Unlock()
+	if score != -PenaltyProtocol {
+		t.Fatalf("calling peer's score is %d; wanted %d", score, -PenaltyProtocol)
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	im := generateTestInkMiner(t)
+
+	p := newPeer("peer", nil)
+	im.mu.Lock()
+	im.mu.peers[p.address] = p
+	im.mu.Unlock()
+
+	block := make(chan struct{})
+	var sent []int
+	for j := 0; j < MaxSendQueue; j++ {
+		j := j
+		if err := p.enqueue(func(p *peer) error {
+			if j == 0 {
+				<-block
+			}
+			sent = append(sent, j)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.enqueue(func(p *peer) error { return nil }); err == nil {
+		t.Fatalf("expected full queue to drop the message")
+	}
+	if depth := im.PeerQueueDepths()["peer"]; depth != MaxSendQueue {
+		t.Fatalf("got queue depth %d; wanted %d", depth, MaxSendQueue)
+	}
+
+	// Announcements to a peer with a full queue are dropped but remembered
+	// for the next flush.
+	if err := im.queueInventory(p, []string{"a"}, nil); err == nil {
+		t.Fatalf("expected full queue to drop the announcement")
+	}
+	if len(p.inv.blocks) != 1 {
+		t.Fatalf("dropped announcement should stay pending: %+v", p.inv.blocks)
+	}
+
+	go im.sendLoop(p)
+	close(block)
+
+	done := make(chan struct{})
+	p.queue <- func(p *peer) error {
+		close(done)
+		return nil
+	}
+	<-done
+
+	for j, n := range sent {
+		if j != n {
+			t.Fatalf("messages sent out of order: %+v", sent)
+		}
+	}
+	if len(sent) != MaxSendQueue {
+		t.Fatalf("got %d messages; wanted %d", len(sent), MaxSendQueue)
+	}
+}
+
+func TestQueueInventoryCoalesces(t *testing.T) {
+	im := generateTestInkMiner(t)
+	p := newPeer("peer", nil)
+
+	for _, hash := range []string{"a", "b", "a"} {
+		if err := im.queueInventory(p, []string{hash}, []string{"op" + hash}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(p.queue) != 1 {
+		t.Fatalf("announcements should be coalesced into one message, got %d", len(p.queue))
+	}
+	if fmt.Sprint(p.inv.blocks) != "[a b]" || fmt.Sprint(p.inv.ops) != "[opa opb]" {
+		t.Fatalf("got pending inventory %+v %+v", p.inv.blocks, p.inv.ops)
+	}
+}
+
+func TestBans(t *testing.T) {
+	im := generateTestInkMiner(t)
+
+	const addr = "127.0.0.1:1"
+	im.misbehaving(addr, PenaltyInvalid, "invalid block")
+	im.behaving(addr)
+	if len(im.Bans()) != 0 {
+		t.Fatalf("peer shouldn't be banned yet")
+	}
+	im.misbehaving(addr, PenaltyInvalid, "invalid block")
+	if len(im.Bans()) != 0 {
+		t.Fatalf("behaving should have restored some of the score")
+	}
+	im.misbehaving(addr, PenaltyTimeout, "timeout")
+
+	// Bans are only managed on the admin address.
+	conn, other := net.Pipe()
+	go im.rs.ServeConn(other)
+	public := rpc.NewClient(conn)
+	defer public.Close()
+	var bans []Ban
+	if err := public.Call("AdminRPC.GetBans", GetBansRequest{}, &bans); err == nil {
+		t.Fatal("expected GetBans not to be served publicly")
+	}
+	im.adminAddr = "127.0.0.1:0"
+	if err := im.serveAdmin(); err != nil {
+		t.Fatal(err)
+	}
+	defer im.mu.adminL.Close()
+	admin, err := rpc.Dial("tcp", im.mu.adminL.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer admin.Close()
+	if err := admin.Call("AdminRPC.GetBans", GetBansRequest{}, &bans); err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans[0].Addr != addr {
+		t.Fatalf("expected %s to be banned: %+v", addr, bans)
+	}
+
+	if _, err := im.addPeer(addr); err == nil || !strings.Contains(err.Error(), "banned") {
+		t.Fatalf("expected banned error: %+v", err)
+	}
+
+	var ok bool
+	if err := admin.Call("AdminRPC.ClearBan", ClearBanRequest{Addr: addr}, &ok); err != nil {
+		t.Fatal(err)
+	}
+	if len(im.Bans()) != 0 {
+		t.Fatalf("ban should be cleared")
+	}
+
+	// Bans expire.
+	im.SetBanDuration(time.Millisecond)
+	im.misbehaving(addr, BanThreshold, "invalid block")
+	if !im.banned(addr) {
+		t.Fatalf("expected %s to be banned", addr)
+	}
+	time.Sleep(2 * time.Millisecond)
+	if im.banned(addr) {
+		t.Fatalf("ban should have expired")
+	}
+}
+
+func TestAddrBook(t *testing.T) {
+	dir, err := ioutil.TempDir("", "inkminer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.json")
+
+	im := generateTestInkMiner(t)
+	if err := im.SetPeersFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	im.mu.Lock()
+	im.noteAddrLocked("old", now.Add(-2*AddrTTL))
+	im.noteAddrLocked("recent", now.Add(-time.Minute))
+	im.noteAddrLocked("banned", now)
+	im.mu.bans["banned"] = now.Add(time.Hour)
+	im.mu.Unlock()
+	im.noteAddr("new")
+
+	var resp GetAddrsResponse
+	if err := im.RPC().GetAddrs(GetAddrsRequest{}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	var addrs []string
+	for _, info := range resp.Addrs {
+		addrs = append(addrs, info.Addr)
+	}
+	if fmt.Sprint(addrs) != "[new recent]" {
+		t.Fatalf("got addrs %+v", addrs)
+	}
+
+	im.AddBootstrapPeers("bootstrap", "new")
+	if got := fmt.Sprint(im.candidateAddrs()); got != "[bootstrap new recent old]" {
+		t.Fatalf("got candidates %s", got)
+	}
+
+	if err := im.savePeersFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	im2 := generateTestInkMiner(t)
+	if err := im2.SetPeersFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(im2.candidateAddrs()); got != "[new recent old]" {
+		t.Fatalf("got candidates after reload %s", got)
+	}
+	im2.mu.Lock()
+	saved := im2.mu.savedSettings
+	im2.mu.Unlock()
+	if saved == nil || *saved != im.settings {
+		t.Fatalf("settings weren't saved: %+v", saved)
+	}
+}
+
+func TestShapeIndex(t *testing.T) {
+	im := generateTestInkMiner(t)
+	rpc := im.RPC()
+
+	added, addedHash := testAddOp(t, im.privKey, 1, blockartlib.TestShape(5, 0))
+	del := blockartlib.Operation{OpType: blockartlib.DELETE, Id: 2}
+	del.DELETE.ShapeHash = addedHash
+	del, delHash := testSignOp(t, im.privKey, del)
+	forked, forkedHash := testAddOp(t, im.privKey, 3, blockartlib.TestShape(5, 1))
+
+	b1 := testAddBlock(t, im, im.settings.GenesisBlockHash, 1)
+	b2 := testAddBlock(t, im, b1, 2, added)
+	b3 := testAddBlock(t, im, b2, 3, del)
+	fork := testAddBlock(t, im, b1, 2, forked)
+
+	var shapes blockartlib.GetShapesResponse
+	if err := rpc.GetShapes(&b2, &shapes); err != nil {
+		t.Fatal(err)
+	}
+	if len(shapes.ShapeHashes) != 1 || shapes.ShapeHashes[0] != addedHash {
+		t.Fatalf("GetShapes(b2) = %v; wanted [%s]", shapes.ShapeHashes, addedHash)
+	}
+
+	cases := []struct {
+		hash   string
+		block  string
+		status ShapeStatus
+		stroke string
+	}{
+		{addedHash, b2, ShapeDeleted, blockartlib.TestShape(5, 0).Stroke},
+		{delHash, b3, ShapeOnCanvas, "white"},
+		{forkedHash, fork, ShapeOffChain, blockartlib.TestShape(5, 1).Stroke},
+	}
+	for _, c := range cases {
+		hash := c.hash
+		var info ShapeInfo
+		if err := rpc.GetShapeInfo(&hash, &info); err != nil {
+			t.Fatal(err)
+		}
+		if info.BlockHash != c.block || info.OpIndex != 0 || info.Status != c.status || info.Owner != im.publicKey {
+			t.Errorf("GetShapeInfo(%s) = %+v; wanted block %s and status %s", hash, info, c.block, c.status)
+		}
+
+		var svg string
+		if err := rpc.GetSvgString(&hash, &svg); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(svg, fmt.Sprintf("stroke=%q", c.stroke)) {
+			t.Errorf("GetSvgString(%s) = %s; wanted stroke %q", hash, svg, c.stroke)
+		}
+
+		var proof blockartlib.OperationProof
+		if err := rpc.GetOperationProof(&hash, &proof); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := blockartlib.VerifyOperationProof(hash, proof); err != nil || got != c.block {
+			t.Errorf("VerifyOperationProof(%s, ...) = %q, %v; wanted %q", hash, got, err, c.block)
+		}
+	}
+
+	missing := "missing"
+	var info ShapeInfo
+	if err := rpc.GetShapeInfo(&missing, &info); err == nil {
+		t.Fatal("expected an error for an unknown shape")
+	}
+	var proof blockartlib.OperationProof
+	if err := rpc.GetOperationProof(&missing, &proof); err == nil {
+		t.Fatal("expected an error proving an unknown shape")
+	}
+}
+
+func TestMempoolLimits(t *testing.T) {
+	im := generateTestInkMiner(t)
+	im.SetMempoolLimits(3, 2, time.Hour)
+
+	keyB, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyC, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inMempool := func(hash string) bool {
+		im.mu.Lock()
+		defer im.mu.Unlock()
+
+		_, ok := im.mu.mempool[hash]
+		return ok
+	}
+	expectMempoolError := func(err error) {
+		t.Helper()
+		if _, ok := err.(MempoolError); !ok {
+			t.Fatalf("expected a MempoolError; got %v", err)
+		}
+	}
+
+	a1, a1Hash := testAddOp(t, im.privKey, 1, blockartlib.TestShape(5, 0))
+	a2, _ := testAddOp(t, im.privKey, 2, blockartlib.TestShape(5, 1))
+	a3, _ := testAddOp(t, im.privKey, 3, blockartlib.TestShape(5, 2))
+	b1, _ := testAddOp(t, keyB, 4, blockartlib.TestShape(5, 3))
+	b2, _ := testAddOp(t, keyB, 5, blockartlib.TestShape(5, 4))
+	c1, c1Hash := testAddOp(t, keyC, 6, blockartlib.TestShape(5, 5))
+
+	// Each key has a quota.
+	for _, op := range []blockartlib.Operation{a1, a2, b1} {
+		if err := im.addOperation(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectMempoolError(im.addOperation(a3))
+
+	// A full mempool evicts the oldest operation of the key with the most.
+	if err := im.addOperation(c1); err != nil {
+		t.Fatal(err)
+	}
+	if inMempool(a1Hash) || !inMempool(c1Hash) {
+		t.Fatalf("expected %s to be evicted for %s", a1Hash, c1Hash)
+	}
+	// No key has more than B now.
+	expectMempoolError(im.addOperation(b2))
+
+	// Operations that aren't mined in time expire and their waiters are
+	// told.
+	waiter := im.addValidateNumWaiter(c1Hash, 1)
+	im.mu.Lock()
+	im.pruneMempoolLocked(NewState(), time.Now().Add(2*time.Hour))
+	im.mu.Unlock()
+	if n := im.MemPoolSize(); n != 0 {
+		t.Fatalf("MemPoolSize() = %d; wanted 0", n)
+	}
+	select {
+	case err := <-waiter.err:
+		expectMempoolError(err)
+	default:
+		t.Fatal("expected the waiter to get an error")
+	}
+
+	// Mine a shape owned by the miner's key.
+	block1 := im.TestMine(t, blockartlib.Block{
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: im.settings.GenesisBlockHash,
+			BlockNum:  1,
+			PubKey:    im.privKey.PublicKey,
+		},
+	})
+	if _, err := im.AddBlock(block1); err != nil {
+		t.Fatal(err)
+	}
+	hash1, _ := block1.Hash()
+	block2 := im.TestMine(t, blockartlib.Block{
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: hash1,
+			BlockNum:  2,
+			PubKey:    im.privKey.PublicKey,
+		},
+		Records: []blockartlib.Operation{a1},
+	})
+	if _, err := im.AddBlock(block2); err != nil {
+		t.Fatal(err)
+	}
+
+	// B can't delete A's shape so it's dropped, B has no ink so that one
+	// waits.
+	del := blockartlib.Operation{OpType: blockartlib.DELETE, Id: 7}
+	del.DELETE.ShapeHash = a1Hash
+	del, delHash := testSignOp(t, keyB, del)
+	b2Hash, err := b2.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, op := range []blockartlib.Operation{del, b2} {
+		if err := im.addOperation(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := im.generateNewMiningBlock(); err != nil {
+		t.Fatal(err)
+	}
+	if inMempool(delHash) {
+		t.Fatal("expected the delete of someone else's shape to be dropped")
+	}
+
+	var ops []MempoolOp
+	if err := (&AdminRPC{i: im}).GetMempool(GetMempoolRequest{}, &ops); err != nil {
+		t.Fatal(err)
+	}
+	if len(ops) != 1 || ops[0].Hash != b2Hash || ops[0].Mined || ops[0].FirstErrorBlockNum != 3 ||
+		!strings.Contains(ops[0].LastError, "ink") {
+		t.Fatalf("GetMempool(...) = %+v; wanted %s failing for lack of ink", ops, b2Hash)
+	}
+
+	// Mined operations are dropped once no reorg could reach them.
+	if err := im.addOperation(a1); err != nil {
+		t.Fatal(err)
+	}
+	state, err := im.CalculateState(block2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	im.mu.Lock()
+	im.pruneMempoolLocked(state, time.Now())
+	im.mu.Unlock()
+	if !inMempool(a1Hash) {
+		t.Fatal("expected a recently mined operation to be kept")
+	}
+
+	// Mined operations don't count towards the limits and aren't evicted, so
+	// their waiters aren't told they were dropped.
+	waiter = im.addValidateNumWaiter(a1Hash, 1)
+	im.SetMempoolLimits(2, 1, time.Hour)
+	if err := im.addOperation(a2); err != nil {
+		t.Fatal(err)
+	}
+	c2, _ := testAddOp(t, keyC, 8, blockartlib.TestShape(5, 6))
+	if err := im.addOperation(c2); err != nil {
+		t.Fatal(err)
+	}
+	if !inMempool(a1Hash) {
+		t.Fatal("expected the mined operation to be kept")
+	}
+	select {
+	case err := <-waiter.err:
+		t.Fatalf("waiter on a mined operation got %v", err)
+	default:
+	}
+	state.blockNum += MaxReorgDepth + 1
+	im.mu.Lock()
+	im.pruneMempoolLocked(state, time.Now())
+	im.mu.Unlock()
+	if inMempool(a1Hash) {
+		t.Fatal("expected a deeply mined operation to be dropped")
+	}
+}
+
+func TestGetStateProof(t *testing.T) {
+	im := generateTestInkMiner(t)
+	blocks, hashes := testChain(t, im, 3)
+	for _, block := range blocks {
+		if _, err := im.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shapeHash, err := blocks[1].Records[0].Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rpc := im.RPC()
+
+	var proof blockartlib.StateProof
+	req := blockartlib.GetStateProofRequest{BlockHash: hashes[2], Map: blockartlib.StateInk, Key: im.publicKey}
+	if err := rpc.GetStateProof(req, &proof); err != nil {
+		t.Fatal(err)
+	}
+	_, _, head := im.headState()
+	if ink, hash, err := blockartlib.VerifyInkProof(im.privKey.PublicKey, proof); err != nil || ink != head.inkLevel(im.publicKey) || hash != hashes[2] {
+		t.Fatalf("VerifyInkProof(...) = %d, %q, %v; wanted %d, %q", ink, hash, err, head.inkLevel(im.publicKey), hashes[2])
+	}
+
+	// The shape isn't on the canvas until the block that adds it.
+	req = blockartlib.GetStateProofRequest{BlockHash: hashes[0], Map: blockartlib.StateShapes, Key: shapeHash}
+	if err := rpc.GetStateProof(req, &proof); err == nil {
+		t.Fatal("expected an error proving a shape before it was added")
+	}
+	req.BlockHash = hashes[1]
+	if err := rpc.GetStateProof(req, &proof); err != nil {
+		t.Fatal(err)
+	}
+	if shape, hash, err := blockartlib.VerifyShapeProof(shapeHash, proof); err != nil || shape != blocks[1].Records[0].ADD.Shape || hash != hashes[1] {
+		t.Fatalf("VerifyShapeProof(...) = %+v, %q, %v", shape, hash, err)
+	}
+
+	req.BlockHash = "missing"
+	if err := rpc.GetStateProof(req, &proof); err == nil {
+		t.Fatal("expected an error for an unknown block")
+	}
+}
+
+func TestGetSnapshot(t *testing.T) {
+	a := generateTestInkMiner(t)
+	blocks, hashes := testChain(t, a, SnapshotInterval+MaxReorgDepth+10)
+	for _, block := range blocks {
+		if _, err := a.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var resp GetSnapshotResponse
+	if err := a.RPC().GetSnapshot(GetSnapshotRequest{MinBlockNum: SnapshotInterval + 1}, &resp); err != nil || len(resp.Headers) != 0 {
+		t.Fatalf("expected no snapshot past the checkpoint: %d headers, %v", len(resp.Headers), err)
+	}
+	if err := a.RPC().GetSnapshot(GetSnapshotRequest{MinBlockNum: SnapshotInterval}, &resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Headers) != SnapshotInterval {
+		t.Fatalf("got %d headers; wanted %d", len(resp.Headers), SnapshotInterval)
+	}
+
+	b := generateTestInkMiner(t)
+
+	// Snapshots that don't match the headers are rejected.
+	bad := resp
+	bad.Maps = append([][]SnapshotEntry(nil), resp.Maps...)
+	bad.Maps[blockartlib.StateInk] = []SnapshotEntry{{Key: a.publicKey, Value: []byte{0, 0, 255, 255}}}
+	if _, _, err := b.verifySnapshot(bad); err == nil || !strings.Contains(err.Error(), "state root") {
+		t.Fatalf("expected a state root error: %+v", err)
+	}
+	bad = resp
+	bad.Headers = append(append([]blockartlib.BlockHeader(nil), resp.Headers[:10]...), resp.Headers[11:]...)
+	if _, _, err := b.verifySnapshot(bad); err == nil {
+		t.Fatal("expected an error for headers that don't chain")
+	}
+
+	snapshotHashes, state, err := b.verifySnapshot(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHashes(t, snapshotHashes, hashes[:SnapshotInterval])
+	b.installSnapshot(resp.Headers, snapshotHashes, state)
+	want, err := a.CalculateState(blocks[SnapshotInterval-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash, _, head := b.headState(); hash != hashes[SnapshotInterval-1] || head.StateRoot() != want.StateRoot() {
+		t.Fatalf("head is %s with %d ink; wanted the checkpoint with %d", hash, head.inkLevel(a.publicKey), want.inkLevel(a.publicKey))
+	}
+
+	// The blocks after the checkpoint are validated on the snapshot's state.
+	for _, block := range blocks[SnapshotInterval:] {
+		if _, err := b.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if hash, _, _ := b.headState(); hash != hashes[len(hashes)-1] {
+		t.Fatalf("head is %s; wanted %s", hash, hashes[len(hashes)-1])
+	}
+
+	// Only the headers of the blocks with operations before the checkpoint
+	// are kept, so they aren't served and their states can't be replayed.
+	var getResp GetBlocksResponse
+	if err := b.RPC().GetBlocks(GetBlocksRequest{Hashes: hashes[:3]}, &getResp); err != nil {
+		t.Fatal(err)
+	}
+	if len(getResp.Blocks) != 2 || len(getResp.Blocks[1].Records) != 0 || getResp.Blocks[1].BlockNum != 3 {
+		t.Fatalf("got blocks %+v; wanted blocks 1 and 3", getResp.Blocks)
+	}
+	if _, err := b.CalculateState(blocks[2]); err == nil || !strings.Contains(err.Error(), "only has a header") {
+		t.Fatalf("expected an error replaying over a header: %+v", err)
+	}
+	var headers GetHeadersResponse
+	if err := b.RPC().GetHeaders(GetHeadersRequest{Locator: []string{b.settings.GenesisBlockHash}}, &headers); err != nil || len(headers.Headers) != 1 {
+		t.Fatalf("expected headers to stop before block 2: %+v, %v", headers.Headers, err)
+	}
+
+	// A miner that fast synced serves the same snapshot.
+	var again GetSnapshotResponse
+	if err := b.RPC().GetSnapshot(GetSnapshotRequest{MinBlockNum: SnapshotInterval}, &again); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(again) != fmt.Sprint(resp) {
+		t.Fatal("snapshots differ")
+	}
+}
@@ -0,0 +1,230 @@
+package inkminer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"../blockartlib"
+)
+
+// MaxKnownInventory is the number of recently seen hashes remembered for each
+// peer.
+const MaxKnownInventory = 5000
+
+// MaxInventory is the maximum number of hashes in a single Inv call.
+const MaxInventory = 1000
+
+// knownInventory is a bounded set of hashes a peer is known to have, either
+// because it announced them to us, sent them to us or we announced them to it.
+// The oldest hashes are forgotten first.
+type knownInventory struct {
+	mu     sync.Mutex
+	hashes map[string]struct{}
+	order  []string
+}
+
+func newKnownInventory() *knownInventory {
+	return &knownInventory{
+		hashes: make(map[string]struct{}),
+	}
+}
+
+// add marks the hash as known and returns whether it wasn't known before.
+func (k *knownInventory) add(hash string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.hashes[hash]; ok {
+		return false
+	}
+	if len(k.order) >= MaxKnownInventory {
+		delete(k.hashes, k.order[0])
+		k.order = k.order[1:]
+	}
+	k.hashes[hash] = struct{}{}
+	k.order = append(k.order, hash)
+	return true
+}
+
+func (k *knownInventory) has(hash string) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	_, ok := k.hashes[hash]
+	return ok
+}
+
+type InvRequest struct {
+	Blocks []string
+	Ops    []string
+}
+
+type InvResponse struct{}
+
+// announceInventory announces the hashes to every peer that doesn't already
+// know about them.
+func (i *InkMiner) announceInventory(blocks, ops []string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for _, p := range i.mu.peers {
+		if !p.hasCapability("inv") {
+			continue
+		}
+		if err := i.queueInventory(p, blocks, ops); err != nil {
+			i.log.Printf("failed to announce inventory (to %s): %s", p, err)
+		}
+	}
+	return nil
+}
+
+func (i *InkMiner) announceBlock(hash string) error {
+	return i.announceInventory([]string{hash}, nil)
+}
+
+func (i *InkMiner) announceOperation(hash string) error {
+	return i.announceInventory(nil, []string{hash})
+}
+
+// wantInventory returns the announced hashes that we don't have and haven't
+// already requested from another peer recently. The returned hashes are marked
+// as requested.
+func (i *InkMiner) wantInventory(blocks, ops []string) ([]string, []string) {
+	now := time.Now()
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for hash, at := range i.mu.requested {
+		if now.Sub(at) > i.timeout {
+			delete(i.mu.requested, hash)
+		}
+	}
+
+	want := func(hash string, have bool) bool {
+		if have {
+			return false
+		}
+		if _, ok := i.mu.requested[hash]; ok {
+			return false
+		}
+		i.mu.requested[hash] = now
+		return true
+	}
+
+	var wantBlocks, wantOps []string
+	for _, hash := range blocks {
+		_, ok := i.mu.blockchain[hash]
+		if _, orphan := i.mu.orphans[hash]; want(hash, ok || orphan) {
+			wantBlocks = append(wantBlocks, hash)
+		}
+	}
+	for _, hash := range ops {
+		if _, ok := i.mu.mempool[hash]; want(hash, ok) {
+			wantOps = append(wantOps, hash)
+		}
+	}
+	return wantBlocks, wantOps
+}
+
+// Inv is called by peers to announce blocks and operations they have. Any
+// that we're missing are fetched from the peer attached to the calling
+// connection.
+func (i *InkMinerRPC) Inv(req InvRequest, resp *InvResponse) error {
+	// The items are fetched over the connection the announcement came in on,
+	// and that's who's scored, rather than an address the caller gives.
+	if i.conn == nil {
+		return fmt.Errorf("Inv must be sent over a peer connection")
+	}
+	p := i.i.connPeer(i.conn)
+	if p == nil {
+		return fmt.Errorf("Inv sent before Hello")
+	}
+	if len(req.Blocks)+len(req.Ops) > MaxInventory {
+		i.i.misbehaving(p.address, PenaltyProtocol, "too many inventory items")
+		return fmt.Errorf("too many inventory items: %d > %d", len(req.Blocks)+len(req.Ops), MaxInventory)
+	}
+
+	for _, hash := range req.Blocks {
+		p.known.add(hash)
+	}
+	for _, hash := range req.Ops {
+		p.known.add(hash)
+	}
+
+	blocks, ops := i.i.wantInventory(req.Blocks, req.Ops)
+	if len(blocks) == 0 && len(ops) == 0 {
+		return nil
+	}
+
+	go func() {
+		if err := i.i.getData(p, blocks, ops); err != nil {
+			i.i.log.Printf("failed to get data (from %s): %+v", p, err)
+		}
+	}()
+	return nil
+}
+
+type GetOperationsRequest struct {
+	Hashes []string
+}
+
+type GetOperationsResponse struct {
+	Ops []blockartlib.Operation
+}
+
+// GetOperations returns the requested operations from the mempool. Unknown
+// hashes are skipped.
+func (i *InkMinerRPC) GetOperations(req GetOperationsRequest, resp *GetOperationsResponse) error {
+	if len(req.Hashes) > MaxInventory {
+		return fmt.Errorf("too many operations requested: %d > %d", len(req.Hashes), MaxInventory)
+	}
+
+	i.i.mu.Lock()
+	defer i.i.mu.Unlock()
+
+	for _, hash := range req.Hashes {
+		if e, ok := i.i.mu.mempool[hash]; ok {
+			resp.Ops = append(resp.Ops, e.op)
+		}
+	}
+	return nil
+}
+
+// getData fetches the blocks and operations from the peer and adds them. The
+// peer is penalized if it doesn't respond or sends invalid data.
+func (i *InkMiner) getData(p *peer, blocks, ops []string) error {
+	if len(ops) > 0 {
+		var resp GetOperationsResponse
+		if err := p.rpc.Call("InkMinerRPC.GetOperations", GetOperationsRequest{Hashes: ops}, &resp); err != nil {
+			i.misbehaving(p.address, PenaltyTimeout, err.Error())
+			return err
+		}
+		for _, op := range resp.Ops {
+			err := i.addOperation(op)
+			if _, full := err.(MempoolError); full {
+				// A full mempool isn't the peer's fault.
+				continue
+			} else if err != nil {
+				i.misbehaving(p.address, PenaltyInvalid, err.Error())
+				return err
+			}
+		}
+	}
+
+	if len(blocks) > 0 {
+		var resp GetBlocksResponse
+		if err := p.rpc.Call("InkMinerRPC.GetBlocks", GetBlocksRequest{Hashes: blocks}, &resp); err != nil {
+			i.misbehaving(p.address, PenaltyTimeout, err.Error())
+			return err
+		}
+		for _, block := range resp.Blocks {
+			if _, err := i.AddBlock(block); err != nil {
+				i.misbehaving(p.address, PenaltyInvalid, err.Error())
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package inkminer
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"../blockartlib"
+)
+
+// DefaultMaxMempool is the default maximum number of operations in the
+// mempool.
+const DefaultMaxMempool = 5000
+
+// DefaultMempoolQuota is the default maximum number of operations from a
+// single public key in the mempool.
+const DefaultMempoolQuota = 100
+
+// DefaultMempoolExpiry is how long an operation can wait in the mempool to be
+// mined by default.
+const DefaultMempoolExpiry = time.Hour
+
+// MempoolError is returned when an operation isn't accepted into the mempool
+// or is dropped from it.
+type MempoolError string
+
+func (e MempoolError) Error() string {
+	return fmt.Sprintf("InkMiner: mempool [%s]", string(e))
+}
+
+// mempoolEntry is an operation waiting in the mempool. Mined operations stay
+// until they're buried deep enough that they won't need to be mined again
+// after a reorg.
+type mempoolEntry struct {
+	op    blockartlib.Operation
+	owner string
+	added time.Time
+	// mined is whether the operation was committed at the head the last time
+	// the mempool was pruned. Mined operations don't count towards the
+	// limits and are never evicted.
+	mined bool
+	// size is the size of the operation's encoding, see tipOrderLocked, and
+	// vertices is the number of vertices in its shape.
+	size     int
+	vertices int
+}
+
+// SetMempoolLimits sets the maximum number of operations in the mempool, the
+// maximum number from a single public key and how long an operation can wait
+// to be mined before it's dropped.
+func (i *InkMiner) SetMempoolLimits(maxOps, quota int, expiry time.Duration) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.mu.maxMempool = maxOps
+	i.mu.mempoolQuota = quota
+	i.mu.mempoolExpiry = expiry
+}
+
+// admitOperationLocked adds an operation to the mempool if the owner is under
+// its quota. When the mempool is full the oldest operation of the key with
+// the most operations is evicted, unless that's the owner. It must be locked
+// before calling!
+func (i *InkMiner) admitOperationLocked(hash string, op blockartlib.Operation, owner string, now time.Time) error {
+	if n := i.mu.mempoolByKey[owner]; n >= i.mu.mempoolQuota {
+		return MempoolError(fmt.Sprintf("key has %d operations waiting, the limit is %d", n, i.mu.mempoolQuota))
+	}
+
+	size, err := op.Size()
+	if err != nil {
+		return err
+	}
+
+	if i.mu.mempoolPending >= i.mu.maxMempool {
+		victim, ok := i.mempoolVictimLocked()
+		if !ok || i.mu.mempoolByKey[i.mu.mempool[victim].owner] <= i.mu.mempoolByKey[owner] {
+			return MempoolError("mempool is full")
+		}
+		i.dropOperationLocked(victim, MempoolError("evicted to make room for other keys"))
+	}
+
+	i.mu.mempool[hash] = mempoolEntry{
+		op:       op,
+		owner:    owner,
+		added:    now,
+		size:     size,
+		vertices: op.Vertices(),
+	}
+	i.mu.mempoolByKey[owner]++
+	i.mu.mempoolPending++
+	return nil
+}
+
+// mempoolVictimLocked returns the oldest operation of the key with the most
+// operations in the mempool. Operations committed at the head are skipped
+// even if the mempool hasn't been pruned since, their waiters are only told
+// about reorgs. It must be locked before calling!
+func (i *InkMiner) mempoolVictimLocked() (string, bool) {
+	_, _, head := i.headState()
+
+	var victim string
+	var victimEntry mempoolEntry
+	for hash, e := range i.mu.mempool {
+		if e.mined {
+			continue
+		}
+		if _, ok := head.committedFor(hash); ok {
+			continue
+		}
+		if victim != "" {
+			n, victimN := i.mu.mempoolByKey[e.owner], i.mu.mempoolByKey[victimEntry.owner]
+			if n < victimN || (n == victimN && !e.added.Before(victimEntry.added)) {
+				continue
+			}
+		}
+		victim, victimEntry = hash, e
+	}
+	return victim, victim != ""
+}
+
+// dropOperationLocked removes an operation from the mempool. If err isn't nil
+// anyone waiting on the operation gets it. It must be locked before calling!
+func (i *InkMiner) dropOperationLocked(hash string, err error) {
+	e, ok := i.mu.mempool[hash]
+	if !ok {
+		return
+	}
+	delete(i.mu.mempool, hash)
+	if !e.mined {
+		i.countPendingLocked(e.owner, -1)
+	}
+	delete(i.mu.opErrors, hash)
+
+	if err == nil {
+		return
+	}
+	i.log.Printf("dropped operation %s: %+v", hash, err)
+	waiters := i.mu.validateNumMap[hash]
+	delete(i.mu.validateNumMap, hash)
+	delete(i.mu.confirmations, hash)
+	for _, waiter := range waiters {
+		waiter.err <- err
+	}
+}
+
+// countPendingLocked adds delta to the number of operations waiting to be
+// mined in total and from the owner. It must be locked before calling!
+func (i *InkMiner) countPendingLocked(owner string, delta int) {
+	i.mu.mempoolPending += delta
+	if i.mu.mempoolByKey[owner] += delta; i.mu.mempoolByKey[owner] <= 0 {
+		delete(i.mu.mempoolByKey, owner)
+	}
+}
+
+// setMinedLocked records whether an operation in the mempool is committed at
+// the head. It must be locked before calling!
+func (i *InkMiner) setMinedLocked(hash string, mined bool) {
+	e := i.mu.mempool[hash]
+	if e.mined == mined {
+		return
+	}
+	e.mined = mined
+	i.mu.mempool[hash] = e
+	if mined {
+		i.countPendingLocked(e.owner, -1)
+	} else {
+		i.countPendingLocked(e.owner, 1)
+	}
+}
+
+// pruneMempoolLocked drops operations that have waited too long to be mined
+// and mined operations that are buried deeper than a reorg could reach, and
+// records which are mined. state is the state of the head. It must be locked
+// before calling!
+func (i *InkMiner) pruneMempoolLocked(state State, now time.Time) {
+	for hash, e := range i.mu.mempool {
+		if n, ok := state.committedFor(hash); ok {
+			if n > int(e.op.ValidateNum)+MaxReorgDepth {
+				i.dropOperationLocked(hash, nil)
+			} else {
+				i.setMinedLocked(hash, true)
+			}
+			continue
+		}
+		// It could have been reorged out.
+		i.setMinedLocked(hash, false)
+		if now.Sub(e.added) > i.mu.mempoolExpiry {
+			i.dropOperationLocked(hash, MempoolError(fmt.Sprintf("operation wasn't mined within %s", i.mu.mempoolExpiry)))
+		}
+	}
+}
+
+// tipOrderLocked returns the hashes of the operations in the mempool by tip per
+// byte, highest first. Operations with the same rate are oldest first. It must
+// be locked before calling!
+func (i *InkMiner) tipOrderLocked() []string {
+	entries := make([]mempoolEntry, 0, len(i.mu.mempool))
+	hashes := make([]string, 0, len(i.mu.mempool))
+	for hash, e := range i.mu.mempool {
+		entries = append(entries, e)
+		hashes = append(hashes, hash)
+	}
+	sort.Sort(byTipRate{entries: entries, hashes: hashes})
+	return hashes
+}
+
+// byTipRate sorts mempool entries and their hashes together, see
+// tipOrderLocked.
+type byTipRate struct {
+	entries []mempoolEntry
+	hashes  []string
+}
+
+func (b byTipRate) Len() int { return len(b.entries) }
+
+func (b byTipRate) Swap(x, y int) {
+	b.entries[x], b.entries[y] = b.entries[y], b.entries[x]
+	b.hashes[x], b.hashes[y] = b.hashes[y], b.hashes[x]
+}
+
+func (b byTipRate) Less(x, y int) bool {
+	ex, ey := b.entries[x], b.entries[y]
+	// Compare tipX/sizeX and tipY/sizeY without dividing.
+	rateX := uint64(ex.op.Tip) * uint64(ey.size)
+	rateY := uint64(ey.op.Tip) * uint64(ex.size)
+	if rateX != rateY {
+		return rateX > rateY
+	}
+	if !ex.added.Equal(ey.added) {
+		return ex.added.Before(ey.added)
+	}
+	return b.hashes[x] < b.hashes[y]
+}
+
+// MempoolOp is an operation in the mempool.
+type MempoolOp struct {
+	Hash   string
+	OpType blockartlib.OpType
+	Owner  string
+	Tip    uint32
+	Age    time.Duration
+	// Mined is whether the operation is in the chain ending at the head.
+	Mined bool
+	// LastError is why the operation last couldn't be mined and
+	// FirstErrorBlockNum is the BlockNum it first failed in, if it has.
+	LastError          string
+	FirstErrorBlockNum int
+}
+
+// Mempool returns the operations in the mempool, oldest first.
+func (i *InkMiner) Mempool() []MempoolOp {
+	_, _, head := i.headState()
+	now := time.Now()
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	ops := make([]MempoolOp, 0, len(i.mu.mempool))
+	for hash, e := range i.mu.mempool {
+		op := MempoolOp{
+			Hash:   hash,
+			OpType: e.op.OpType,
+			Owner:  e.owner,
+			Tip:    e.op.Tip,
+			Age:    now.Sub(e.added),
+		}
+		_, op.Mined = head.committedFor(hash)
+		if opErr, ok := i.mu.opErrors[hash]; ok {
+			op.LastError = opErr.err.Error()
+			op.FirstErrorBlockNum = opErr.blockNum
+		}
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(a, b int) bool {
+		if ops[a].Age != ops[b].Age {
+			return ops[a].Age > ops[b].Age
+		}
+		return ops[a].Hash < ops[b].Hash
+	})
+	return ops
+}
+
+type GetMempoolRequest struct{}
+
+// GetMempool returns the operations in the mempool.
+func (a *AdminRPC) GetMempool(req GetMempoolRequest, resp *[]MempoolOp) error {
+	*resp = a.i.Mempool()
+	return nil
+}
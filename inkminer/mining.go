@@ -5,7 +5,6 @@ import (
 	"flag"
 	"fmt"
 	"math/rand"
-	"testing"
 	"time"
 
 	"../blockartlib"
@@ -18,71 +17,16 @@ func init() {
 	flag.DurationVar(&TestBlockDelay, "delay", 1*time.Second, "mining block delay")
 }
 
-// BlockDepth returns the block depth for the given hash. It also memoizes the
-// depths into the provided map for performance with repeated calls.
-func (i *InkMiner) BlockDepth(hash string, depths map[string]int) (int, error) {
-	i.mu.Lock()
-	defer i.mu.Unlock()
-
-	return i.blockDepthLocked(hash, depths)
-}
-
-// blockDepthLocked returns the block depth. It must be locked before calling!
-// See BlockDepth.
-func (i *InkMiner) blockDepthLocked(hash string, depths map[string]int) (int, error) {
-	if hash == i.settings.GenesisBlockHash {
-		return 0, nil
-	}
-
-	if depths != nil {
-		if depth, ok := depths[hash]; ok {
-			return depth, nil
-		}
-	}
-
-	prev, ok := i.mu.blockchain[hash]
-	if !ok {
-		return 0, blockartlib.InvalidBlockHashError(hash)
-	}
-	depth, err := i.blockDepthLocked(prev.PrevBlock, depths)
-	if err != nil {
-		return 0, err
-	}
-	depth += 1
-
-	if depths != nil {
-		depths[hash] = depth
-	}
-
-	return depth, nil
-}
-
+// BlockWithLongestChain returns the hash and depth of the current head, the
+// block at the end of the chain with the most work.
 func (i *InkMiner) BlockWithLongestChain() (string, int, error) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	depths := map[string]int{}
-
-	max := i.settings.GenesisBlockHash
-	var maxBlock blockartlib.Block
-	maxDepth := 0
-
-	for hash, block := range i.mu.blockchain {
-		depth, err := i.blockDepthLocked(hash, depths)
-		if err != nil {
-			i.log.Printf("invalid block: %+v: %+v", block, err)
-			continue
-		}
-		if depth > maxDepth {
-			max = hash
-			maxDepth = depth
-			maxBlock = block
-		}
+	if i.mu.head == "" {
+		return i.settings.GenesisBlockHash, 0, nil
 	}
-
-	i.mu.currentHead = maxBlock
-
-	return max, maxDepth, nil
+	return i.mu.head, i.headMetaLocked().depth, nil
 }
 
 func (i *InkMiner) GetBlock(hash string) (blockartlib.Block, bool) {
@@ -113,6 +57,42 @@ type opError struct {
 	err      error
 }
 
+// DefaultMaxBlockOps is the default maximum number of operations in a block
+// we mine.
+const DefaultMaxBlockOps = 100
+
+// DefaultMaxBlockBytes is the default maximum total size of the encoded
+// operations in a block we mine.
+const DefaultMaxBlockBytes = 256 << 10
+
+// SetBlockLimits sets the maximum number of operations and total size of the
+// encoded operations in the blocks we mine. Operations that don't fit wait
+// for a later block, the ones with the highest tip per byte go first. The
+// consensus limits in the settings apply too if they're lower.
+func (i *InkMiner) SetBlockLimits(maxOps, maxBytes int) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.mu.maxBlockOps = maxOps
+	i.mu.maxBlockBytes = maxBytes
+}
+
+// blockLimitsLocked returns the limits on the blocks we mine, the lower of
+// SetBlockLimits and the consensus limits. maxVertices is 0 if there's no
+// limit. It must be locked before calling!
+func (i *InkMiner) blockLimitsLocked() (maxOps, maxBytes, maxVertices int) {
+	maxOps, maxBytes = i.mu.maxBlockOps, i.mu.maxBlockBytes
+	if n := int(i.settings.MaxBlockOps); n > 0 && n < maxOps {
+		maxOps = n
+	}
+	if n := int(i.settings.MaxBlockBytes); n > 0 && n < maxBytes {
+		maxBytes = n
+	}
+	return maxOps, maxBytes, int(i.settings.MaxBlockVertices)
+}
+
+// generateNewMiningBlock builds the block to mine on the head from the
+// mempool, highest tip per byte first.
 func (i *InkMiner) generateNewMiningBlock() (blockartlib.Block, error) {
 
 	prevBlockHash, _, err := i.BlockWithLongestChain()
@@ -126,59 +106,101 @@ func (i *InkMiner) generateNewMiningBlock() (blockartlib.Block, error) {
 	}
 
 	block := blockartlib.Block{
-		PrevBlock: prevBlockHash,
-		BlockNum:  state.blockNum + 1,
-		PubKey:    i.privKey.PublicKey,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: prevBlockHash,
+			BlockNum:  state.blockNum + 1,
+			PubKey:    i.privKey.PublicKey,
+			Timestamp: time.Now().Unix(),
+		},
 	}
 
+	working := state.Copy()
+	working.blockNum = block.BlockNum
+
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
-	for hash, op := range i.mu.mempool {
-		if _, ok := state.commitedOperations[hash]; ok {
+	i.pruneMempoolLocked(state, time.Now())
+
+	maxOps, maxBytes, maxVertices := i.blockLimitsLocked()
+	size, vertices := 0, 0
+	for _, hash := range i.tipOrderLocked() {
+		if len(block.Records) >= maxOps {
+			break
+		}
+		e, ok := i.mu.mempool[hash]
+		if !ok {
+			continue
+		}
+		op := e.op
+		if _, ok := state.committedFor(hash); ok {
+			continue
+		}
+		// A smaller operation with a lower tip might still fit.
+		if size+e.size > maxBytes || (maxVertices > 0 && vertices+e.vertices > maxVertices) {
 			continue
 		}
 
 		// check to see if there have been ValidateNum blocks that have been unable
-		// to include the operation. If there have been, send an error to the waiter
-		// if it exists.
+		// to include the operation. If there have been, drop it and send the
+		// error to the waiters.
 		firstError, ok := i.mu.opErrors[hash]
 		if ok && (firstError.blockNum+int(op.ValidateNum) < block.BlockNum) {
-			waiter, ok := i.mu.validateNumMap[hash]
-			if ok {
-				delete(i.mu.validateNumMap, hash)
-				waiter.err <- firstError.err
-			}
+			i.dropOperationLocked(hash, firstError.err)
 			continue
 		}
 
-		block.Records = append(block.Records, op)
-		if _, err := i.TransformState(state, block); err != nil {
+		// Each operation is applied on top of the ones already in the block
+		// so the template costs O(changes) to build.
+		next := working.Copy()
+		if err := next.applyOperation(op); err != nil {
+			if _, permanent := err.(permanentOpError); permanent {
+				i.dropOperationLocked(hash, err)
+				continue
+			}
 			i.log.Printf("op can't be applied to block: %+v, %+v", op, err)
-			block.Records = block.Records[:len(block.Records)-1]
 			if !ok {
-				i.mu.opErrors[hash] = opError{
-					blockNum: block.BlockNum,
-					err:      err,
-				}
+				firstError.blockNum = block.BlockNum
 			}
+			firstError.err = err
+			i.mu.opErrors[hash] = firstError
 			continue
 		}
+		working = next
+		block.Records = append(block.Records, op)
+		size += e.size
+		vertices += e.vertices
 	}
 
+	block.MerkleRoot, err = blockartlib.MerkleRoot(block.Records)
+	if err != nil {
+		return blockartlib.Block{}, err
+	}
+	if err := i.applyReward(&working, block); err != nil {
+		return blockartlib.Block{}, err
+	}
+	block.StateRoot = working.StateRoot()
 	return block, nil
 }
 
+// TestBlockDelay is a delay before mining each block for every miner in the
+// process. Tests use it to limit the cost of mining.
 var TestBlockDelay time.Duration
 
-func (i *InkMiner) generateNewMiningBlockLoop(mineBlockChan chan blockartlib.Block) {
+// generateNewMiningBlockLoop sends every new block to mine to all of the
+// mining threads.
+func (i *InkMiner) generateNewMiningBlockLoop(mineBlockChans []chan blockartlib.Block) {
 	for {
 		start := time.Now()
 		i.log.Printf("block generate loop")
 
 		// For testing purposes to limit computational cost of block mining.
-		if TestBlockDelay > 0 {
-			time.Sleep(TestBlockDelay)
+		delay := i.blockDelay
+		if TestBlockDelay > delay {
+			delay = TestBlockDelay
+		}
+		if delay > 0 {
+			time.Sleep(delay)
 		}
 
 		// Clear the newOp/newBlock channels to avoid duplicate work.
@@ -200,7 +222,14 @@ func (i *InkMiner) generateNewMiningBlockLoop(mineBlockChan chan blockartlib.Blo
 			continue
 		}
 		i.log.Printf("generated block, took %s", time.Since(start))
-		mineBlockChan <- block
+		for _, mineBlockChan := range mineBlockChans {
+			// Replace the block the thread hasn't started on yet.
+			select {
+			case <-mineBlockChan:
+			default:
+			}
+			mineBlockChan <- block
+		}
 
 		// wait for a new operation or block to come in
 		select {
@@ -214,10 +243,14 @@ func (i *InkMiner) generateNewMiningBlockLoop(mineBlockChan chan blockartlib.Blo
 
 // startMining should only ever be called once.
 func (i *InkMiner) startMining() error {
-	mineBlockChan := make(chan blockartlib.Block, 1)
+	var mineBlockChans []chan blockartlib.Block
+	for j := 0; j < i.miningThreads; j++ {
+		mineBlockChan := make(chan blockartlib.Block, 1)
+		mineBlockChans = append(mineBlockChans, mineBlockChan)
+		go i.minerLoop(mineBlockChan)
+	}
 
-	go i.generateNewMiningBlockLoop(mineBlockChan)
-	go i.minerLoop(mineBlockChan)
+	go i.generateNewMiningBlockLoop(mineBlockChans)
 
 	return nil
 }
@@ -225,10 +258,7 @@ func (i *InkMiner) startMining() error {
 // mineBlock returns the nonce, whether or not it found a valid nonce and an
 // error.
 func (i *InkMiner) mineWorker(block blockartlib.Block, oldNonce uint32, maxIterations int) (uint32, bool, error) {
-	difficulty := i.settings.PoWDifficultyOpBlock
-	if len(block.Records) == 0 {
-		difficulty = i.settings.PoWDifficultyNoOpBlock
-	}
+	difficulty := i.blockDifficulty(block.BlockHeader)
 
 	hashNoNonce, err := block.HashNoNonce()
 	if err != nil {
@@ -300,15 +330,13 @@ outer:
 	}
 }
 
-// Given a particular blockHash, generate a new state by walking through the blockchain
-// Automatically adds states if they do not exist already
+// CalculateState returns the state after the given block. If the state isn't
+// cached, it's rebuilt by replaying the blocks after the nearest cached state,
+// which is at most SnapshotInterval blocks back. The replayed states are
+// cached. InkMiner.mu is only locked while looking up the blocks to replay so
+// the replay doesn't block anything else.
 // INVARIANT: The blockchain has all blocks from 1..n precomputed
-func (i *InkMiner) CalculateState(block blockartlib.Block) (newState State, err error) {
-	newState = NewState()
-
-	i.mu.Lock()
-	defer i.mu.Unlock()
-
+func (i *InkMiner) CalculateState(block blockartlib.Block) (State, error) {
 	blockHash, err := block.Hash()
 	if err != nil {
 		return State{}, err
@@ -320,82 +348,62 @@ func (i *InkMiner) CalculateState(block blockartlib.Block) (newState State, err
 	}
 
 	// If the state was already previously calculated, simply return it
-	if state, ok := i.mu.states[blockHash]; ok {
+	if state, ok := i.states.get(blockHash); ok {
 		return state, nil
 	}
 
-	// Begin walking through the blockchain, adding every non-calculated block to a worklist to compute
-	workListStack := make([]blockartlib.Block, 0)
-	workListStack = append(workListStack, block)
-
-	lastState := State{}
-	foundState := false
-	// Keep walking until we hit a genesis block, or a pre-computed block
-	for err == nil && block.PrevBlock != i.settings.GenesisBlockHash {
-		// Grab the next block on the chain
-		nextHash := block.PrevBlock
-		block, ok := i.mu.blockchain[nextHash]
-		// If we didn't find the next block, something went wrong
-		if !ok {
-			i.log.Println("Invalid blockhash")
-			err = blockartlib.InvalidBlockHashError(nextHash)
-			return newState, err
-		}
+	workList, workListHashes, lastState, err := i.stateWorkList(block, blockHash)
+	if err != nil {
+		return State{}, err
+	}
 
-		// Check if the next block has a state associated with it
-		nextHash, err := block.Hash()
+	// Replay the worklist from the oldest block.
+	for pos := len(workList) - 1; pos >= 0; pos-- {
+		createdState, err := i.TransformState(lastState, workList[pos])
 		if err != nil {
-			return newState, err
-		}
-		_, ok = i.mu.states[nextHash]
-		if ok {
-			// We did it! We found a block that has some kind of state attached to it!
-			// Save this state, we will use it to compute the rest of our worklist
-			foundState = true
-			lastState = i.mu.states[nextHash]
-			break
-		} else {
-			// Not found just yet, add this block to the worklist and keep going
-			workListStack = append(workListStack, block)
-			if block.PrevBlock == i.settings.GenesisBlockHash {
-				// We are at the end of the blockchain, don't bother continuing
-				break
-			}
-			continue
+			return State{}, err
 		}
+		i.states.put(workListHashes[pos], createdState)
+		lastState = createdState
 	}
 
-	// Check if we did not find a block to work with, if so generate a "blank state"
-	if !foundState {
-		lastState = NewState()
-	}
+	return lastState, nil
+}
 
-	// Now, attempt to work through the worklist
-	for pos := len(workListStack) - 1; pos >= 0; pos-- {
-		workingBlock := workListStack[pos]
-		createdState, err := i.TransformState(lastState, workingBlock)
-		if err != nil {
-			return State{}, err
+// stateWorkList walks back from the block until it hits the genesis block or
+// a cached state. It returns the blocks on the way, newest first, and the
+// state to replay them on.
+func (i *InkMiner) stateWorkList(block blockartlib.Block, blockHash string) ([]blockartlib.Block, []string, State, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var workList []blockartlib.Block
+	var workListHashes []string
+	for {
+		// Only the state of the checkpoint is known before the blocks after
+		// a snapshot, see bodyless.
+		if bodyless(block) {
+			return nil, nil, State{}, fmt.Errorf("block %s only has a header from a snapshot, its state can't be replayed", blockHash)
+		}
+		workList = append(workList, block)
+		workListHashes = append(workListHashes, blockHash)
+		if block.PrevBlock == i.settings.GenesisBlockHash {
+			break
 		}
 
-		// Update the states
-		workingBlockHash, err := workingBlock.Hash()
-		if err != nil {
-			fmt.Println("Error hashing block")
-			return State{}, err
+		blockHash = block.PrevBlock
+		if state, ok := i.states.get(blockHash); ok {
+			return workList, workListHashes, state, nil
 		}
-		i.mu.states[workingBlockHash] = createdState
-		// Set the state walker with the newest state
-		lastState = createdState
-	}
 
-	newState, ok := i.mu.states[blockHash]
-	if !ok {
-		i.log.Println("This should never occur...")
-		return newState, blockartlib.InvalidBlockHashError(blockHash)
+		var ok bool
+		block, ok = i.mu.blockchain[blockHash]
+		if !ok {
+			i.log.Println("Invalid blockhash")
+			return nil, nil, State{}, blockartlib.InvalidBlockHashError(blockHash)
+		}
 	}
-
-	return newState, err
+	return workList, workListHashes, NewState(), nil
 }
 
 func (i *InkMiner) TransformState(prev State, block blockartlib.Block) (State, error) {
@@ -406,115 +414,159 @@ func (i *InkMiner) TransformState(prev State, block blockartlib.Block) (State, e
 		return State{}, fmt.Errorf("expected block to have BlockNum = %d; got %d\nblock: %+v", createdState.blockNum, block.BlockNum, block)
 	}
 
-	// increment the committed time by one
-	for k, v := range createdState.commitedOperations {
-		createdState.commitedOperations[k] = v + 1
-	}
-
 	// For each operation, add each entry
 	for _, op := range block.Records {
-		opHash, err := op.Hash()
-		if err != nil {
+		if err := createdState.applyOperation(op); err != nil {
 			return State{}, err
 		}
+	}
+
+	if err := i.applyReward(&createdState, block); err != nil {
+		return State{}, err
+	}
+	return createdState, nil
+}
+
+// permanentOpError is returned by applyOperation for operations that will
+// never apply on top of the state, like deleting a shape someone else owns.
+type permanentOpError struct {
+	error
+}
+
+// applyOperation applies an operation committed in the state's block.
+func (s *State) applyOperation(op blockartlib.Operation) error {
+	opHash, err := op.Hash()
+	if err != nil {
+		return err
+	}
+
+	if _, ok := s.committedFor(opHash); ok {
+		return fmt.Errorf("operation has already been committed! %+v", opHash)
+	}
+	s.commitOperation(opHash)
+
+	pubkey, err := op.PubKeyString()
+	if err != nil {
+		return err
+	}
 
-		if _, ok := createdState.commitedOperations[opHash]; ok {
-			return State{}, fmt.Errorf("operation has already been committed! %+v", opHash)
+	// The tip is paid first so the ink a delete gives back can't cover it.
+	// applyReward gives it to the miner.
+	if op.Tip > 0 {
+		inkLevel := s.inkLevel(pubkey)
+		if inkLevel < op.Tip {
+			return blockartlib.InsufficientInkError(inkLevel)
 		}
-		createdState.commitedOperations[opHash] = 0
+		s.setInkLevel(pubkey, inkLevel-op.Tip)
+	}
 
-		pubkey, err := op.PubKeyString()
+	switch op.OpType {
+	case blockartlib.ADD:
+		opCost, err := op.ADD.Shape.InkCost()
 		if err != nil {
-			return State{}, err
+			return err
 		}
 
-		switch op.OpType {
-		case blockartlib.ADD:
-			opCost, err := op.ADD.Shape.InkCost()
-			if err != nil {
-				return State{}, err
-			}
+		inkLevel := s.inkLevel(pubkey)
+		if inkLevel < opCost {
+			return blockartlib.InsufficientInkError(inkLevel)
+		}
+		s.setInkLevel(pubkey, inkLevel-opCost)
 
-			inkLevel := createdState.inkLevels[pubkey]
-			if inkLevel < opCost {
-				return State{}, blockartlib.InsufficientInkError(inkLevel)
+		var overlapErr error
+		s.eachShapeOwner(func(shapeHash, owner string) bool {
+			if owner == pubkey {
+				return true
 			}
-			createdState.inkLevels[pubkey] -= opCost
-
-			for shapeHash, owner := range createdState.shapeOwners {
-				if owner == pubkey {
-					continue
-				}
 
-				shape := createdState.shapes[shapeHash]
-				if blockartlib.DoesShapeOverlap(shape, op.ADD.Shape) {
-					return State{}, blockartlib.ShapeOverlapError(shapeHash)
-				}
+			shape, _ := s.shape(shapeHash)
+			if blockartlib.DoesShapeOverlap(shape, op.ADD.Shape) {
+				overlapErr = blockartlib.ShapeOverlapError(shapeHash)
+				return false
 			}
+			return true
+		})
+		if overlapErr != nil {
+			return overlapErr
+		}
 
-			createdState.shapes[opHash] = op.ADD.Shape
-			createdState.shapeOwners[opHash] = pubkey
+		s.setShape(opHash, op.ADD.Shape)
+		s.setShapeOwner(opHash, pubkey)
 
-		case blockartlib.DELETE:
-			shapeHash := op.DELETE.ShapeHash
-			owner, ok := createdState.shapeOwners[shapeHash]
-			if !ok {
-				return State{}, fmt.Errorf("shape doesn't exist")
-			}
-			shape := createdState.shapes[shapeHash]
-			if owner != pubkey {
-				return State{}, fmt.Errorf("owner != user: %q != %q", owner, pubkey)
+	case blockartlib.DELETE:
+		shapeHash := op.DELETE.ShapeHash
+		owner, ok := s.shapeOwner(shapeHash)
+		if !ok {
+			// The shape could still be waiting to be mined unless it was
+			// added and deleted already.
+			if _, added := s.committedFor(shapeHash); added {
+				return permanentOpError{fmt.Errorf("shape %s was already deleted", shapeHash)}
 			}
-			delete(createdState.shapeOwners, shapeHash)
-			delete(createdState.shapes, shapeHash)
+			return fmt.Errorf("shape doesn't exist")
+		}
+		shape, _ := s.shape(shapeHash)
+		if owner != pubkey {
+			return permanentOpError{fmt.Errorf("owner != user: %q != %q", owner, pubkey)}
+		}
+		s.removeShape(shapeHash)
+		s.setShape(opHash, deletedShape(shape))
 
-			// make deleted shape white
-			if shape.Fill != "transparent" {
-				shape.Fill = "white"
-			}
-			if shape.Stroke != "transparent" {
-				shape.Stroke = "white"
-			}
-			createdState.shapes[opHash] = shape
+		opCost, err := shape.InkCost()
+		if err != nil {
+			return err
+		}
+		s.setInkLevel(pubkey, s.inkLevel(pubkey)+opCost)
 
-			opCost, err := shape.InkCost()
-			if err != nil {
-				return State{}, err
-			}
-			createdState.inkLevels[pubkey] += opCost
+	default:
+		return fmt.Errorf("invalid OpType: %+v", op)
+	}
+	return nil
+}
 
-		default:
-			return State{}, fmt.Errorf("invalid OpType: %+v", op)
-		}
+// deletedShape returns the white shape a delete leaves in place of shape.
+func deletedShape(shape blockartlib.Shape) blockartlib.Shape {
+	if shape.Fill != "transparent" {
+		shape.Fill = "white"
+	}
+	if shape.Stroke != "transparent" {
+		shape.Stroke = "white"
 	}
+	return shape
+}
 
-	// Gives reward based on the block
+// applyReward gives the miner of the block its ink and the tips of its
+// operations.
+func (i *InkMiner) applyReward(s *State, block blockartlib.Block) error {
 	rewardPubKey, err := crypto.MarshalPublic(&block.PubKey)
 	if err != nil {
-		return State{}, err
+		return err
 	}
+	reward := s.inkLevel(rewardPubKey)
 	if len(block.Records) > 0 {
 		// Operation block
-		createdState.inkLevels[rewardPubKey] += i.settings.InkPerOpBlock
+		reward += i.settings.InkPerOpBlock
 	} else {
 		// NoOp block
-		createdState.inkLevels[rewardPubKey] += i.settings.InkPerNoOpBlock
+		reward += i.settings.InkPerNoOpBlock
 	}
-
-	return createdState, nil
+	for _, op := range block.Records {
+		reward += op.Tip
+	}
+	s.setInkLevel(rewardPubKey, reward)
+	return nil
 }
 
-// TestMine mines a block to completion. Should only be used for testing
-// purposes.
-func (i *InkMiner) TestMine(t *testing.T, block blockartlib.Block) blockartlib.Block {
+// MineBlock mines the block to completion and returns it with the nonce set.
+// Its Merkle and state roots have to be filled in already.
+func (i *InkMiner) MineBlock(block blockartlib.Block) (blockartlib.Block, error) {
 	for {
 		nonce, success, err := i.mineWorker(block, 0, 10000000000)
 		if err != nil {
-			t.Fatal(err)
+			return blockartlib.Block{}, err
 		}
 		if success {
 			block.Nonce = nonce
-			return block
+			return block, nil
 		}
 	}
 }
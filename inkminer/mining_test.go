@@ -1,7 +1,12 @@
 package inkminer
 
 import (
+	"crypto/ecdsa"
+	"fmt"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"../blockartlib"
 	"../crypto"
@@ -58,10 +63,12 @@ func TestInkMiner_CalculateState(t *testing.T) {
 
 	// Generate Block 1
 	block1 := inkMiner.TestMine(t, blockartlib.Block{
-		BlockNum:  1,
-		PrevBlock: inkMiner.settings.GenesisBlockHash,
-		PubKey:    inkMiner.privKey.PublicKey,
-		Nonce:     4,
+		BlockHeader: blockartlib.BlockHeader{
+			BlockNum:  1,
+			PrevBlock: inkMiner.settings.GenesisBlockHash,
+			PubKey:    inkMiner.privKey.PublicKey,
+			Nonce:     4,
+		},
 	})
 	blockHash1, err := block1.Hash()
 	if err != nil {
@@ -78,13 +85,19 @@ func TestInkMiner_CalculateState(t *testing.T) {
 		PubKey: inkMiner.privKey.PublicKey,
 	}
 	operation1.ADD.Shape = blockartlib.TestShape(5, 0)
+	operation1, err = operation1.Sign(*inkMiner.privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	block2 := inkMiner.TestMine(t, blockartlib.Block{
-		Records:   []blockartlib.Operation{operation1},
-		PrevBlock: blockHash1,
-		BlockNum:  2,
-		PubKey:    inkMiner.privKey.PublicKey,
-		Nonce:     15,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: blockHash1,
+			BlockNum:  2,
+			PubKey:    inkMiner.privKey.PublicKey,
+			Nonce:     15,
+		},
+		Records: []blockartlib.Operation{operation1},
 	})
 	blockHash2, err := block2.Hash()
 	if err != nil {
@@ -103,24 +116,24 @@ func TestInkMiner_CalculateState(t *testing.T) {
 
 	// Check if the inkLevels are updated
 	want := inkMiner.settings.InkPerNoOpBlock*1 + inkMiner.settings.InkPerOpBlock*1 - 5
-	out := someState.inkLevels[inkMiner.publicKey]
+	out := someState.inkLevel(inkMiner.publicKey)
 	if out != want {
 		t.Fatal("ERROR: Incorrect inkLevels. Got: ", out, " Expected: ", want)
 	}
 
 	// Check if the inkMiner contains the block
-	if _, ok := inkMiner.mu.states[blockHash2]; !ok {
+	if _, ok := inkMiner.states.get(blockHash2); !ok {
 		t.Log("ERROR: InkMiner has not saved the state to it's map")
 	}
 
 	// Check if the first block was computed properly
-	state1, ok := inkMiner.mu.states[blockHash1]
+	state1, ok := inkMiner.states.get(blockHash1)
 	if !ok {
 		t.Fatal("Block hash was not computed properly, invariant violated")
 	}
 
-	if state1.inkLevels[inkMiner.publicKey] != inkMiner.settings.InkPerNoOpBlock*1 {
-		t.Fatal("ERROR: Incorrect inkLevels. Got: ", state1.inkLevels[inkMiner.publicKey],
+	if state1.inkLevel(inkMiner.publicKey) != inkMiner.settings.InkPerNoOpBlock*1 {
+		t.Fatal("ERROR: Incorrect inkLevels. Got: ", state1.inkLevel(inkMiner.publicKey),
 			" Expected: ", inkMiner.settings.InkPerNoOpBlock*1)
 	}
 
@@ -131,13 +144,19 @@ func TestInkMiner_CalculateState(t *testing.T) {
 		PubKey: inkMiner.privKey.PublicKey,
 	}
 	operation2.ADD.Shape = blockartlib.TestShape(5, 1)
+	operation2, err = operation2.Sign(*inkMiner.privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	block3 := inkMiner.TestMine(t, blockartlib.Block{
-		PrevBlock: blockHash2,
-		BlockNum:  3,
-		Records:   []blockartlib.Operation{operation2},
-		PubKey:    inkMiner.privKey.PublicKey,
-		Nonce:     22441,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: blockHash2,
+			BlockNum:  3,
+			PubKey:    inkMiner.privKey.PublicKey,
+			Nonce:     22441,
+		},
+		Records: []blockartlib.Operation{operation2},
 	})
 
 	block3Hash, err := block3.Hash()
@@ -156,13 +175,13 @@ func TestInkMiner_CalculateState(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	state3, ok := inkMiner.mu.states[block3Hash]
+	state3, ok := inkMiner.states.get(block3Hash)
 	if !ok {
 		t.Fatal("Block State 3 was not stored correctly")
 	}
 
 	{
-		got := state3.inkLevels[inkMiner.publicKey]
+		got := state3.inkLevel(inkMiner.publicKey)
 		want := inkMiner.settings.InkPerNoOpBlock*1 + inkMiner.settings.InkPerOpBlock*2 - 10
 		if got != want {
 			t.Fatal("ERROR: Incorrect inkLevels. Got: ", got, " Expected: ", want)
@@ -170,6 +189,246 @@ func TestInkMiner_CalculateState(t *testing.T) {
 	}
 }
 
+func TestStateCache(t *testing.T) {
+	im := generateTestInkMiner(t)
+	// Only the most recently used state fits in the cache.
+	im.SetStateCacheSize(1)
+
+	n := 2*SnapshotInterval + 5
+	var blocks []blockartlib.Block
+	prev := im.settings.GenesisBlockHash
+	for j := 1; j <= n; j++ {
+		block := im.TestMine(t, blockartlib.Block{
+			BlockHeader: blockartlib.BlockHeader{
+				PrevBlock: prev,
+				BlockNum:  j,
+				PubKey:    im.privKey.PublicKey,
+			},
+		})
+		if _, err := im.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := block.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+		prev = hash
+	}
+
+	snapshots, recent := im.states.len()
+	if snapshots != 2 || recent != 1 {
+		t.Fatalf("cached %d snapshots and %d recent states; wanted 2 and 1", snapshots, recent)
+	}
+
+	// Evicted states are replayed from the nearest snapshot.
+	for _, j := range []int{1, SnapshotInterval - 1, SnapshotInterval, SnapshotInterval + 7, n} {
+		state, err := im.CalculateState(blocks[j-1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.blockNum != j {
+			t.Errorf("state of block %d has blockNum %d", j, state.blockNum)
+		}
+		want := im.settings.InkPerNoOpBlock * uint32(j)
+		if got := state.inkLevel(im.publicKey); got != want {
+			t.Errorf("state of block %d has ink %d; wanted %d", j, got, want)
+		}
+	}
+
+	_, recent = im.states.len()
+	if recent != 1 {
+		t.Fatalf("cached %d recent states after replaying; wanted 1", recent)
+	}
+}
+
+// TestForkSnapshots checks that only states on the main chain are kept as
+// snapshots.
+func TestForkSnapshots(t *testing.T) {
+	im := generateTestInkMiner(t)
+	im.SetStateCacheSize(1)
+	forkKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fork blocks are mined with another key so they differ from the main
+	// chain's.
+	addFork := func(prev string, blockNum int) string {
+		block, hash := testMineBlock(t, im, forkKey, prev, blockNum)
+		if _, err := im.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	expectSnapshot := func(want string) {
+		im.states.mu.Lock()
+		defer im.states.mu.Unlock()
+
+		if _, ok := im.states.snapshots[want]; !ok || len(im.states.snapshots) != 1 {
+			t.Fatalf("snapshots = %v; wanted only %s", im.states.snapshots, want)
+		}
+	}
+
+	prev := im.settings.GenesisBlockHash
+	for j := 1; j < SnapshotInterval; j++ {
+		prev = testAddBlock(t, im, prev, j)
+	}
+	fork := prev
+	main := testAddBlock(t, im, prev, SnapshotInterval)
+	testAddBlock(t, im, main, SnapshotInterval+1)
+	expectSnapshot(main)
+
+	// A fork block that isn't the head isn't a snapshot.
+	forked := addFork(fork, SnapshotInterval)
+	expectSnapshot(main)
+
+	// Once the fork takes over the old main chain's snapshot is dropped, and
+	// the fork's is kept when it's replayed.
+	head := addFork(addFork(forked, SnapshotInterval+1), SnapshotInterval+2)
+	if got, _, _ := im.BlockWithLongestChain(); got != head {
+		t.Fatalf("head = %s; wanted the fork's %s", got, head)
+	}
+	block, _ := im.GetBlock(forked)
+	if _, err := im.CalculateState(block); err != nil {
+		t.Fatal(err)
+	}
+	expectSnapshot(forked)
+}
+
+// TestConcurrentStateAccess adds blocks while states are read and replayed.
+// Run it with -race.
+func TestConcurrentStateAccess(t *testing.T) {
+	im := generateTestInkMiner(t)
+	// Force states off the head to be replayed.
+	im.SetStateCacheSize(1)
+
+	blocks, hashes := testChain(t, im, SnapshotInterval+20)
+	shapeHash, err := blocks[1].Records[0].Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var added int32
+	done := make(chan struct{})
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(done)
+		for _, block := range blocks {
+			if _, err := im.AddBlock(block); err != nil {
+				errs <- err
+				return
+			}
+			atomic.AddInt32(&added, 1)
+		}
+	}()
+
+	reader := func(read func(n int) error) {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			n := int(atomic.LoadInt32(&added))
+			if n == 0 {
+				continue
+			}
+			if err := read(n); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}
+
+	rpc := im.RPC()
+	wg.Add(5)
+	go reader(func(n int) error {
+		var ink uint32
+		return rpc.GetInk(nil, &ink)
+	})
+	go reader(func(n int) error {
+		var svg string
+		if n < 2 {
+			return nil
+		}
+		return rpc.GetSvgString(&shapeHash, &svg)
+	})
+	go reader(func(n int) error {
+		state, err := im.CalculateState(blocks[n/2])
+		if err != nil {
+			return err
+		}
+		if state.blockNum != n/2+1 {
+			return fmt.Errorf("state of block %d has blockNum %d", n/2+1, state.blockNum)
+		}
+		return nil
+	})
+	go reader(func(n int) error {
+		var resp blockartlib.GetChildrenResponse
+		return rpc.GetChildrenBlocks(&hashes[n-1], &resp)
+	})
+	go reader(func(n int) error {
+		_, err := im.generateNewMiningBlock()
+		return err
+	})
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if head, _, _ := im.headState(); head != hashes[len(hashes)-1] {
+		t.Fatalf("head = %q; wanted %q", head, hashes[len(hashes)-1])
+	}
+}
+
+// TestReadsDontLockMiner checks read only calls answer while InkMiner.mu is
+// held, e.g. by a long replay.
+func TestReadsDontLockMiner(t *testing.T) {
+	im := generateTestInkMiner(t)
+	blocks, _ := testChain(t, im, 3)
+	for _, block := range blocks {
+		if _, err := im.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	shapeHash, err := blocks[1].Records[0].Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	result := make(chan error, 1)
+	go func() {
+		rpc := im.RPC()
+		var ink uint32
+		if err := rpc.GetInk(nil, &ink); err != nil {
+			result <- err
+			return
+		}
+		var svg string
+		result <- rpc.GetSvgString(&shapeHash, &svg)
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("read only calls waited on InkMiner.mu")
+	}
+}
+
 func TestTransformStateIntersectionsMultipleBlocks(t *testing.T) {
 	im := generateTestInkMiner(t)
 
@@ -204,14 +463,16 @@ func TestTransformStateIntersectionsMultipleBlocks(t *testing.T) {
 	operation3.ADD.Shape = blockartlib.TestShape(5, 0)
 
 	state := NewState()
-	state.inkLevels[im.publicKey] = 1000000
-	state.inkLevels[pubKey2] = 1000000
+	state.setInkLevel(im.publicKey, 1000000)
+	state.setInkLevel(pubKey2, 1000000)
 
 	block := blockartlib.Block{
-		PrevBlock: im.settings.GenesisBlockHash,
-		BlockNum:  1,
-		Records:   []blockartlib.Operation{operation1},
-		PubKey:    im.privKey.PublicKey,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: im.settings.GenesisBlockHash,
+			BlockNum:  1,
+			PubKey:    im.privKey.PublicKey,
+		},
+		Records: []blockartlib.Operation{operation1},
 	}
 	hash, err := block.Hash()
 	if err != nil {
@@ -223,10 +484,12 @@ func TestTransformStateIntersectionsMultipleBlocks(t *testing.T) {
 	}
 
 	block = blockartlib.Block{
-		PrevBlock: hash,
-		BlockNum:  2,
-		Records:   []blockartlib.Operation{operation2},
-		PubKey:    im.privKey.PublicKey,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: hash,
+			BlockNum:  2,
+			PubKey:    im.privKey.PublicKey,
+		},
+		Records: []blockartlib.Operation{operation2},
 	}
 	hash, err = block.Hash()
 	if err != nil {
@@ -238,10 +501,12 @@ func TestTransformStateIntersectionsMultipleBlocks(t *testing.T) {
 	}
 
 	block = blockartlib.Block{
-		PrevBlock: hash,
-		BlockNum:  3,
-		Records:   []blockartlib.Operation{operation3},
-		PubKey:    im.privKey.PublicKey,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: hash,
+			BlockNum:  3,
+			PubKey:    im.privKey.PublicKey,
+		},
+		Records: []blockartlib.Operation{operation3},
 	}
 	state, err = im.TransformState(state, block)
 	if err == nil {
@@ -283,20 +548,506 @@ func TestTransformStateIntersectionsOneBlock(t *testing.T) {
 	operation3.ADD.Shape = blockartlib.TestShape(5, 0)
 
 	state := NewState()
-	state.inkLevels[im.publicKey] = 1000000
-	state.inkLevels[pubKey2] = 1000000
+	state.setInkLevel(im.publicKey, 1000000)
+	state.setInkLevel(pubKey2, 1000000)
 
 	block := blockartlib.Block{
-		PrevBlock: im.settings.GenesisBlockHash,
-		BlockNum:  1,
-		Records:   []blockartlib.Operation{operation1, operation3},
-		PubKey:    im.privKey.PublicKey,
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: im.settings.GenesisBlockHash,
+			BlockNum:  1,
+			PubKey:    im.privKey.PublicKey,
+		},
+		Records: []blockartlib.Operation{operation1, operation3},
 	}
 	if _, err := im.TransformState(state, block); err == nil {
 		t.Fatalf("expected error from intersecting operations")
 	}
 }
 
+func TestAddBlockValidation(t *testing.T) {
+	im := generateTestInkMiner(t)
+
+	b1Hash := testAddBlock(t, im, im.settings.GenesisBlockHash, 1)
+
+	op, _ := testAddOp(t, im.privKey, 1, blockartlib.TestShape(5, 0))
+	other, _ := testAddOp(t, im.privKey, 2, blockartlib.TestShape(5, 0))
+
+	unsigned := blockartlib.Operation{
+		OpType: blockartlib.ADD,
+		Id:     1,
+		PubKey: im.privKey.PublicKey,
+	}
+	unsigned.ADD.Shape = blockartlib.TestShape(5, 0)
+
+	badSig := op
+	badSig.Id = 2
+
+	outOfBounds := blockartlib.TestShape(5, 0)
+	outOfBounds.Svg = "M 0 0 L 0 2000000"
+	invalidShape, _ := testAddOp(t, im.privKey, 1, outOfBounds)
+	tooMuchInk, _ := testAddOp(t, im.privKey, 1, blockartlib.TestShape(100, 0))
+
+	cases := []struct {
+		name     string
+		prev     string
+		blockNum int
+		records  []blockartlib.Operation
+	}{
+		{"wrong block num", b1Hash, 3, nil},
+		{"unsigned op", b1Hash, 2, []blockartlib.Operation{unsigned}},
+		{"bad signature", b1Hash, 2, []blockartlib.Operation{badSig}},
+		{"invalid shape", b1Hash, 2, []blockartlib.Operation{invalidShape}},
+		{"insufficient ink", b1Hash, 2, []blockartlib.Operation{tooMuchInk}},
+	}
+
+	for _, c := range cases {
+		block, _ := testMineBlock(t, im, im.privKey, c.prev, c.blockNum, c.records...)
+		if ok, err := im.AddBlock(block); err == nil || ok {
+			t.Errorf("%s: AddBlock(...) = %t, %v; expected error", c.name, ok, err)
+		}
+		if n := im.BlockPoolSize(); n != 1 {
+			t.Errorf("%s: invalid block was stored, BlockPoolSize() = %d", c.name, n)
+		}
+	}
+
+	// The header has to commit to the operations.
+	wrongRoot := blockartlib.Block{
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: b1Hash,
+			BlockNum:  2,
+			PubKey:    im.privKey.PublicKey,
+		},
+		Records: []blockartlib.Operation{op},
+	}
+	root, err := blockartlib.MerkleRoot([]blockartlib.Operation{other})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrongRoot.MerkleRoot = root
+	if ok, err := im.AddBlock(im.TestMine(t, wrongRoot)); err == nil || ok {
+		t.Errorf("AddBlock(...) = %t, %v; expected an error for the wrong Merkle root", ok, err)
+	}
+
+	valid, _ := testMineBlock(t, im, im.privKey, b1Hash, 2, op)
+	if ok, err := im.AddBlock(valid); err != nil || !ok {
+		t.Fatalf("AddBlock(...) = %t, %v; expected success", ok, err)
+	}
+}
+
+func TestBlockLimits(t *testing.T) {
+	im := generateTestInkMiner(t)
+	im.settings.MaxBlockOps = 2
+	im.settings.MaxBlockVertices = 5
+
+	prev := im.settings.GenesisBlockHash
+	for j := 1; j <= 4; j++ {
+		prev = testAddBlock(t, im, prev, j)
+	}
+
+	// Each test shape has 2 vertices.
+	var ops []blockartlib.Operation
+	for j := 0; j < 3; j++ {
+		op, _ := testAddOp(t, im.privKey, int64(j+1), blockartlib.TestShape(5, j))
+		ops = append(ops, op)
+	}
+	detailed := blockartlib.TestShape(5, 0)
+	detailed.Svg = "M 0 0 L 0 1 L 1 1 L 1 2 L 2 2 L 2 3"
+	detailedOp, _ := testAddOp(t, im.privKey, 4, detailed)
+
+	cases := []struct {
+		name    string
+		records []blockartlib.Operation
+	}{
+		{"too many operations", ops},
+		{"too many vertices", ops[:1:1]},
+		{"too many bytes", ops[:1]},
+	}
+	cases[1].records = append(cases[1].records, detailedOp)
+	size, err := ops[0].Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cases {
+		if c.name == "too many bytes" {
+			im.settings.MaxBlockBytes = uint32(size - 1)
+		}
+		block, _ := testMineBlock(t, im, im.privKey, prev, 5, c.records...)
+		if ok, err := im.AddBlock(block); err == nil || ok {
+			t.Errorf("%s: AddBlock(...) = %t, %v; expected error", c.name, ok, err)
+		}
+	}
+	im.settings.MaxBlockBytes = 0
+
+	// Operations that could never fit in a block aren't accepted.
+	if err := im.addOperation(detailedOp); err == nil {
+		t.Fatal("expected an operation over the vertex limit to be rejected")
+	}
+
+	// Blocks we mine stay under the consensus limits even if ours are
+	// higher.
+	for _, op := range ops {
+		if err := im.addOperation(op); err != nil {
+			t.Fatal(err)
+		}
+	}
+	im.settings.MaxBlockVertices = 3
+	block, err := im.generateNewMiningBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Records) != 1 {
+		t.Fatalf("mined block has %d operations; wanted 1", len(block.Records))
+	}
+
+	im.settings.MaxBlockVertices = 5
+	block, err = im.generateNewMiningBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Records) != 2 {
+		t.Fatalf("mined block has %d operations; wanted 2", len(block.Records))
+	}
+	if ok, err := im.AddBlock(im.TestMine(t, block)); err != nil || !ok {
+		t.Fatalf("AddBlock(...) = %t, %v; expected success", ok, err)
+	}
+}
+
+func TestOrphanBlocks(t *testing.T) {
+	im := generateTestInkMiner(t)
+
+	block := func(prev string, blockNum int) (blockartlib.Block, string) {
+		b := im.TestMine(t, blockartlib.Block{
+			BlockHeader: blockartlib.BlockHeader{
+				PrevBlock: prev,
+				BlockNum:  blockNum,
+				PubKey:    im.privKey.PublicKey,
+			},
+		})
+		hash, err := b.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b, hash
+	}
+
+	b1, hash1 := block(im.settings.GenesisBlockHash, 1)
+	b2, hash2 := block(hash1, 2)
+	b3, hash3 := block(hash2, 3)
+
+	for _, b := range []blockartlib.Block{b3, b2} {
+		if ok, err := im.AddBlock(b); err != nil || ok {
+			t.Fatalf("AddBlock(orphan) = %t, %+v; expected false, nil", ok, err)
+		}
+	}
+	if n := im.BlockPoolSize(); n != 0 {
+		t.Fatalf("orphans were added to the blockchain: %d", n)
+	}
+	if n := im.OrphanPoolSize(); n != 2 {
+		t.Fatalf("OrphanPoolSize() = %d; wanted 2", n)
+	}
+
+	// The missing parent connects the whole chain.
+	if _, err := im.AddBlock(b1); err != nil {
+		t.Fatal(err)
+	}
+	if n := im.BlockPoolSize(); n != 3 {
+		t.Fatalf("BlockPoolSize() = %d; wanted 3", n)
+	}
+	if n := im.OrphanPoolSize(); n != 0 {
+		t.Fatalf("OrphanPoolSize() = %d; wanted 0", n)
+	}
+	if head, _, _ := im.BlockWithLongestChain(); head != hash3 {
+		t.Fatalf("head = %q; wanted %q", head, hash3)
+	}
+
+	// The pool is bounded and evicts the oldest orphan.
+	first, _ := block("missing 0", 1)
+	if _, err := im.AddBlock(first); err != nil {
+		t.Fatal(err)
+	}
+	firstHash, _ := first.Hash()
+	for j := 1; j <= MaxOrphans; j++ {
+		b, _ := block(fmt.Sprintf("missing %d", j), 1)
+		if _, err := im.AddBlock(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := im.OrphanPoolSize(); n != MaxOrphans {
+		t.Fatalf("OrphanPoolSize() = %d; wanted %d", n, MaxOrphans)
+	}
+	im.mu.Lock()
+	_, ok := im.mu.orphans[firstHash]
+	im.mu.Unlock()
+	if ok {
+		t.Fatalf("expected oldest orphan to be evicted")
+	}
+
+	// Old orphans expire.
+	im.mu.Lock()
+	im.pruneOrphansLocked(time.Now().Add(OrphanTimeout + time.Second))
+	im.mu.Unlock()
+	if n := im.OrphanPoolSize(); n != 0 {
+		t.Fatalf("OrphanPoolSize() = %d; wanted 0", n)
+	}
+}
+
+func TestForkChoice(t *testing.T) {
+	im := generateTestInkMiner(t)
+	im.settings.PoWDifficultyOpBlock = 2
+
+	assertHead := func(want string, wantDepth int) {
+		t.Helper()
+
+		for j := 0; j < 10; j++ {
+			head, depth, err := im.BlockWithLongestChain()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if head != want || depth != wantDepth {
+				t.Fatalf("BlockWithLongestChain() = %q, %d; wanted %q, %d", head, depth, want, wantDepth)
+			}
+		}
+		if hash, err := im.currentHead().Hash(); err != nil || hash != want {
+			t.Fatalf("currentHead() = %q, %v; wanted %q", hash, err, want)
+		}
+	}
+
+	genesis := im.settings.GenesisBlockHash
+	a1 := testAddBlock(t, im, genesis, 1)
+	assertHead(a1, 1)
+
+	// Equal work, the first block seen stays the head.
+	b1 := testAddBlock(t, im, genesis, 1)
+	assertHead(a1, 1)
+
+	a2 := testAddBlock(t, im, a1, 2)
+	a3 := testAddBlock(t, im, a2, 3)
+	assertHead(a3, 3)
+
+	// A shorter chain wins if it has more work since op blocks are harder.
+	op1, _ := testAddOp(t, im.privKey, 1, blockartlib.TestShape(5, 0))
+	b2 := testAddBlock(t, im, b1, 2, op1)
+	assertHead(b2, 2)
+
+	a4 := testAddBlock(t, im, a3, 4)
+	a5 := testAddBlock(t, im, a4, 5)
+	assertHead(b2, 2)
+
+	// A block with the most work that spends ink the miner doesn't have is
+	// rejected and never becomes the head.
+	op2, _ := testAddOp(t, im.privKey, 2, blockartlib.TestShape(1000, 1))
+	invalid, _ := testMineBlock(t, im, im.privKey, a5, 6, op2)
+	if _, err := im.AddBlock(invalid); err == nil {
+		t.Fatalf("expected invalid block to be rejected")
+	}
+	assertHead(b2, 2)
+
+	op3, _ := testAddOp(t, im.privKey, 3, blockartlib.TestShape(5, 1))
+	a6 := testAddBlock(t, im, a5, 6, op3)
+	assertHead(a6, 6)
+}
+
+func TestReorgConfirmations(t *testing.T) {
+	im := generateTestInkMiner(t)
+	// Op blocks are worth 256 noop blocks so which fork wins is controlled by
+	// where the op blocks go.
+	im.settings.PoWDifficultyOpBlock = 2
+
+	op, opHash := testAddOp(t, im.privKey, 1, blockartlib.TestShape(5, 0))
+	im.mu.Lock()
+	if err := im.admitOperationLocked(opHash, op, im.publicKey, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	im.mu.Unlock()
+
+	// AddBlock updates the confirmations synchronously so the waiter has
+	// either fired by the time it returns or it hasn't.
+	assertConfirmed := func(waiter ValidateNumWaiter, want string) {
+		t.Helper()
+
+		select {
+		case got := <-waiter.done:
+			if got != want {
+				t.Fatalf("confirmed in %q; wanted %q", got, want)
+			}
+		default:
+			if want != "" {
+				t.Fatalf("not confirmed; wanted %q", want)
+			}
+		}
+
+		im.mu.Lock()
+		c := im.mu.confirmations[opHash]
+		im.mu.Unlock()
+		if c.blockHash != want {
+			t.Fatalf("confirmation block = %q; wanted %q", c.blockHash, want)
+		}
+	}
+
+	assertReorged := func(pubKey string, want ...string) {
+		t.Helper()
+
+		var reorged []string
+		if err := im.RPC().GetReorged(&pubKey, &reorged); err != nil {
+			t.Fatal(err)
+		}
+		if len(reorged) != len(want) || (len(want) > 0 && reorged[0] != want[0]) {
+			t.Fatalf("GetReorged(...) = %+v; wanted %+v", reorged, want)
+		}
+	}
+
+	genesis := im.settings.GenesisBlockHash
+	b1 := testAddBlock(t, im, genesis, 1)
+
+	waiter := im.addValidateNumWaiter(opHash, 1)
+	// A second waiter on the same operation doesn't replace the first one.
+	waiter2 := im.addValidateNumWaiter(opHash, 1)
+
+	// Only committed, not ValidateNum deep yet.
+	a2 := testAddBlock(t, im, b1, 2, op)
+	assertConfirmed(waiter, "")
+
+	// A longer fork with less work doesn't count.
+	c2 := testAddBlock(t, im, b1, 2)
+	c3 := testAddBlock(t, im, c2, 3)
+	assertConfirmed(waiter, "")
+
+	testAddBlock(t, im, a2, 3)
+	assertConfirmed(waiter, a2)
+	assertConfirmed(waiter2, a2)
+	assertReorged(im.publicKey)
+
+	// The other fork overtakes with an op block of its own and orphans the
+	// operation.
+	op2, _ := testAddOp(t, im.privKey, 2, blockartlib.TestShape(5, 1))
+	c4 := testAddBlock(t, im, c3, 4, op2)
+	assertReorged(im.publicKey, opHash)
+	assertReorged("someone else")
+
+	// The operation gets mined again on the new chain and confirmed.
+	waiter = im.addValidateNumWaiter(opHash, 1)
+	c5 := testAddBlock(t, im, c4, 5, op)
+	assertConfirmed(waiter, "")
+	assertReorged(im.publicKey, opHash)
+	head := testAddBlock(t, im, c5, 6)
+	assertConfirmed(waiter, c5)
+	assertReorged(im.publicKey)
+
+	// Buried operations aren't tracked anymore.
+	for j := 7; j < 7+MaxReorgDepth; j++ {
+		head = testAddBlock(t, im, head, j)
+	}
+	im.mu.Lock()
+	_, ok := im.mu.confirmations[opHash]
+	im.mu.Unlock()
+	if ok {
+		t.Fatalf("expected buried operation to no longer be tracked")
+	}
+}
+
+func TestTipOrder(t *testing.T) {
+	im := generateTestInkMiner(t)
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := crypto.MarshalPublic(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Give the key ink by mining no-op blocks with it.
+	prev := im.settings.GenesisBlockHash
+	for j := 1; j <= 4; j++ {
+		var block blockartlib.Block
+		block, prev = testMineBlock(t, im, key, prev, j)
+		if _, err := im.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// tipped adds an operation with the tip to the mempool.
+	tipped := func(id int64, tip uint32) (blockartlib.Operation, string) {
+		op := blockartlib.Operation{OpType: blockartlib.ADD, Id: id, Tip: tip}
+		op.ADD.Shape = blockartlib.TestShape(5, int(id))
+		op, hash := testSignOp(t, key, op)
+		if err := im.addOperation(op); err != nil {
+			t.Fatal(err)
+		}
+		return op, hash
+	}
+	low, _ := tipped(1, 0)
+	mid, midHash := tipped(2, 1)
+	high, highHash := tipped(3, 3)
+
+	expectRecords := func(block blockartlib.Block, want ...string) {
+		t.Helper()
+		var got []string
+		for _, op := range block.Records {
+			hash, err := op.Hash()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, hash)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("Records = %v; wanted %v", got, want)
+		}
+	}
+
+	// The operations with the highest tips go first.
+	im.SetBlockLimits(2, DefaultMaxBlockBytes)
+	block, err := im.generateNewMiningBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRecords(block, highHash, midHash)
+
+	// Operations that don't fit are left for later.
+	size, err := high.Size()
+	if err != nil {
+		t.Fatal(err)
+	}
+	im.SetBlockLimits(DefaultMaxBlockOps, size)
+	only, err := im.generateNewMiningBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectRecords(only, highHash)
+
+	// The tips move from the key to the miner of the block.
+	if _, err := im.AddBlock(im.TestMine(t, block)); err != nil {
+		t.Fatal(err)
+	}
+	_, _, state := im.headState()
+	cost, err := high.ADD.Shape.InkCost()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := state.inkLevel(pubKey), 4*im.settings.InkPerNoOpBlock-2*cost-high.Tip-mid.Tip; got != want {
+		t.Fatalf("key ink = %d; wanted %d", got, want)
+	}
+	if got, want := state.inkLevel(im.publicKey), im.settings.InkPerOpBlock+high.Tip+mid.Tip; got != want {
+		t.Fatalf("miner ink = %d; wanted %d", got, want)
+	}
+
+	// The tip has to be covered on top of the shape's cost.
+	expensive := low
+	expensive.Tip = state.inkLevel(pubKey)
+	if expensive, err = expensive.Sign(*key); err != nil {
+		t.Fatal(err)
+	}
+	if err := im.testOperation(expensive); err == nil {
+		t.Fatal("expected a tip the key can't cover to be rejected")
+	} else if _, ok := err.(blockartlib.InsufficientInkError); !ok {
+		t.Fatalf("expected InsufficientInkError; got %v", err)
+	}
+	if err := im.testOperation(low); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func generateTestInkMiner(t *testing.T) *InkMiner {
 	privKey, err := crypto.GenerateKey()
 	if err != nil {
@@ -314,7 +1065,123 @@ func generateTestInkMiner(t *testing.T) *InkMiner {
 		InkPerNoOpBlock:        5,
 		PoWDifficultyNoOpBlock: 0,
 		PoWDifficultyOpBlock:   0,
+		CanvasSettings: server.CanvasSettings{
+			CanvasXMax: 1000000,
+			CanvasYMax: 1000000,
+		},
 	}
 
 	return inkMiner
 }
+
+// testMineBlock mines a block on prev with the key and the records, and
+// returns it with its hash.
+func testMineBlock(t *testing.T, im *InkMiner, key *ecdsa.PrivateKey, prev string, blockNum int, records ...blockartlib.Operation) (blockartlib.Block, string) {
+	t.Helper()
+	block := im.TestMine(t, blockartlib.Block{
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: prev,
+			BlockNum:  blockNum,
+			PubKey:    key.PublicKey,
+		},
+		Records: records,
+	})
+	hash, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block, hash
+}
+
+// testAddBlock mines a block on prev with the miner's key and the records,
+// adds it and returns its hash.
+func testAddBlock(t *testing.T, im *InkMiner, prev string, blockNum int, records ...blockartlib.Operation) string {
+	t.Helper()
+	block, hash := testMineBlock(t, im, im.privKey, prev, blockNum, records...)
+	if _, err := im.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	return hash
+}
+
+// testSignOp signs the operation with the key and returns it with its hash.
+func testSignOp(t *testing.T, key *ecdsa.PrivateKey, op blockartlib.Operation) (blockartlib.Operation, string) {
+	t.Helper()
+	op.PubKey = key.PublicKey
+	op, err := op.Sign(*key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := op.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return op, hash
+}
+
+// testAddOp returns an ADD of the shape signed with the key and its hash.
+func testAddOp(t *testing.T, key *ecdsa.PrivateKey, id int64, shape blockartlib.Shape) (blockartlib.Operation, string) {
+	t.Helper()
+	op := blockartlib.Operation{OpType: blockartlib.ADD, Id: id}
+	op.ADD.Shape = shape
+	return testSignOp(t, key, op)
+}
+
+// testMined are the blocks mined by TestMine in any miner, so the state roots
+// of blocks on parents that haven't been added yet can be filled in.
+var testMined = struct {
+	sync.Mutex
+	blocks map[string]blockartlib.Block
+}{blocks: make(map[string]blockartlib.Block)}
+
+// testState returns the state after the block with the hash if it's been added
+// or mined by TestMine.
+func (i *InkMiner) testState(hash string) (State, error) {
+	if _, ok := i.GetBlock(hash); ok || hash == i.settings.GenesisBlockHash {
+		return i.getStateForHash(hash)
+	}
+	testMined.Lock()
+	block, ok := testMined.blocks[hash]
+	testMined.Unlock()
+	if !ok {
+		return State{}, blockartlib.InvalidBlockHashError(hash)
+	}
+	prev, err := i.testState(block.PrevBlock)
+	if err != nil {
+		return State{}, err
+	}
+	return i.TransformState(prev, block)
+}
+
+// TestMine mines a block to completion. The Merkle and state roots are filled
+// in if they're empty and the state root can be worked out.
+func (i *InkMiner) TestMine(t *testing.T, block blockartlib.Block) blockartlib.Block {
+	if block.MerkleRoot == "" {
+		root, err := blockartlib.MerkleRoot(block.Records)
+		if err != nil {
+			t.Fatal(err)
+		}
+		block.MerkleRoot = root
+	}
+	if block.StateRoot == "" {
+		// Blocks that are invalid or on unknown parents are left without
+		// one.
+		if prev, err := i.testState(block.PrevBlock); err == nil {
+			if state, err := i.TransformState(prev, block); err == nil {
+				block.StateRoot = state.StateRoot()
+			}
+		}
+	}
+	block, err := i.MineBlock(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMined.Lock()
+	testMined.blocks[hash] = block
+	testMined.Unlock()
+	return block
+}
@@ -0,0 +1,189 @@
+package inkminer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// peerMagic is sent by miners when they open a connection to another miner so
+// it can be told apart from art node connections.
+const peerMagic = "INKPEER1"
+
+// maxFrame is the largest payload written in a single frame.
+const maxFrame = 1 << 16
+
+// Streams carried by a peer connection. Each side runs an RPC client on one
+// and serves RPCs on the other so a single TCP connection is used in both
+// directions.
+const (
+	// dialerStream carries calls from the side that opened the connection.
+	dialerStream = 0
+	// acceptorStream carries calls from the side that accepted it.
+	acceptorStream = 1
+)
+
+var errMuxClosed = errors.New("connection closed")
+
+// muxConn multiplexes two streams over one connection. Each frame is a stream
+// id, a big endian uint32 length and the payload.
+type muxConn struct {
+	conn    net.Conn
+	r       io.Reader
+	streams [2]*muxStream
+
+	wmu       sync.Mutex
+	closeOnce sync.Once
+
+	helloMu  sync.Mutex
+	gotHello bool
+}
+
+type muxStream struct {
+	m  *muxConn
+	id byte
+	r  *io.PipeReader
+	w  *io.PipeWriter
+}
+
+// newMuxConn starts demultiplexing conn. r is used for reading so any data
+// buffered while checking for peerMagic isn't lost.
+func newMuxConn(conn net.Conn, r io.Reader) *muxConn {
+	m := &muxConn{conn: conn, r: r}
+	for id := range m.streams {
+		pr, pw := io.Pipe()
+		m.streams[id] = &muxStream{m: m, id: byte(id), r: pr, w: pw}
+	}
+	go m.readLoop()
+	return m
+}
+
+// dialPeerConn opens a peer connection to addr. It returns the key the peer
+// proved it has if TLS is on.
+func (i *InkMiner) dialPeerConn(addr string) (*muxConn, string, error) {
+	conn, err := net.DialTimeout("tcp", addr, i.timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	conn, identity, err := i.secureConn(conn, true)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := io.WriteString(conn, peerMagic); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return newMuxConn(conn, conn), identity, nil
+}
+
+// isPeerConn checks whether the connection starts with peerMagic. It returns
+// a reader that still has all the data that was read.
+func isPeerConn(conn net.Conn) (bool, *bufio.Reader) {
+	r := bufio.NewReader(conn)
+	magic, err := r.Peek(len(peerMagic))
+	if err != nil || string(magic) != peerMagic {
+		return false, r
+	}
+	r.Discard(len(peerMagic))
+	return true, r
+}
+
+func (m *muxConn) readLoop() {
+	var header [5]byte
+	var err error
+	for {
+		if _, err = io.ReadFull(m.r, header[:]); err != nil {
+			break
+		}
+		id := header[0]
+		n := binary.BigEndian.Uint32(header[1:])
+		if int(id) >= len(m.streams) || n > maxFrame {
+			err = errors.New("invalid frame")
+			break
+		}
+		if _, err = io.CopyN(m.streams[id].w, m.r, int64(n)); err != nil {
+			break
+		}
+	}
+	if err == io.EOF {
+		err = errMuxClosed
+	}
+	m.closeWithError(err)
+}
+
+// hello records that a Hello was received on the connection and returns
+// whether it was the first one.
+func (m *muxConn) hello() bool {
+	m.helloMu.Lock()
+	defer m.helloMu.Unlock()
+
+	if m.gotHello {
+		return false
+	}
+	m.gotHello = true
+	return true
+}
+
+func (m *muxConn) stream(id int) *muxStream {
+	return m.streams[id]
+}
+
+func (m *muxConn) closeWithError(err error) error {
+	var closeErr error
+	m.closeOnce.Do(func() {
+		for _, s := range m.streams {
+			s.w.CloseWithError(err)
+			s.r.CloseWithError(err)
+		}
+		closeErr = m.conn.Close()
+	})
+	return closeErr
+}
+
+// Close closes the connection and both streams.
+func (m *muxConn) Close() error {
+	return m.closeWithError(errMuxClosed)
+}
+
+// RemoteAddr returns the address the connection is from.
+func (m *muxConn) RemoteAddr() net.Addr {
+	return m.conn.RemoteAddr()
+}
+
+func (s *muxStream) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *muxStream) Write(p []byte) (int, error) {
+	s.m.wmu.Lock()
+	defer s.m.wmu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > maxFrame {
+			n = maxFrame
+		}
+		var header [5]byte
+		header[0] = s.id
+		binary.BigEndian.PutUint32(header[1:], uint32(n))
+		if _, err := s.m.conn.Write(header[:]); err != nil {
+			return written, err
+		}
+		if _, err := s.m.conn.Write(p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes the whole connection. A peer connection isn't useful once
+// either direction is gone.
+func (s *muxStream) Close() error {
+	return s.m.Close()
+}
@@ -2,9 +2,10 @@ package inkminer
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"net/rpc"
-	"sort"
+	"sync"
 	"time"
 
 	blockartlib "../blockartlib"
@@ -13,11 +14,13 @@ import (
 
 var ErrUnimplemented = errors.New("unimplemented")
 
-const Timeout = 2 * time.Second
+// DefaultTimeout is how long network calls to other miners can take by
+// default.
+const DefaultTimeout = 2 * time.Second
 const HeartBeatsPerInterval = 5
 
-func dialRPC(addr string) (*rpc.Client, error) {
-	conn, err := net.DialTimeout("tcp", addr, Timeout)
+func dialRPC(addr string, timeout time.Duration) (*rpc.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -42,23 +45,46 @@ func (i *InkMiner) heartbeatLoop() {
 	}
 }
 
+// peerDiscover connects to more peers if we have fewer than
+// MinNumMinerConnections. Peers come from the server if it's available and
+// from the bootstrap peers and address book otherwise.
 func (i *InkMiner) peerDiscover() error {
-	if i.NumPeers() >= int(i.settings.MinNumMinerConnections) {
+	if err := i.exchangeAddrs(); err != nil {
+		i.log.Printf("GetAddrs failed: %s", err)
+	}
+
+	need := int(i.settings.MinNumMinerConnections) - i.NumPeers()
+	if need <= 0 {
 		return nil
 	}
 
-	var resp []net.Addr
-	if err := i.client.Call("RServer.GetNodes", i.privKey.PublicKey, &resp); err != nil {
-		i.log.Printf("GetNodes failed: %s", err)
-		return err
+	var addrs []string
+	if i.client != nil {
+		var resp []net.Addr
+		if err := i.client.Call("RServer.GetNodes", i.privKey.PublicKey, &resp); err != nil {
+			i.log.Printf("GetNodes failed: %s", err)
+		}
+		for _, addr := range resp {
+			addrs = append(addrs, addr.String())
+		}
+	}
+	if len(addrs) < need {
+		candidates := i.candidateAddrs()
+		if len(candidates) > need-len(addrs) {
+			candidates = candidates[:need-len(addrs)]
+		}
+		addrs = append(addrs, candidates...)
 	}
 
-	i.log.Printf("got peers: %+v", resp)
+	i.log.Printf("got peers: %+v", addrs)
 
-	for _, addr := range resp {
+	for _, addr := range addrs {
 		addr := addr
+		if i.banned(addr) {
+			continue
+		}
 		go func() {
-			if _, err := i.addPeer(addr.String()); err != nil {
+			if _, err := i.addPeer(addr); err != nil {
 				i.log.Printf("failed to add peer: %s")
 			}
 		}()
@@ -67,126 +93,132 @@ func (i *InkMiner) peerDiscover() error {
 	return nil
 }
 
+// addPeer connects to the peer at address unless we're already connected to
+// it. The connection is used for calls in both directions.
 func (i *InkMiner) addPeer(address string) (*peer, error) {
 	if address == i.addr {
 		return nil, nil
 	}
+	if i.banned(address) {
+		return nil, bannedError(address)
+	}
 
 	i.mu.Lock()
 	p, ok := i.mu.peers[address]
+	_, outbound := i.countPeersLocked()
+	full := outbound >= i.mu.maxOutbound
 	i.mu.Unlock()
 
 	// don't readd a peer
 	if ok {
 		return p, nil
 	}
+	if full {
+		return nil, fmt.Errorf("too many outbound peers")
+	}
 
-	client, err := dialRPC(address)
+	m, identity, err := i.dialPeerConn(address)
 	if err != nil {
 		return nil, err
 	}
-
-	p = &peer{
-		rpc:     client,
-		address: address,
+	if err := i.checkPeerKey(address, identity); err != nil {
+		m.Close()
+		return nil, err
 	}
+	go i.servePeerConn(m, m.stream(acceptorStream), identity)
+
+	p = newPeer(address, rpc.NewClient(m.stream(dialerStream)))
+	p.conn = m
 
 	i.mu.Lock()
 	p2, exists := i.mu.peers[address]
 	// race condition to add peer, discard this one
 	if exists {
-		p = p2
-	} else {
-		i.mu.peers[address] = p
+		i.mu.Unlock()
+		m.Close()
+		return p2, nil
 	}
+	i.mu.peers[address] = p
 	i.mu.Unlock()
 
-	if !exists {
-		if err := p.sendHello(i); err != nil {
-			return nil, err
+	if err := p.sendHello(i); err != nil {
+		if err := i.removePeer(p); err != nil {
+			i.log.Printf("failed to remove peer: %s", err)
 		}
-		go i.peerHeartBeat(p)
+		return nil, err
 	}
+	i.startPeer(p)
 
 	return p, nil
 }
 
+// sendHello sends our handshake to the peer and checks the one it responds
+// with.
 func (p *peer) sendHello(i *InkMiner) error {
-	var resp HelloResponse
-	req := HelloRequest{
-		Addr:   i.Addr(),
-		Blocks: map[string]struct{}{},
+	handshake, err := i.handshake()
+	if err != nil {
+		return err
 	}
 
-	i.mu.Lock()
-	for blockHash := range i.mu.blockchain {
-		req.Blocks[blockHash] = struct{}{}
+	var resp HelloResponse
+	req := HelloRequest{
+		Addr:      i.Addr(),
+		Handshake: handshake,
 	}
-	i.mu.Unlock()
 
 	if err := p.rpc.Call("InkMinerRPC.Hello", req, &resp); err != nil {
 		return err
 	}
+	if err := i.checkHandshake(resp.Handshake); err != nil {
+		return err
+	}
+
+	i.mu.Lock()
+	p.negotiate(resp.Handshake)
+	i.mu.Unlock()
+
 	return nil
 }
 
 type HelloRequest struct {
-	Addr string
-
-	Blocks map[string]struct{}
+	Addr      string
+	Handshake Handshake
 }
 
-type HelloResponse struct{}
+type HelloResponse struct {
+	Handshake Handshake
+}
 
+// Hello is called by new peers over the connection they opened. The
+// connection is reused to call the peer so no connection is opened back.
+// Blocks are exchanged afterwards by sync.
 func (i *InkMinerRPC) Hello(req HelloRequest, resp *HelloResponse) error {
 	i.i.log.Printf("got Hello: %+v", req)
 
-	p, err := i.i.addPeer(req.Addr)
-	if err != nil {
-		return err
+	if i.conn == nil {
+		return fmt.Errorf("Hello must be sent over a peer connection")
 	}
-
-	if p == nil {
-		return nil
+	if !i.conn.hello() {
+		i.i.misbehaving(req.Addr, PenaltyProtocol, "repeated Hello")
+		return fmt.Errorf("repeated Hello")
 	}
 
-	// send all blocks the client doesn't have
-	go func() {
-		depths := map[string]int{}
-
-		var toSend []string
-		i.i.mu.Lock()
-		for hash := range i.i.mu.blockchain {
-			if _, ok := req.Blocks[hash]; ok {
-				continue
-			}
-
-			// build up the depths of all the blocks so we can send them in order
-			if _, err := i.i.blockDepthLocked(hash, depths); err != nil {
-				i.i.log.Printf("blockDepthLocked err: %+v", err)
-				// send any blocks without a proper chain last
-				depths[hash] = len(i.i.mu.blockchain)
-			}
-
-			toSend = append(toSend, hash)
-		}
-		i.i.mu.Unlock()
-
-		sort.Slice(toSend, func(i, j int) bool {
-			return depths[toSend[i]] < depths[toSend[j]]
-		})
+	if err := i.i.checkHandshake(req.Handshake); err != nil {
+		return err
+	}
+	if err := i.i.checkPeerKey(req.Addr, i.identity); err != nil {
+		return err
+	}
 
-		for _, hash := range toSend {
-			block, ok := i.i.GetBlock(hash)
-			if !ok {
-				continue
-			}
+	handshake, err := i.i.handshake()
+	if err != nil {
+		return err
+	}
+	resp.Handshake = handshake
 
-			if err := p.notifyBlock(block); err != nil {
-				i.i.log.Printf("failed to send block to new client: %s", err)
-			}
-		}
-	}()
+	if _, err := i.i.acceptPeer(req.Addr, i.conn, req.Handshake); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -215,6 +247,13 @@ func (i *InkMiner) peerDiscoveryLoop() {
 			i.log.Printf("Peer discovery error: %s", err)
 		}
 
+		// Catch up on anything that was missed while a peer was unreachable.
+		go i.sync()
+
+		if err := i.savePeersFile(); err != nil {
+			i.log.Printf("failed to save peers file: %s", err)
+		}
+
 		select {
 		case <-i.stopper.ShouldStop():
 			return
@@ -223,17 +262,16 @@ func (i *InkMiner) peerDiscoveryLoop() {
 	}
 }
 
+// asyncSend queues a message to every peer. Messages are sent to each peer in
+// the order they were queued and dropped if the peer's queue is full.
 func (i *InkMiner) asyncSend(f func(p *peer) error) error {
 	i.mu.Lock()
 	defer i.mu.Unlock()
 
 	for _, p := range i.mu.peers {
-		p := p
-		go func() {
-			if err := f(p); err != nil {
-				i.log.Printf("asyncSend error (to %s): %s", p, err)
-			}
-		}()
+		if err := p.enqueue(f); err != nil {
+			i.log.Printf("asyncSend error (to %s): %s", p, err)
+		}
 	}
 
 	return nil
@@ -245,16 +283,8 @@ type NotifyOperationRequest struct {
 
 type NotifyOperationResponse struct{}
 
-func (i *InkMiner) floodOperation(operation blockartlib.Operation) error {
-	req := NotifyOperationRequest{
-		Operation: operation,
-	}
-	return i.asyncSend(func(p *peer) error {
-		var resp NotifyOperationResponse
-		return p.rpc.Call("InkMinerRPC.NotifyOperation", req, &resp)
-	})
-}
-
+// NotifyOperation adds an operation directly. Peers announce operations to
+// each other with Inv instead.
 func (i *InkMinerRPC) NotifyOperation(req NotifyOperationRequest, resp *NotifyOperationResponse) error {
 	return i.i.addOperation(req.Operation)
 }
@@ -263,21 +293,29 @@ func (i *InkMiner) addOperation(op blockartlib.Operation) error {
 	if err := i.validateOp(op); err != nil {
 		return err
 	}
+	// An operation that doesn't fit in a block on its own can never be mined.
+	if err := i.checkBlockLimits([]blockartlib.Operation{op}); err != nil {
+		return err
+	}
 
 	hash, err := op.Hash()
 	if err != nil {
 		return err
 	}
+	owner, err := op.PubKeyString()
+	if err != nil {
+		return err
+	}
 
 	i.mu.Lock()
-	_, ok := i.mu.mempool[hash]
-	if !ok {
-		i.mu.mempool[hash] = op
+	if _, ok := i.mu.mempool[hash]; ok {
+		i.mu.Unlock()
+		return nil
 	}
+	err = i.admitOperationLocked(hash, op, owner, time.Now())
 	i.mu.Unlock()
-
-	if ok {
-		return nil
+	if err != nil {
+		return err
 	}
 
 	select {
@@ -286,7 +324,7 @@ func (i *InkMiner) addOperation(op blockartlib.Operation) error {
 	}
 
 	// if it's a new operation, announce it to all peers
-	return i.floodOperation(op)
+	return i.announceOperation(hash)
 }
 
 type NotifyBlockRequest struct {
@@ -295,20 +333,77 @@ type NotifyBlockRequest struct {
 
 type NotifyBlockResponse struct{}
 
-func (i *InkMiner) announceBlock(block blockartlib.Block) error {
-	return i.asyncSend(func(p *peer) error {
-		return p.notifyBlock(block)
-	})
+// MaxGetBlocks is the maximum number of blocks returned by a GetBlocks call.
+const MaxGetBlocks = 500
+
+type GetBlocksRequest struct {
+	Hashes []string
 }
 
-func (p *peer) notifyBlock(block blockartlib.Block) error {
-	req := NotifyBlockRequest{
-		Block: block,
+type GetBlocksResponse struct {
+	Blocks []blockartlib.Block
+}
+
+// GetBlocks returns the requested blocks that this miner has. Unknown hashes
+// and blocks we only have the header of are skipped.
+func (i *InkMinerRPC) GetBlocks(req GetBlocksRequest, resp *GetBlocksResponse) error {
+	if len(req.Hashes) > MaxGetBlocks {
+		return fmt.Errorf("too many blocks requested: %d > %d", len(req.Hashes), MaxGetBlocks)
 	}
-	var resp NotifyBlockResponse
-	return p.rpc.Call("InkMinerRPC.NotifyBlock", req, &resp)
+
+	i.i.mu.Lock()
+	defer i.i.mu.Unlock()
+
+	for _, hash := range req.Hashes {
+		if block, ok := i.i.mu.blockchain[hash]; ok && !bodyless(block) {
+			resp.Blocks = append(resp.Blocks, block)
+		}
+	}
+	return nil
 }
 
+// requestBlocks asks all peers for the given blocks and adds any that come
+// back. Blocks that were requested recently are skipped.
+func (i *InkMiner) requestBlocks(hashes []string) error {
+	now := time.Now()
+
+	var req GetBlocksRequest
+	i.mu.Lock()
+	for hash, at := range i.mu.requested {
+		if now.Sub(at) > i.timeout {
+			delete(i.mu.requested, hash)
+		}
+	}
+	for _, hash := range hashes {
+		if _, ok := i.mu.requested[hash]; ok {
+			continue
+		}
+		i.mu.requested[hash] = now
+		req.Hashes = append(req.Hashes, hash)
+	}
+	i.mu.Unlock()
+
+	if len(req.Hashes) == 0 {
+		return nil
+	}
+
+	return i.asyncSend(func(p *peer) error {
+		var resp GetBlocksResponse
+		if err := p.rpc.Call("InkMinerRPC.GetBlocks", req, &resp); err != nil {
+			return err
+		}
+		for _, block := range resp.Blocks {
+			if _, err := i.AddBlock(block); err != nil {
+				i.misbehaving(p.address, PenaltyInvalid, err.Error())
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// NotifyBlock adds a block directly. Peers announce blocks to each other with
+// Inv instead.
 func (i *InkMinerRPC) NotifyBlock(req NotifyBlockRequest, resp *NotifyBlockResponse) error {
 	if _, err := i.i.AddBlock(req.Block); err != nil {
 		return err
@@ -318,10 +413,12 @@ func (i *InkMinerRPC) NotifyBlock(req NotifyBlockRequest, resp *NotifyBlockRespo
 
 func (i *InkMiner) removePeer(p *peer) error {
 	i.mu.Lock()
-	defer i.mu.Unlock()
+	if i.mu.peers[p.address] == p {
+		delete(i.mu.peers, p.address)
+	}
+	i.mu.Unlock()
 
-	delete(i.mu.peers, p.address)
-	return p.rpc.Close()
+	return p.close()
 }
 
 func (i *InkMiner) peerHeartBeat(p *peer) {
@@ -331,6 +428,7 @@ func (i *InkMiner) peerHeartBeat(p *peer) {
 
 	remove := func() {
 		i.log.Printf("peer timed out: %s", p)
+		i.misbehaving(p.address, PenaltyTimeout, "heartbeat timed out")
 		if err := i.removePeer(p); err != nil {
 			i.log.Printf("failed to remove peer: %s", err)
 		}
@@ -340,6 +438,8 @@ func (i *InkMiner) peerHeartBeat(p *peer) {
 		select {
 		case <-i.stopper.ShouldStop():
 			return
+		case <-p.done:
+			return
 		case <-ticker.C:
 		}
 
@@ -349,12 +449,16 @@ func (i *InkMiner) peerHeartBeat(p *peer) {
 		select {
 		case <-i.stopper.ShouldStop():
 			return
+		case <-p.done:
+			return
 		case reply := <-call.Done:
 			if reply.Error != nil {
 				i.log.Printf("got heartbeat error: %s", reply.Error)
 				remove()
 				return
 			}
+			i.behaving(p.address)
+			i.noteAddr(p.address)
 		case <-time.After(timeout):
 			remove()
 			return
@@ -362,23 +466,50 @@ func (i *InkMiner) peerHeartBeat(p *peer) {
 	}
 }
 
-// Helper Function: Adds block to the InkMiner
+// Helper Function: Adds block to the InkMiner. The block is fully validated
+// before it's stored or announced to peers, invalid blocks return an error
+// with the reason. Blocks whose parent is unknown are kept in the orphan pool
+// until the parent arrives.
 func (i *InkMiner) AddBlock(block blockartlib.Block) (success bool, err error) {
-	if err := i.isBlockNonceValid(block); err != nil {
+	hash, err := block.Hash()
+	if err != nil {
 		return false, err
 	}
 
-	hash, err := block.Hash()
+	if _, ok := i.GetBlock(hash); ok {
+		return false, nil
+	}
+
+	// Check the nonce before keeping a block around as an orphan so it costs
+	// something to fill up the pool.
+	if err := i.isBlockNonceValid(block.BlockHeader); err != nil {
+		return false, fmt.Errorf("rejected block %s: %+v", hash, err)
+	}
+	if _, ok := i.GetBlock(block.PrevBlock); !ok && block.PrevBlock != i.settings.GenesisBlockHash {
+		i.addOrphan(hash, block)
+		return false, nil
+	}
+
+	state, err := i.validateBlock(block)
+	if err != nil {
+		return false, fmt.Errorf("rejected block %s: %+v", hash, err)
+	}
+	ops, err := indexOps(block)
 	if err != nil {
 		return false, err
 	}
 
 	i.mu.Lock()
-	if _, ok := i.mu.blockchain[hash]; ok {
+	added, headChanged := i.addBlockLocked(hash, block, state, ops)
+	if !added {
 		i.mu.Unlock()
 		return false, nil
 	}
-	i.mu.blockchain[hash] = block
+	// The block is stored while locked so it's always stored after its
+	// parent.
+	if err := i.store.Append(block); err != nil {
+		i.log.Printf("failed to store block %s: %+v", hash, err)
+	}
 	i.mu.Unlock()
 
 	select {
@@ -386,35 +517,91 @@ func (i *InkMiner) AddBlock(block blockartlib.Block) (success bool, err error) {
 	default:
 	}
 
-	state, err := i.CalculateState(block)
-	if err != nil {
-		i.log.Printf("got possibly invalid block, orphaned/out of order?: %+v: %+v", block, err)
-	} else {
-		i.mu.Lock()
-		for opHash, validateNumWaiter := range i.mu.validateNumMap {
-			validateNum, ok := state.commitedOperations[opHash]
-			if ok && validateNum >= int(validateNumWaiter.validateNum) {
-				var blockHash string
-				currentBlock := block
-				for j := 0; j < int(validateNumWaiter.validateNum); j++ {
-					blockHash = currentBlock.PrevBlock
-					currentBlock = i.mu.blockchain[currentBlock.PrevBlock]
-				}
-				delete(i.mu.validateNumMap, opHash)
-				validateNumWaiter.done <- blockHash
-			}
-		}
-		i.mu.Unlock()
+	// Confirmations are only counted on the canonical chain so they only need
+	// to be rechecked when the head moves.
+	if headChanged {
+		i.updateConfirmations(hash, state)
 	}
 
-	return true, i.announceBlock(block)
+	err = i.announceBlock(hash)
+	i.connectOrphans(hash)
+	return true, err
+}
+
+// addBlockLocked adds a validated block to the blockchain, the state cache
+// and the shape index. It returns whether the block was new and whether the
+// head moved to it. It must be locked before calling!
+func (i *InkMiner) addBlockLocked(hash string, block blockartlib.Block, state State, ops []indexedOp) (added, headChanged bool) {
+	if _, ok := i.mu.blockchain[hash]; ok {
+		return false, false
+	}
+	i.mu.blockchain[hash] = block
+	i.states.put(hash, state)
+	i.indexBlockLocked(hash, ops)
+	return true, i.addBlockMetaLocked(hash, block, state)
 }
 
 type peer struct {
 	address string
 	rpc     *rpc.Client
+	// conn is the connection the peer's calls come in on and rpc calls it
+	// over.
+	conn *muxConn
+	// known is the inventory the peer is known to have so it isn't announced
+	// to it again.
+	known *knownInventory
+
+	// queue holds the messages waiting to be sent by sendLoop.
+	queue chan func(p *peer) error
+	// done is closed when the peer is removed.
+	done chan struct{}
+	// version is the protocol version used with the peer, softwareVersion is
+	// the build it's running and capabilities are the optional features both
+	// sides support. They're set by the handshake and protected by
+	// InkMiner.mu.
+	version         int
+	softwareVersion string
+	capabilities    []string
+
+	// inbound is whether the peer opened the connection.
+	inbound bool
+	// connected is when the connection was made.
+	connected time.Time
+	closeOnce sync.Once
+	// inv is the inventory waiting to be announced to the peer.
+	inv struct {
+		sync.Mutex
+
+		blocks []string
+		ops    []string
+		// queued is whether a flush is in the send queue.
+		queued bool
+	}
+}
+
+func newPeer(address string, client *rpc.Client) *peer {
+	return &peer{
+		rpc:       client,
+		address:   address,
+		known:     newKnownInventory(),
+		queue:     make(chan func(p *peer) error, MaxSendQueue),
+		done:      make(chan struct{}),
+		connected: time.Now(),
+	}
+}
+
+// close stops the peer's background work and closes the connection.
+func (p *peer) close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.done)
+		if p.rpc != nil {
+			err = p.rpc.Close()
+		}
+	})
+	return err
 }
 
-func (p peer) String() string {
+func (p *peer) String() string {
 	return colors.Green(p.address)
 }
@@ -0,0 +1,309 @@
+package inkminer
+
+import (
+	"crypto/elliptic"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"../blockartlib"
+	"../crypto"
+)
+
+// listenTestInkMiner accepts connections for the miner on a local port. It
+// returns a counter of the connections accepted.
+func listenTestInkMiner(t *testing.T, im *InkMiner) *int32 {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	im.addr = l.Addr().String()
+	im.settings.HeartBeat = 1000
+	im.mu.head = im.settings.GenesisBlockHash
+
+	var accepted int32
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go im.handleConn(conn)
+		}
+	}()
+	go func() {
+		<-im.stopper.ShouldStop()
+		l.Close()
+	}()
+
+	return &accepted
+}
+
+func TestPeerConnectionReused(t *testing.T) {
+	a := generateTestInkMiner(t)
+	b := generateTestInkMiner(t)
+	defer a.stopper.Stop()
+	defer b.stopper.Stop()
+
+	aAccepted := listenTestInkMiner(t, a)
+	bAccepted := listenTestInkMiner(t, b)
+
+	if _, err := b.addPeer(a.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	a.mu.Lock()
+	pb := a.mu.peers[b.Addr()]
+	a.mu.Unlock()
+	b.mu.Lock()
+	pa := b.mu.peers[a.Addr()]
+	b.mu.Unlock()
+
+	if pb == nil || !pb.inbound {
+		t.Fatalf("a should have b as an inbound peer: %+v", pb)
+	}
+	if pa == nil || pa.inbound {
+		t.Fatalf("b should have a as an outbound peer: %+v", pa)
+	}
+
+	// a calls b over the connection b opened.
+	for _, p := range []*peer{pa, pb} {
+		var resp GetHeadersResponse
+		req := GetHeadersRequest{Locator: []string{a.settings.GenesisBlockHash}}
+		if err := p.rpc.Call("InkMinerRPC.GetHeaders", req, &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := atomic.LoadInt32(aAccepted); n != 1 {
+		t.Fatalf("a accepted %d connections; wanted 1", n)
+	}
+	if n := atomic.LoadInt32(bAccepted); n != 0 {
+		t.Fatalf("b accepted %d connections; wanted 0", n)
+	}
+
+	// Adding again reuses the connection.
+	if p, err := b.addPeer(a.Addr()); err != nil || p != pa {
+		t.Fatalf("expected existing peer: %+v, %+v", p, err)
+	}
+
+	// A second Hello on the same connection is a protocol violation.
+	if err := pa.sendHello(b); err == nil || !strings.Contains(err.Error(), "repeated Hello") {
+		t.Fatalf("expected repeated Hello error: %+v", err)
+	}
+}
+
+func TestPeerLimits(t *testing.T) {
+	a := generateTestInkMiner(t)
+	b := generateTestInkMiner(t)
+	defer a.stopper.Stop()
+	defer b.stopper.Stop()
+
+	listenTestInkMiner(t, a)
+	listenTestInkMiner(t, b)
+
+	a.SetPeerLimits(0, DefaultMaxOutbound)
+	if _, err := b.addPeer(a.Addr()); err == nil || !strings.Contains(err.Error(), "too many inbound peers") {
+		t.Fatalf("expected inbound limit error: %+v", err)
+	}
+	if b.NumPeers() != 0 {
+		t.Fatalf("rejected peer should be removed")
+	}
+
+	b.SetPeerLimits(DefaultMaxInbound, 0)
+	if _, err := b.addPeer(a.Addr()); err == nil || !strings.Contains(err.Error(), "too many outbound peers") {
+		t.Fatalf("expected outbound limit error: %+v", err)
+	}
+}
+
+func TestEvictionCandidate(t *testing.T) {
+	im := generateTestInkMiner(t)
+
+	start := time.Now()
+	addPeer := func(j int, addr string) *peer {
+		p := newPeer(addr, nil)
+		p.inbound = true
+		p.connected = start.Add(time.Duration(j) * time.Second)
+		im.mu.peers[addr] = p
+		return p
+	}
+
+	var peers []*peer
+	for j := 0; j < 8; j++ {
+		peers = append(peers, addPeer(j, fmt.Sprintf("10.0.0.%d:1", j)))
+	}
+	peers = append(peers, addPeer(8, "10.1.0.1:1"))
+	peers = append(peers, addPeer(9, "10.2.0.1:1"))
+
+	// Outbound peers are never evicted.
+	outbound := newPeer("10.0.0.100:1", nil)
+	outbound.connected = start.Add(time.Hour)
+	im.mu.peers[outbound.address] = outbound
+
+	// The oldest two have misbehaved.
+	im.mu.scores[peers[0].address] = -10
+	im.mu.scores[peers[1].address] = -10
+
+	// Protected: 2 and 3 by score, 0, 1, 4 and 5 by age. Of the rest the 10.0
+	// network has the most peers and 7 is the newest.
+	if p := im.evictionCandidateLocked(); p != peers[7] {
+		t.Fatalf("evicted %s; wanted %s", p, peers[7])
+	}
+
+	for _, p := range peers[4:8] {
+		delete(im.mu.peers, p.address)
+	}
+	if p := im.evictionCandidateLocked(); p != nil {
+		t.Fatalf("all peers should be protected, evicted %s", p)
+	}
+}
+
+func TestPeerHandshake(t *testing.T) {
+	a := generateTestInkMiner(t)
+	b := generateTestInkMiner(t)
+	defer a.stopper.Stop()
+	defer b.stopper.Stop()
+
+	listenTestInkMiner(t, a)
+	listenTestInkMiner(t, b)
+
+	b.settings.PoWDifficultyOpBlock = 5
+	if _, err := b.addPeer(a.Addr()); err == nil || !strings.Contains(err.Error(), "incompatible peer [settings hash") {
+		t.Fatalf("expected settings hash error: %+v", err)
+	}
+	b.settings.PoWDifficultyOpBlock = a.settings.PoWDifficultyOpBlock
+	b.settings.MaxBlockVertices = 10
+	if _, err := b.addPeer(a.Addr()); err == nil || !strings.Contains(err.Error(), "incompatible peer [settings hash") {
+		t.Fatalf("expected settings hash error for different block limits: %+v", err)
+	}
+	b.settings.GenesisBlockHash = "other"
+	if _, err := b.addPeer(a.Addr()); err == nil || !strings.Contains(err.Error(), "incompatible peer [genesis block other") {
+		t.Fatalf("expected genesis block error: %+v", err)
+	}
+	if a.NumPeers() != 0 || b.NumPeers() != 0 {
+		t.Fatalf("incompatible peers shouldn't be added")
+	}
+
+	b.settings = a.settings
+	// Settings that don't affect consensus may differ.
+	b.settings.MinNumMinerConnections = 3
+	if _, err := b.addPeer(a.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, im := range []*InkMiner{a, b} {
+		im.mu.Lock()
+		for _, p := range im.mu.peers {
+			if p.version != ProtocolVersion || p.softwareVersion != SoftwareVersion || fmt.Sprint(p.capabilities) != fmt.Sprint(Capabilities) {
+				t.Errorf("handshake not recorded: %+v %+v %+v", p.version, p.softwareVersion, p.capabilities)
+			}
+		}
+		im.mu.Unlock()
+	}
+}
+
+func TestNegotiateCapabilities(t *testing.T) {
+	p := newPeer("peer", nil)
+	p.negotiate(Handshake{
+		ProtocolVersion: ProtocolVersion + 1,
+		Capabilities:    []string{"headers", "future"},
+	})
+	if p.version != ProtocolVersion {
+		t.Fatalf("got version %d; wanted %d", p.version, ProtocolVersion)
+	}
+	if !p.hasCapability("headers") || p.hasCapability("future") || p.hasCapability("inv") {
+		t.Fatalf("got capabilities %+v", p.capabilities)
+	}
+}
+
+func TestTLSPeers(t *testing.T) {
+	a := generateTestInkMiner(t)
+	b := generateTestInkMiner(t)
+	c := generateTestInkMiner(t)
+	defer a.stopper.Stop()
+	defer b.stopper.Stop()
+	defer c.stopper.Stop()
+
+	for _, im := range []*InkMiner{a, b} {
+		if err := im.SetTLS(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	listenTestInkMiner(t, a)
+	listenTestInkMiner(t, b)
+	listenTestInkMiner(t, c)
+
+	// Plaintext connections are refused.
+	if _, err := c.addPeer(a.Addr()); err == nil {
+		t.Fatalf("expected plaintext connection to fail")
+	}
+
+	// b's address was seen with another key before.
+	other, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.mu.peerKeys[b.Addr()] = elliptic.Marshal(other.Curve, other.X, other.Y)
+	if _, err := b.addPeer(a.Addr()); err == nil || !strings.Contains(err.Error(), "isn't registered") {
+		t.Fatalf("expected key mismatch error: %+v", err)
+	}
+
+	delete(a.mu.peerKeys, b.Addr())
+	if _, err := b.addPeer(a.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if a.NumPeers() != 1 || b.NumPeers() != 1 {
+		t.Fatalf("expected a and b to be peered")
+	}
+
+	// Art nodes have to prove they have the miner's key.
+	if _, _, err := blockartlib.OpenCanvasTLS(a.Addr(), *other); err == nil {
+		t.Fatalf("expected art node with the wrong key to be refused")
+	}
+	if _, settings, err := blockartlib.OpenCanvasTLS(a.Addr(), *a.privKey); err != nil {
+		t.Fatal(err)
+	} else if settings.CanvasXMax != a.settings.CanvasSettings.CanvasXMax {
+		t.Fatalf("got settings %+v", settings)
+	}
+}
+
+func TestResolveAdvertiseAddr(t *testing.T) {
+	im := generateTestInkMiner(t)
+
+	cases := []struct {
+		advertise string
+		listen    *net.TCPAddr
+		want      string
+	}{
+		{"", &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 8000}, "10.1.2.3:8000"},
+		{"", &net.TCPAddr{IP: net.ParseIP("::1"), Port: 8000}, "[::1]:8000"},
+		{"example.com", &net.TCPAddr{Port: 8000}, "example.com:8000"},
+		{"2001:db8::1", &net.TCPAddr{Port: 8000}, "[2001:db8::1]:8000"},
+		{"example.com:9000", &net.TCPAddr{Port: 8000}, "example.com:9000"},
+	}
+	for _, c := range cases {
+		im.SetAdvertiseAddr(c.advertise)
+		if got := im.resolveAdvertiseAddr(c.listen); got != c.want {
+			t.Errorf("%q, %s: got %q; wanted %q", c.advertise, c.listen, got, c.want)
+		}
+	}
+
+	// Without a configured or bound address some address is always found,
+	// even with no network.
+	im.SetAdvertiseAddr("")
+	if got := im.resolveAdvertiseAddr(&net.TCPAddr{Port: 8000}); !strings.HasSuffix(got, ":8000") {
+		t.Errorf("got %q", got)
+	}
+
+	if err := im.SetListenAddr("8000"); err == nil {
+		t.Errorf("expected error for listen address without port")
+	}
+	if err := im.SetListenAddr("[::1]:0"); err != nil {
+		t.Error(err)
+	}
+}
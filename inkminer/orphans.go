@@ -0,0 +1,132 @@
+package inkminer
+
+import (
+	"time"
+
+	"../blockartlib"
+)
+
+// MaxOrphans is the maximum number of blocks kept while waiting for their
+// parents. The oldest orphan is evicted when the pool is full.
+const MaxOrphans = 100
+
+// OrphanTimeout is how long an orphan is kept for its parent to arrive.
+const OrphanTimeout = 5 * time.Minute
+
+// orphan is a block whose parent we don't have yet.
+type orphan struct {
+	block blockartlib.Block
+	added time.Time
+	// seq orders the orphans by when they were added.
+	seq uint64
+}
+
+// OrphanPoolSize returns the number of blocks waiting on their parents.
+func (i *InkMiner) OrphanPoolSize() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return len(i.mu.orphans)
+}
+
+// addOrphan adds a block with an unknown parent to the orphan pool and asks
+// our peers for the first missing ancestor.
+func (i *InkMiner) addOrphan(hash string, block blockartlib.Block) {
+	i.mu.Lock()
+	if _, ok := i.mu.orphans[hash]; ok {
+		i.mu.Unlock()
+		return
+	}
+
+	i.pruneOrphansLocked(time.Now())
+	if len(i.mu.orphans) >= MaxOrphans {
+		i.removeOrphanLocked(i.oldestOrphanLocked())
+	}
+
+	i.mu.seen++
+	i.mu.orphans[hash] = orphan{block: block, added: time.Now(), seq: i.mu.seen}
+	i.mu.orphansByParent[block.PrevBlock] = append(i.mu.orphansByParent[block.PrevBlock], hash)
+
+	// Walk back through the orphans to find the block that's actually
+	// missing.
+	missing := block.PrevBlock
+	for {
+		o, ok := i.mu.orphans[missing]
+		if !ok {
+			break
+		}
+		missing = o.block.PrevBlock
+	}
+	i.mu.Unlock()
+
+	i.log.Printf("orphan block %s, requesting missing ancestor %s", hash, missing)
+	if err := i.requestBlocks([]string{missing}); err != nil {
+		i.log.Printf("failed to request blocks: %+v", err)
+	}
+}
+
+// pruneOrphansLocked removes orphans that have been waiting too long. It must
+// be locked before calling!
+func (i *InkMiner) pruneOrphansLocked(now time.Time) {
+	for hash, o := range i.mu.orphans {
+		if now.Sub(o.added) > OrphanTimeout {
+			i.removeOrphanLocked(hash)
+		}
+	}
+}
+
+// oldestOrphanLocked returns the hash of the orphan that was added first. It
+// must be locked before calling!
+func (i *InkMiner) oldestOrphanLocked() string {
+	var oldest string
+	var oldestSeq uint64
+	for hash, o := range i.mu.orphans {
+		if oldest == "" || o.seq < oldestSeq {
+			oldest = hash
+			oldestSeq = o.seq
+		}
+	}
+	return oldest
+}
+
+// removeOrphanLocked removes an orphan from the pool. It must be locked before
+// calling!
+func (i *InkMiner) removeOrphanLocked(hash string) {
+	o, ok := i.mu.orphans[hash]
+	if !ok {
+		return
+	}
+	delete(i.mu.orphans, hash)
+
+	siblings := i.mu.orphansByParent[o.block.PrevBlock]
+	for j, sibling := range siblings {
+		if sibling == hash {
+			siblings = append(siblings[:j], siblings[j+1:]...)
+			break
+		}
+	}
+	if len(siblings) > 0 {
+		i.mu.orphansByParent[o.block.PrevBlock] = siblings
+	} else {
+		delete(i.mu.orphansByParent, o.block.PrevBlock)
+	}
+}
+
+// connectOrphans adds all orphans that were waiting on the given block now
+// that it has been added.
+func (i *InkMiner) connectOrphans(parent string) {
+	i.mu.Lock()
+	var blocks []blockartlib.Block
+	for _, hash := range i.mu.orphansByParent[parent] {
+		blocks = append(blocks, i.mu.orphans[hash].block)
+		delete(i.mu.orphans, hash)
+	}
+	delete(i.mu.orphansByParent, parent)
+	i.mu.Unlock()
+
+	for _, block := range blocks {
+		if _, err := i.AddBlock(block); err != nil {
+			i.log.Printf("failed to connect orphan: %+v", err)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package inkminer
+
+import (
+	"encoding/hex"
+	"hash/fnv"
+	"math/bits"
+	"sync"
+
+	"../blockartlib"
+)
+
+// pmapBits is the number of hash bits used at each level of a pmap.
+const pmapBits = 5
+
+// pmap is a persistent map from strings to values, a hash array mapped trie.
+// Updates return a new map that shares everything but the path to the changed
+// key with the old one, so they cost O(log n) and the old map stays valid.
+// The zero value is an empty map.
+type pmap struct {
+	root *pmapNode
+	size int
+}
+
+// pmapNode is a node of the trie. bitmap has a bit set for each child present
+// and entries holds them in order. Keys whose hashes are equal end up in a
+// collision node past the last level, which has no bitmap and is searched in
+// order.
+//
+// Nodes never change once they're made, so the hash of each one for the state
+// root is worked out the first time it's needed and kept.
+type pmapNode struct {
+	bitmap  uint32
+	entries []pmapEntry
+
+	digestOnce sync.Once
+	digest     []byte
+}
+
+// pmapEntry is either a key and value, or a subtree if node is set.
+type pmapEntry struct {
+	node  *pmapNode
+	hash  uint64
+	key   string
+	value interface{}
+}
+
+func pmapHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+func (m pmap) len() int {
+	return m.size
+}
+
+func (m pmap) get(key string) (interface{}, bool) {
+	hash := pmapHash(key)
+	n := m.root
+	for shift := uint(0); n != nil; shift += pmapBits {
+		if shift >= 64 {
+			for _, e := range n.entries {
+				if e.key == key {
+					return e.value, true
+				}
+			}
+			return nil, false
+		}
+
+		bit := uint32(1) << ((hash >> shift) & 31)
+		if n.bitmap&bit == 0 {
+			return nil, false
+		}
+		e := n.entries[bits.OnesCount32(n.bitmap&(bit-1))]
+		if e.node == nil {
+			if e.key == key {
+				return e.value, true
+			}
+			return nil, false
+		}
+		n = e.node
+	}
+	return nil, false
+}
+
+// set returns a map with key set to value.
+func (m pmap) set(key string, value interface{}) pmap {
+	root, added := m.root.set(0, pmapEntry{hash: pmapHash(key), key: key, value: value})
+	m.root = root
+	if added {
+		m.size++
+	}
+	return m
+}
+
+// delete returns a map without key.
+func (m pmap) delete(key string) pmap {
+	root, removed := m.root.delete(0, pmapHash(key), key)
+	if removed {
+		m.root = root
+		m.size--
+	}
+	return m
+}
+
+// each calls fn for every key and value until it returns false.
+func (m pmap) each(fn func(key string, value interface{}) bool) {
+	m.root.each(fn)
+}
+
+func (n *pmapNode) set(shift uint, leaf pmapEntry) (*pmapNode, bool) {
+	if n == nil {
+		n = &pmapNode{}
+	}
+
+	if shift >= 64 {
+		for j, e := range n.entries {
+			if e.key == leaf.key {
+				return n.replace(j, leaf), false
+			}
+		}
+		entries := make([]pmapEntry, len(n.entries), len(n.entries)+1)
+		copy(entries, n.entries)
+		return &pmapNode{entries: append(entries, leaf)}, true
+	}
+
+	bit := uint32(1) << ((leaf.hash >> shift) & 31)
+	pos := bits.OnesCount32(n.bitmap & (bit - 1))
+	if n.bitmap&bit == 0 {
+		entries := make([]pmapEntry, len(n.entries)+1)
+		copy(entries, n.entries[:pos])
+		entries[pos] = leaf
+		copy(entries[pos+1:], n.entries[pos:])
+		return &pmapNode{bitmap: n.bitmap | bit, entries: entries}, true
+	}
+
+	e := n.entries[pos]
+	switch {
+	case e.node != nil:
+		child, added := e.node.set(shift+pmapBits, leaf)
+		return n.replace(pos, pmapEntry{node: child}), added
+	case e.key == leaf.key:
+		return n.replace(pos, leaf), false
+	default:
+		// Push both keys down a level.
+		child, _ := (*pmapNode)(nil).set(shift+pmapBits, e)
+		child, _ = child.set(shift+pmapBits, leaf)
+		return n.replace(pos, pmapEntry{node: child}), true
+	}
+}
+
+// delete returns the node without key, or nil if it's empty.
+func (n *pmapNode) delete(shift uint, hash uint64, key string) (*pmapNode, bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	if shift >= 64 {
+		for j, e := range n.entries {
+			if e.key == key {
+				return n.remove(j, 0), true
+			}
+		}
+		return n, false
+	}
+
+	bit := uint32(1) << ((hash >> shift) & 31)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	pos := bits.OnesCount32(n.bitmap & (bit - 1))
+	e := n.entries[pos]
+
+	if e.node == nil {
+		if e.key != key {
+			return n, false
+		}
+		return n.remove(pos, bit), true
+	}
+
+	child, removed := e.node.delete(shift+pmapBits, hash, key)
+	if !removed {
+		return n, false
+	}
+	switch {
+	case child == nil:
+		return n.remove(pos, bit), true
+	case len(child.entries) == 1 && child.entries[0].node == nil:
+		// Pull a lone key back up a level.
+		return n.replace(pos, child.entries[0]), true
+	default:
+		return n.replace(pos, pmapEntry{node: child}), true
+	}
+}
+
+// replace returns a copy of the node with the entry at pos replaced.
+func (n *pmapNode) replace(pos int, e pmapEntry) *pmapNode {
+	entries := make([]pmapEntry, len(n.entries))
+	copy(entries, n.entries)
+	entries[pos] = e
+	return &pmapNode{bitmap: n.bitmap, entries: entries}
+}
+
+// remove returns a copy of the node without the entry at pos, or nil if it
+// would be empty.
+func (n *pmapNode) remove(pos int, bit uint32) *pmapNode {
+	if len(n.entries) == 1 {
+		return nil
+	}
+	entries := make([]pmapEntry, 0, len(n.entries)-1)
+	entries = append(entries, n.entries[:pos]...)
+	entries = append(entries, n.entries[pos+1:]...)
+	return &pmapNode{bitmap: n.bitmap &^ bit, entries: entries}
+}
+
+func (n *pmapNode) each(fn func(key string, value interface{}) bool) bool {
+	if n == nil {
+		return true
+	}
+	for _, e := range n.entries {
+		if e.node != nil {
+			if !e.node.each(fn) {
+				return false
+			}
+		} else if !fn(e.key, e.value) {
+			return false
+		}
+	}
+	return true
+}
+
+// rootHash returns the hash of the map for the state root, see
+// blockartlib.StateNodeHash. The trie has the same shape for the same keys
+// however it was built so equal maps have equal hashes.
+func (m pmap) rootHash() []byte {
+	if m.root == nil {
+		return blockartlib.StateNodeHash(0, nil)
+	}
+	return m.root.nodeDigest()
+}
+
+func (n *pmapNode) nodeDigest() []byte {
+	n.digestOnce.Do(func() {
+		n.digest = blockartlib.StateNodeHash(n.bitmap, n.childDigests())
+	})
+	return n.digest
+}
+
+func (n *pmapNode) childDigests() [][]byte {
+	children := make([][]byte, len(n.entries))
+	for j, e := range n.entries {
+		children[j] = e.entryDigest()
+	}
+	return children
+}
+
+func (e pmapEntry) entryDigest() []byte {
+	if e.node != nil {
+		return e.node.nodeDigest()
+	}
+	return blockartlib.StateLeafHash(e.key, blockartlib.EncodeStateValue(e.value))
+}
+
+// proof returns the value of the key and the nodes on the path from its entry
+// up to the root, see blockartlib.StateProof.
+func (m pmap) proof(key string) (interface{}, []blockartlib.StateProofNode, bool) {
+	hash := pmapHash(key)
+	var nodes []*pmapNode
+	var indexes []int
+	var value interface{}
+	found := false
+
+	n := m.root
+	for shift := uint(0); n != nil && !found; shift += pmapBits {
+		nodes = append(nodes, n)
+		if shift >= 64 {
+			for j, e := range n.entries {
+				if e.key == key {
+					indexes = append(indexes, j)
+					value, found = e.value, true
+					break
+				}
+			}
+			break
+		}
+
+		bit := uint32(1) << ((hash >> shift) & 31)
+		if n.bitmap&bit == 0 {
+			break
+		}
+		pos := bits.OnesCount32(n.bitmap & (bit - 1))
+		indexes = append(indexes, pos)
+		e := n.entries[pos]
+		if e.node == nil {
+			if e.key != key {
+				break
+			}
+			value, found = e.value, true
+		}
+		n = e.node
+	}
+	if !found {
+		return nil, nil, false
+	}
+
+	path := make([]blockartlib.StateProofNode, len(nodes))
+	for j, n := range nodes {
+		children := n.childDigests()
+		node := blockartlib.StateProofNode{
+			Bitmap:   n.bitmap,
+			Children: make([]string, len(children)),
+			Index:    indexes[j],
+		}
+		for k, child := range children {
+			node.Children[k] = hex.EncodeToString(child)
+		}
+		path[len(nodes)-1-j] = node
+	}
+	return value, path, true
+}
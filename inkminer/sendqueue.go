@@ -0,0 +1,140 @@
+package inkminer
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxSendQueue is the number of messages that can be waiting to be sent to a
+// peer. Messages to a peer with a full queue are dropped.
+const MaxSendQueue = 100
+
+// SendTimeout is how long a single message to a peer may take.
+const SendTimeout = 10 * time.Second
+
+// PeerQueueDepths returns the number of messages waiting to be sent to each
+// peer.
+func (i *InkMiner) PeerQueueDepths() map[string]int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	depths := make(map[string]int, len(i.mu.peers))
+	for addr, p := range i.mu.peers {
+		depths[addr] = len(p.queue)
+	}
+	return depths
+}
+
+// enqueue adds a message to the peer's send queue. It returns an error if the
+// queue is full.
+func (p *peer) enqueue(f func(p *peer) error) error {
+	select {
+	case p.queue <- f:
+		return nil
+	default:
+		return fmt.Errorf("send queue full, dropping message")
+	}
+}
+
+// sendLoop sends the queued messages to the peer one at a time so they arrive
+// in the order they were queued. A peer that takes longer than SendTimeout to
+// take a message is dropped.
+func (i *InkMiner) sendLoop(p *peer) {
+	for {
+		var f func(p *peer) error
+		select {
+		case <-i.stopper.ShouldStop():
+			return
+		case <-p.done:
+			return
+		case f = <-p.queue:
+		}
+
+		errc := make(chan error, 1)
+		go func() {
+			errc <- f(p)
+		}()
+
+		select {
+		case <-i.stopper.ShouldStop():
+			return
+		case <-p.done:
+			return
+		case err := <-errc:
+			if err != nil {
+				i.log.Printf("send error (to %s): %s", p, err)
+			}
+		case <-time.After(SendTimeout):
+			// The send is still running so nothing else can go out after
+			// it in order. Dropping the peer closes the connection, which
+			// ends the send.
+			i.log.Printf("send to %s timed out, dropping peer", p)
+			i.misbehaving(p.address, PenaltyTimeout, "send timed out")
+			if err := i.removePeer(p); err != nil {
+				i.log.Printf("failed to remove peer: %s", err)
+			}
+			return
+		}
+	}
+}
+
+// queueInventory adds the hashes to the peer's pending announcement. Hashes
+// announced while an earlier announcement is still waiting to be sent are
+// coalesced into it.
+func (i *InkMiner) queueInventory(p *peer, blocks, ops []string) error {
+	p.inv.Lock()
+	defer p.inv.Unlock()
+
+	for _, hash := range blocks {
+		if p.known.add(hash) {
+			p.inv.blocks = append(p.inv.blocks, hash)
+		}
+	}
+	for _, hash := range ops {
+		if p.known.add(hash) {
+			p.inv.ops = append(p.inv.ops, hash)
+		}
+	}
+	if p.inv.queued || (len(p.inv.blocks) == 0 && len(p.inv.ops) == 0) {
+		return nil
+	}
+
+	if err := p.enqueue(i.flushInventory); err != nil {
+		return err
+	}
+	p.inv.queued = true
+	return nil
+}
+
+// flushInventory sends the pending announcement to the peer.
+func (i *InkMiner) flushInventory(p *peer) error {
+	p.inv.Lock()
+	req := InvRequest{
+		Blocks: p.inv.blocks,
+		Ops:    p.inv.ops,
+	}
+	p.inv.blocks = nil
+	p.inv.ops = nil
+	p.inv.queued = false
+	p.inv.Unlock()
+
+	for len(req.Blocks)+len(req.Ops) > 0 {
+		var batch InvRequest
+		n := len(req.Blocks)
+		if n > MaxInventory {
+			n = MaxInventory
+		}
+		batch.Blocks, req.Blocks = req.Blocks[:n], req.Blocks[n:]
+		n = len(req.Ops)
+		if n > MaxInventory-len(batch.Blocks) {
+			n = MaxInventory - len(batch.Blocks)
+		}
+		batch.Ops, req.Ops = req.Ops[:n], req.Ops[n:]
+
+		var resp InvResponse
+		if err := p.rpc.Call("InkMinerRPC.Inv", batch, &resp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
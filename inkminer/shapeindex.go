@@ -0,0 +1,165 @@
+package inkminer
+
+import (
+	"../blockartlib"
+)
+
+// ShapeStatus is what happened to a shape as of the current head.
+type ShapeStatus string
+
+const (
+	// ShapeOnCanvas shapes are drawn on the canvas at the head. The white
+	// shapes left by deletes are on the canvas too.
+	ShapeOnCanvas ShapeStatus = "on-canvas"
+	// ShapeDeleted shapes were added on the main chain and deleted since.
+	ShapeDeleted ShapeStatus = "deleted"
+	// ShapeOffChain shapes are only in blocks that aren't on the main chain.
+	ShapeOffChain ShapeStatus = "off-chain"
+)
+
+// ShapeInfo is where a shape was added and its status.
+type ShapeInfo struct {
+	Hash string
+	// BlockHash is the block the shape's operation is in, preferring the
+	// main chain, and OpIndex is its index in the block's records.
+	BlockHash string
+	OpIndex   int
+	OpType    blockartlib.OpType
+	Owner     string
+	Status    ShapeStatus
+}
+
+// shapeLocation is a block an operation is in and its index in the records.
+type shapeLocation struct {
+	blockHash string
+	index     int
+}
+
+// shapeEntry is the index entry for an operation. It can be in blocks on
+// several forks.
+type shapeEntry struct {
+	owner     string
+	locations []shapeLocation
+}
+
+// indexedOp is an operation of a block with its hash and owner worked out
+// before the block is indexed.
+type indexedOp struct {
+	hash  string
+	owner string
+}
+
+// indexOps hashes the operations of a block for indexBlockLocked.
+func indexOps(block blockartlib.Block) ([]indexedOp, error) {
+	ops := make([]indexedOp, 0, len(block.Records))
+	for _, op := range block.Records {
+		hash, err := op.Hash()
+		if err != nil {
+			return nil, err
+		}
+		owner, err := op.PubKeyString()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, indexedOp{hash: hash, owner: owner})
+	}
+	return ops, nil
+}
+
+// indexBlockLocked adds the operations of a block to the shape index. It must
+// be locked before calling!
+func (i *InkMiner) indexBlockLocked(hash string, ops []indexedOp) {
+	hashes := make([]string, 0, len(ops))
+	for j, op := range ops {
+		e, ok := i.mu.shapeIndex[op.hash]
+		if !ok {
+			e = &shapeEntry{owner: op.owner}
+			i.mu.shapeIndex[op.hash] = e
+		}
+		e.locations = append(e.locations, shapeLocation{blockHash: hash, index: j})
+		hashes = append(hashes, op.hash)
+	}
+	i.mu.blockOps[hash] = hashes
+}
+
+// shapeOpLocked returns the operation with the hash and the block it's in,
+// preferring the main chain. It must be locked before calling!
+func (i *InkMiner) shapeOpLocked(hash string) (blockartlib.Operation, shapeLocation, bool) {
+	e, ok := i.mu.shapeIndex[hash]
+	if !ok {
+		return blockartlib.Operation{}, shapeLocation{}, false
+	}
+	loc := e.locations[0]
+	for _, l := range e.locations {
+		if i.onMainChainLocked(l.blockHash) {
+			loc = l
+			break
+		}
+	}
+	return i.mu.blockchain[loc.blockHash].Records[loc.index], loc, true
+}
+
+// shapeLocked returns the shape an operation drew: the added shape or the
+// white shape left by a delete. It must be locked before calling!
+func (i *InkMiner) shapeLocked(hash string) (blockartlib.Shape, bool) {
+	op, _, ok := i.shapeOpLocked(hash)
+	if !ok {
+		return blockartlib.Shape{}, false
+	}
+	if op.OpType != blockartlib.DELETE {
+		return op.ADD.Shape, true
+	}
+	deleted, _, ok := i.shapeOpLocked(op.DELETE.ShapeHash)
+	if !ok {
+		return blockartlib.Shape{}, false
+	}
+	return deletedShape(deleted.ADD.Shape), true
+}
+
+// GetShapeInfo returns where a shape was added and its status at the head.
+func (i *InkMinerRPC) GetShapeInfo(req *string, resp *ShapeInfo) error {
+	i.i.mu.Lock()
+	defer i.i.mu.Unlock()
+
+	op, loc, ok := i.i.shapeOpLocked(*req)
+	if !ok {
+		return blockartlib.InvalidShapeHashError(*req)
+	}
+	*resp = ShapeInfo{
+		Hash:      *req,
+		BlockHash: loc.blockHash,
+		OpIndex:   loc.index,
+		OpType:    op.OpType,
+		Owner:     i.i.mu.shapeIndex[*req].owner,
+	}
+
+	_, _, head := i.i.headState()
+	switch _, onCanvas := head.shape(*req); {
+	case onCanvas:
+		resp.Status = ShapeOnCanvas
+	case i.i.onMainChainLocked(loc.blockHash):
+		resp.Status = ShapeDeleted
+	default:
+		resp.Status = ShapeOffChain
+	}
+	return nil
+}
+
+// GetOperationProof returns a proof that the operation with the hash is in a
+// block, preferring the main chain. Art nodes check it with
+// blockartlib.VerifyOperationProof.
+func (i *InkMinerRPC) GetOperationProof(req *string, resp *blockartlib.OperationProof) error {
+	i.i.mu.Lock()
+	defer i.i.mu.Unlock()
+
+	_, loc, ok := i.i.shapeOpLocked(*req)
+	if !ok {
+		return blockartlib.InvalidShapeHashError(*req)
+	}
+	proof, err := blockartlib.NewOperationProof(i.i.mu.blockchain[loc.blockHash], loc.index)
+	if err != nil {
+		return err
+	}
+	*resp = proof
+	return nil
+}
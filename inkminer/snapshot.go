@@ -0,0 +1,230 @@
+package inkminer
+
+import (
+	"fmt"
+	"math/rand"
+
+	"../blockartlib"
+)
+
+// A snapshot is the canvas state after a checkpoint block plus the headers of
+// the main chain from genesis up to it. A miner that's far behind can start
+// from it instead of replaying every block: the headers are checked for proof
+// of work and the state against the checkpoint's StateRoot, so it's as good as
+// replaying as long as the most work chain is honest. Blocks up to the
+// checkpoint are kept without their bodies, so their shapes can't be looked up
+// and forks from before the checkpoint can't be followed. The snapshot is kept
+// in the BlockStore with the bodies downloaded after the checkpoint, so a
+// miner that restarts picks up from it instead of fast syncing again.
+
+// SnapshotEntry is a key in one of the maps of the state and its value,
+// encoded with blockartlib.EncodeStateValue.
+type SnapshotEntry struct {
+	Key   string
+	Value []byte
+}
+
+type GetSnapshotRequest struct {
+	// MinBlockNum is the lowest checkpoint BlockNum the requester wants a
+	// snapshot for.
+	MinBlockNum int
+}
+
+type GetSnapshotResponse struct {
+	// Headers are the headers of the main chain from the block after genesis
+	// up to the checkpoint. It's empty if there's no checkpoint from
+	// MinBlockNum on.
+	Headers []blockartlib.BlockHeader
+	// Maps are the entries of each blockartlib.StateMap in the state after
+	// the checkpoint.
+	Maps [][]SnapshotEntry
+}
+
+// SetFastSync sets whether the miner bootstraps from a peer's snapshot when
+// it's more than SnapshotInterval blocks behind the peer's checkpoint.
+func (i *InkMiner) SetFastSync(enabled bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.mu.fastSync = enabled
+}
+
+func (i *InkMiner) fastSyncEnabled() bool {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.mu.fastSync
+}
+
+// bodyless returns whether we only have the header of a block from a
+// snapshot. Blocks without operations have no Merkle root so their headers
+// are the whole block.
+func bodyless(block blockartlib.Block) bool {
+	return block.MerkleRoot != "" && len(block.Records) == 0
+}
+
+// checkpointLocked returns the newest block on the main chain that snapshots
+// are served at. It's a multiple of SnapshotInterval so its state is never
+// evicted, and it's buried deep enough that a reorg won't reach it. It must be
+// locked before calling!
+func (i *InkMiner) checkpointLocked() (string, bool) {
+	depth := len(i.mu.mainChain) - MaxReorgDepth
+	depth -= depth % SnapshotInterval
+	if depth <= 0 {
+		return "", false
+	}
+	return i.mu.mainChain[depth-1], true
+}
+
+// snapshotMaps returns the entries of every map of the state.
+func (s State) snapshotMaps() [][]SnapshotEntry {
+	maps := make([][]SnapshotEntry, blockartlib.NumStateMaps)
+	for m := range maps {
+		s.stateMap(blockartlib.StateMap(m)).each(func(key string, value interface{}) bool {
+			maps[m] = append(maps[m], SnapshotEntry{Key: key, Value: blockartlib.EncodeStateValue(value)})
+			return true
+		})
+	}
+	return maps
+}
+
+// GetSnapshot returns the snapshot at our latest checkpoint if it's at least
+// req.MinBlockNum.
+func (i *InkMinerRPC) GetSnapshot(req GetSnapshotRequest, resp *GetSnapshotResponse) error {
+	i.i.mu.Lock()
+	hash, ok := i.i.checkpointLocked()
+	if !ok || i.i.mu.meta[hash].depth < req.MinBlockNum {
+		i.i.mu.Unlock()
+		return nil
+	}
+	checkpoint := i.i.mu.blockchain[hash]
+	headers := make([]blockartlib.BlockHeader, 0, checkpoint.BlockNum)
+	for _, h := range i.i.mu.mainChain[:i.i.mu.meta[hash].depth] {
+		headers = append(headers, i.i.mu.blockchain[h].BlockHeader)
+	}
+	i.i.mu.Unlock()
+
+	state, err := i.i.CalculateState(checkpoint)
+	if err != nil {
+		return err
+	}
+	resp.Headers = headers
+	resp.Maps = state.snapshotMaps()
+	return nil
+}
+
+// verifySnapshot checks that the headers of a snapshot chain back to genesis
+// with valid nonces and rebuilds the state, checking it against the
+// checkpoint's state root. It returns the hashes of the headers and the state.
+func (i *InkMiner) verifySnapshot(resp GetSnapshotResponse) ([]string, State, error) {
+	if len(resp.Headers) == 0 {
+		return nil, State{}, fmt.Errorf("snapshot has no headers")
+	}
+
+	if prev := resp.Headers[0].PrevBlock; prev != i.settings.GenesisBlockHash {
+		return nil, State{}, fmt.Errorf("snapshot headers start after %s, not genesis", prev)
+	}
+	hashes, err := i.checkHeaders(resp.Headers)
+	if err != nil {
+		return nil, State{}, err
+	}
+
+	checkpoint := resp.Headers[len(resp.Headers)-1]
+	if checkpoint.BlockNum%SnapshotInterval != 0 {
+		return nil, State{}, fmt.Errorf("snapshot checkpoint %d isn't a multiple of %d", checkpoint.BlockNum, SnapshotInterval)
+	}
+	if len(resp.Maps) != int(blockartlib.NumStateMaps) {
+		return nil, State{}, fmt.Errorf("snapshot has %d maps, wanted %d", len(resp.Maps), blockartlib.NumStateMaps)
+	}
+
+	state := NewState()
+	state.blockNum = checkpoint.BlockNum
+	for m, entries := range resp.Maps {
+		var p pmap
+		for _, e := range entries {
+			value, err := blockartlib.DecodeStateValue(blockartlib.StateMap(m), e.Value)
+			if err != nil {
+				return nil, State{}, fmt.Errorf("snapshot entry %q: %s", e.Key, err)
+			}
+			p = p.set(e.Key, value)
+		}
+		state.setStateMap(blockartlib.StateMap(m), p)
+	}
+	if root := state.StateRoot(); root != checkpoint.StateRoot {
+		return nil, State{}, fmt.Errorf("snapshot state root is %q, the checkpoint has %q", root, checkpoint.StateRoot)
+	}
+	return hashes, state, nil
+}
+
+// installSnapshot adds the headers of a verified snapshot as blocks without
+// bodies, caches the state after the checkpoint and moves the head to it if
+// it's better than ours. Blocks we already have are kept as they are.
+func (i *InkMiner) installSnapshot(headers []blockartlib.BlockHeader, hashes []string, state State) {
+	i.mu.Lock()
+	var m blockMeta
+	for j, header := range headers {
+		if meta, ok := i.mu.meta[hashes[j]]; ok {
+			m = meta
+			continue
+		}
+		i.mu.blockchain[hashes[j]] = blockartlib.Block{BlockHeader: header}
+		m = i.recordBlockMetaLocked(hashes[j], header)
+	}
+	hash := hashes[len(hashes)-1]
+	checkpoint := i.mu.blockchain[hash]
+	i.states.put(hash, state)
+	headChanged := i.moveHeadLocked(hash, checkpoint, state, m)
+	i.mu.Unlock()
+
+	if headChanged {
+		select {
+		case i.newBlockChan <- checkpoint:
+		default:
+		}
+		i.updateConfirmations(hash, state)
+	}
+	i.connectOrphans(hash)
+}
+
+// fastSync bootstraps from the snapshot of the first peer whose checkpoint
+// is more than SnapshotInterval blocks past our main chain, so the blocks up
+// to it don't have to be downloaded and replayed. Peers that send snapshots
+// that don't verify are penalized and the next one is tried. It returns
+// whether a snapshot was installed.
+func (i *InkMiner) fastSync() bool {
+	peers := i.peerList("snapshot")
+	rand.Shuffle(len(peers), func(a, b int) {
+		peers[a], peers[b] = peers[b], peers[a]
+	})
+
+	i.mu.Lock()
+	req := GetSnapshotRequest{MinBlockNum: len(i.mu.mainChain) + SnapshotInterval}
+	i.mu.Unlock()
+
+	for _, p := range peers {
+		var resp GetSnapshotResponse
+		if err := p.rpc.Call("InkMinerRPC.GetSnapshot", req, &resp); err != nil {
+			i.log.Printf("GetSnapshot error (from %s): %s", p, err)
+			i.misbehaving(p.address, PenaltyTimeout, err.Error())
+			continue
+		}
+		if len(resp.Headers) == 0 {
+			continue
+		}
+		hashes, state, err := i.verifySnapshot(resp)
+		if err != nil {
+			i.log.Printf("invalid snapshot (from %s): %s", p, err)
+			i.misbehaving(p.address, PenaltyInvalid, err.Error())
+			continue
+		}
+		// It's stored first so the blocks stored after it are never left
+		// without it.
+		if err := i.store.SetSnapshot(resp); err != nil {
+			i.log.Printf("failed to store snapshot: %s", err)
+		}
+		i.installSnapshot(resp.Headers, hashes, state)
+		i.log.Printf("fast synced to block %d from %s", len(resp.Headers), p)
+		return true
+	}
+	return false
+}
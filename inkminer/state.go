@@ -2,48 +2,138 @@ package inkminer
 
 import "../blockartlib"
 
-// State represents the state of a block at a certain point.
+// State represents the state of a block at a certain point. The maps are
+// persistent so a child state shares everything it didn't change with its
+// parent. States must only be changed through the methods below.
 type State struct {
 	blockNum    int
-	shapes      map[string]blockartlib.Shape // Map of shape hashes to their SVG string representation
-	shapeOwners map[string]string            // Map of shape hashes to their owner (InkMiner PubKey)
-	inkLevels   map[string]uint32            // Current ink levels of every InkMiner
-	// commitedOperations is a set of currently committed operations and how long
-	// they've been committed for. Used for ValidateNum.
-	commitedOperations map[string]int
+	shapes      pmap // Map of shape hashes to their blockartlib.Shape
+	shapeOwners pmap // Map of shape hashes to their owner (InkMiner PubKey)
+	inkLevels   pmap // Current ink levels (uint32) of every InkMiner
+	// commitedOperations is a set of currently committed operations and the
+	// BlockNum they were committed in. Used for ValidateNum.
+	commitedOperations pmap
+	// changes is the number of entries changed since the state was copied.
+	changes int
 }
 
 // NewState creates a new state.
 func NewState() State {
-	return State{
-		shapes:             make(map[string]blockartlib.Shape),
-		shapeOwners:        make(map[string]string),
-		inkLevels:          make(map[string]uint32),
-		commitedOperations: make(map[string]int),
-	}
+	return State{}
 }
 
-// Copy returns a copy of the given state.
+// Copy returns a copy of the given state. It's cheap since the maps are
+// shared until they're changed.
 func (s State) Copy() State {
-	s2 := NewState()
+	s.changes = 0
+	return s
+}
+
+func (s State) shape(hash string) (blockartlib.Shape, bool) {
+	v, ok := s.shapes.get(hash)
+	if !ok {
+		return blockartlib.Shape{}, false
+	}
+	return v.(blockartlib.Shape), true
+}
+
+func (s *State) setShape(hash string, shape blockartlib.Shape) {
+	s.shapes = s.shapes.set(hash, shape)
+	s.changes++
+}
+
+func (s State) shapeOwner(hash string) (string, bool) {
+	v, ok := s.shapeOwners.get(hash)
+	if !ok {
+		return "", false
+	}
+	return v.(string), true
+}
+
+func (s *State) setShapeOwner(hash, owner string) {
+	s.shapeOwners = s.shapeOwners.set(hash, owner)
+	s.changes++
+}
 
-	s2.blockNum = s.blockNum
+// removeShape removes the shape and its owner.
+func (s *State) removeShape(hash string) {
+	s.shapes = s.shapes.delete(hash)
+	s.shapeOwners = s.shapeOwners.delete(hash)
+	s.changes += 2
+}
+
+// eachShapeOwner calls fn with every owned shape until it returns false.
+func (s State) eachShapeOwner(fn func(hash, owner string) bool) {
+	s.shapeOwners.each(func(key string, value interface{}) bool {
+		return fn(key, value.(string))
+	})
+}
 
-	for key, value := range s.shapes {
-		s2.shapes[key] = value
+func (s State) inkLevel(pubKey string) uint32 {
+	v, ok := s.inkLevels.get(pubKey)
+	if !ok {
+		return 0
 	}
+	return v.(uint32)
+}
+
+func (s *State) setInkLevel(pubKey string, ink uint32) {
+	s.inkLevels = s.inkLevels.set(pubKey, ink)
+	s.changes++
+}
 
-	for key, value := range s.shapeOwners {
-		s2.shapeOwners[key] = value
+// commitOperation records that the operation was committed in this state's
+// block.
+func (s *State) commitOperation(opHash string) {
+	s.commitedOperations = s.commitedOperations.set(opHash, s.blockNum)
+	s.changes++
+}
+
+// committedFor returns the number of blocks that have followed the block the
+// operation was committed in and whether it's committed at all.
+func (s State) committedFor(opHash string) (int, bool) {
+	v, ok := s.commitedOperations.get(opHash)
+	if !ok {
+		return 0, false
 	}
+	return s.blockNum - v.(int), true
+}
 
-	for key, value := range s.inkLevels {
-		s2.inkLevels[key] = value
+// StateRoot returns the root of the state that block headers commit to, see
+// blockartlib.StateRoot. The hashes of the maps are kept so it only costs
+// O(changes) more than the parent's root.
+func (s State) StateRoot() string {
+	roots := make([][]byte, blockartlib.NumStateMaps)
+	for m := range roots {
+		roots[m] = s.stateMap(blockartlib.StateMap(m)).rootHash()
 	}
+	return blockartlib.StateRoot(roots)
+}
 
-	for key, value := range s.commitedOperations {
-		s2.commitedOperations[key] = value
+// stateMap returns the map of the state for m.
+func (s State) stateMap(m blockartlib.StateMap) pmap {
+	switch m {
+	case blockartlib.StateShapes:
+		return s.shapes
+	case blockartlib.StateOwners:
+		return s.shapeOwners
+	case blockartlib.StateInk:
+		return s.inkLevels
+	default:
+		return s.commitedOperations
 	}
+}
 
-	return s2
+// setStateMap replaces the map of the state for m.
+func (s *State) setStateMap(m blockartlib.StateMap, p pmap) {
+	switch m {
+	case blockartlib.StateShapes:
+		s.shapes = p
+	case blockartlib.StateOwners:
+		s.shapeOwners = p
+	case blockartlib.StateInk:
+		s.inkLevels = p
+	default:
+		s.commitedOperations = p
+	}
 }
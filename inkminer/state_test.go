@@ -0,0 +1,289 @@
+package inkminer
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"../blockartlib"
+	"../crypto"
+)
+
+func TestPmap(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	var m pmap
+	want := make(map[string]int)
+	var versions []pmap
+	var wants []map[string]int
+	for j := 0; j < 20000; j++ {
+		key := fmt.Sprint(rng.Intn(5000))
+		if rng.Intn(3) == 0 {
+			m = m.delete(key)
+			delete(want, key)
+		} else {
+			m = m.set(key, j)
+			want[key] = j
+		}
+
+		if j%1000 == 0 {
+			copied := make(map[string]int)
+			for k, v := range want {
+				copied[k] = v
+			}
+			versions = append(versions, m)
+			wants = append(wants, copied)
+		}
+	}
+
+	// Old versions aren't changed by later updates.
+	versions = append(versions, m)
+	wants = append(wants, want)
+	for v, m := range versions {
+		want := wants[v]
+		if m.len() != len(want) {
+			t.Fatalf("version %d: len() = %d; wanted %d", v, m.len(), len(want))
+		}
+		for k, wantValue := range want {
+			if got, ok := m.get(k); !ok || got.(int) != wantValue {
+				t.Fatalf("version %d: get(%q) = %v, %t; wanted %d", v, k, got, ok, wantValue)
+			}
+		}
+		seen := 0
+		m.each(func(key string, value interface{}) bool {
+			seen++
+			if want[key] != value.(int) {
+				t.Fatalf("version %d: each gave %q = %v; wanted %d", v, key, value, want[key])
+			}
+			return true
+		})
+		if seen != len(want) {
+			t.Fatalf("version %d: each gave %d keys; wanted %d", v, seen, len(want))
+		}
+	}
+
+	// Deleting everything leaves an empty map.
+	for k := range want {
+		m = m.delete(k)
+	}
+	if m.len() != 0 || m.root != nil {
+		t.Fatalf("expected an empty map; got %d keys", m.len())
+	}
+}
+
+func TestPmapCollisions(t *testing.T) {
+	// Entries whose hashes are equal end up in a collision node past the
+	// last level. Build one by hand to check it's searched.
+	var root *pmapNode
+	for j := 0; j < 3; j++ {
+		root, _ = root.set(0, pmapEntry{hash: 42, key: fmt.Sprint(j), value: j})
+	}
+	root, _ = root.set(0, pmapEntry{hash: 42, key: "1", value: 10})
+	root, removed := root.delete(0, 42, "0")
+	if !removed {
+		t.Fatal("expected key to be removed")
+	}
+
+	got := make(map[string]interface{})
+	root.each(func(key string, value interface{}) bool {
+		got[key] = value
+		return true
+	})
+	if len(got) != 2 || got["1"] != 10 || got["2"] != 2 {
+		t.Fatalf("got %v; wanted map[1:10 2:2]", got)
+	}
+}
+
+func TestStateRoot(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	// The same entries give the same root however they got there.
+	var keys []string
+	for j := 0; j < 2000; j++ {
+		keys = append(keys, fmt.Sprint(j))
+	}
+	var a, b pmap
+	for _, k := range keys {
+		a = a.set(k, uint32(len(k)))
+	}
+	for _, j := range rng.Perm(len(keys)) {
+		b = b.set(keys[j], uint32(0))
+		b = b.set(fmt.Sprint("extra ", j), uint32(j))
+	}
+	for _, j := range rng.Perm(len(keys)) {
+		b = b.delete(fmt.Sprint("extra ", j))
+		b = b.set(keys[j], uint32(len(keys[j])))
+	}
+	if !bytes.Equal(a.rootHash(), b.rootHash()) {
+		t.Fatal("maps with the same entries have different roots")
+	}
+	if c := a.set(keys[0], uint32(42)); bytes.Equal(a.rootHash(), c.rootHash()) {
+		t.Fatal("changing a value didn't change the root")
+	}
+	empty := a
+	for _, k := range keys {
+		empty = empty.delete(k)
+	}
+	if !bytes.Equal(empty.rootHash(), (pmap{}).rootHash()) {
+		t.Fatal("a map with everything deleted has a different root than an empty one")
+	}
+
+	// So do keys whose hashes collide.
+	var x, y *pmapNode
+	for j := 0; j < 3; j++ {
+		x, _ = x.set(0, pmapEntry{hash: 42, key: fmt.Sprint(j), value: j})
+		y, _ = y.set(0, pmapEntry{hash: 42, key: fmt.Sprint(2 - j), value: 2 - j})
+	}
+	if !bytes.Equal(x.nodeDigest(), y.nodeDigest()) {
+		t.Fatal("collision nodes with the same entries have different roots")
+	}
+}
+
+func TestStateProof(t *testing.T) {
+	key, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pubKey, err := crypto.MarshalPublic(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := largeState(500)
+	s.setInkLevel(pubKey, 1234)
+	header := blockartlib.BlockHeader{BlockNum: 1, StateRoot: s.StateRoot()}
+	blockHash, err := header.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proof, ok := s.proof(blockartlib.StateInk, pubKey)
+	if !ok {
+		t.Fatal("expected a proof of the key's ink")
+	}
+	proof.Header = header
+	if ink, hash, err := blockartlib.VerifyInkProof(key.PublicKey, proof); err != nil || ink != 1234 || hash != blockHash {
+		t.Fatalf("VerifyInkProof(...) = %d, %q, %v; wanted 1234, %q", ink, hash, err, blockHash)
+	}
+	forged := proof
+	forged.Value = blockartlib.EncodeStateValue(uint32(999999))
+	if _, _, err := blockartlib.VerifyInkProof(key.PublicKey, forged); err == nil {
+		t.Fatal("expected a forged ink level not to verify")
+	}
+
+	for j := 0; j < 500; j += 37 {
+		hash := fmt.Sprintf("shape %d", j)
+		proof, ok := s.proof(blockartlib.StateShapes, hash)
+		if !ok {
+			t.Fatalf("expected a proof of %s", hash)
+		}
+		proof.Header = header
+		shape, got, err := blockartlib.VerifyShapeProof(hash, proof)
+		if err != nil || got != blockHash || shape != blockartlib.TestShape(5, j) {
+			t.Fatalf("VerifyShapeProof(%s, ...) = %+v, %q, %v", hash, shape, got, err)
+		}
+		if _, _, err := blockartlib.VerifyShapeProof("shape 1", proof); err == nil && j != 1 {
+			t.Fatalf("proof of %s verified for another shape", hash)
+		}
+	}
+
+	if _, ok := s.proof(blockartlib.StateShapes, "missing"); ok {
+		t.Fatal("expected no proof for a missing shape")
+	}
+}
+
+// largeState returns a state with n shapes.
+func largeState(n int) State {
+	s := NewState()
+	for j := 0; j < n; j++ {
+		hash := fmt.Sprintf("shape %d", j)
+		s.setShape(hash, blockartlib.TestShape(5, j))
+		s.setShapeOwner(hash, "owner")
+		s.commitedOperations = s.commitedOperations.set(hash, 0)
+	}
+	s.setInkLevel("owner", 1000000)
+	return s.Copy()
+}
+
+// BenchmarkTransformState measures deriving the state of a block with a single
+// operation from a large canvas.
+func BenchmarkTransformState(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			key, err := crypto.GenerateKey()
+			if err != nil {
+				b.Fatal(err)
+			}
+			im := &InkMiner{}
+			block := blockartlib.Block{
+				BlockHeader: blockartlib.BlockHeader{
+					PubKey: key.PublicKey,
+				},
+			}
+			prev := largeState(n)
+			prev.blockNum = 1
+			b.ResetTimer()
+
+			for j := 0; j < b.N; j++ {
+				s := prev.Copy()
+				s.blockNum++
+				// Recolour an existing shape, as a delete does.
+				shape, _ := s.shape("shape 0")
+				shape.Fill = "white"
+				s.setShape("shape 0", shape)
+				s.commitOperation(fmt.Sprint(j))
+				if err := im.applyReward(&s, block); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkCopyMaps measures cloning plain maps the size of a large canvas,
+// which is what deriving a state used to cost.
+func BenchmarkCopyMaps(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			shapes := make(map[string]blockartlib.Shape)
+			owners := make(map[string]string)
+			for j := 0; j < n; j++ {
+				hash := fmt.Sprintf("shape %d", j)
+				shapes[hash] = blockartlib.TestShape(5, j)
+				owners[hash] = "owner"
+			}
+			b.ResetTimer()
+
+			for j := 0; j < b.N; j++ {
+				shapes2 := make(map[string]blockartlib.Shape, len(shapes))
+				for k, v := range shapes {
+					shapes2[k] = v
+				}
+				owners2 := make(map[string]string, len(owners))
+				for k, v := range owners {
+					owners2[k] = v
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkStateRoot measures the state root of a block with a single
+// operation on a large canvas whose parent's root is known.
+func BenchmarkStateRoot(b *testing.B) {
+	for _, n := range []int{1000, 10000, 100000} {
+		b.Run(fmt.Sprint(n), func(b *testing.B) {
+			prev := largeState(n)
+			prev.StateRoot()
+			b.ResetTimer()
+
+			for j := 0; j < b.N; j++ {
+				s := prev.Copy()
+				s.commitOperation(fmt.Sprint(j))
+				s.setInkLevel("owner", uint32(j))
+				s.StateRoot()
+			}
+		})
+	}
+}
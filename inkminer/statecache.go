@@ -0,0 +1,165 @@
+package inkminer
+
+import (
+	"container/list"
+	"sync"
+)
+
+// SnapshotInterval is how often the state is kept for good. The state at every
+// block on the main chain whose BlockNum is a multiple of it is never evicted
+// so any state on it can be rebuilt by replaying at most SnapshotInterval
+// blocks. States on forks are replayed from where they branched off.
+const SnapshotInterval = 100
+
+// DefaultStateCacheSize is the default memory budget in bytes for states that
+// aren't snapshots.
+const DefaultStateCacheSize = 64 << 20
+
+// stateBaseSize and stateChangeSize estimate the memory used by a state that
+// isn't shared with its parent: the struct itself, plus the trie nodes on the
+// path to each changed entry which are copied.
+const (
+	stateBaseSize   = 256
+	stateChangeSize = 1024
+)
+
+// SetStateCacheSize sets the memory budget in bytes for recently used states.
+// The least recently used states are evicted once it's exceeded and
+// recalculated from the nearest snapshot when they're needed again.
+func (i *InkMiner) SetStateCacheSize(size int64) {
+	i.states.setMaxSize(size)
+}
+
+// size estimates the memory used by the state that isn't shared with the
+// state it was derived from.
+func (s State) size() int64 {
+	return stateBaseSize + int64(s.changes)*stateChangeSize
+}
+
+type cachedState struct {
+	hash  string
+	state State
+	size  int64
+}
+
+// stateCache holds the states of blocks. Snapshots are kept for good and other
+// states are kept in a least recently used cache bounded by maxSize. It has its
+// own lock so states can be looked up without locking InkMiner.mu.
+type stateCache struct {
+	mu sync.Mutex
+
+	snapshots map[string]State
+	// mainChain are the blocks on the main chain whose BlockNum is a multiple
+	// of SnapshotInterval, see setMainChain.
+	mainChain map[string]bool
+
+	maxSize int64
+	size    int64
+	// recent is ordered from most to least recently used.
+	recent  *list.List
+	entries map[string]*list.Element
+}
+
+func newStateCache(maxSize int64) *stateCache {
+	return &stateCache{
+		snapshots: make(map[string]State),
+		mainChain: make(map[string]bool),
+		maxSize:   maxSize,
+		recent:    list.New(),
+		entries:   make(map[string]*list.Element),
+	}
+}
+
+// get returns the state for the block hash if it's cached.
+func (c *stateCache) get(hash string) (State, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if state, ok := c.snapshots[hash]; ok {
+		return state, true
+	}
+	e, ok := c.entries[hash]
+	if !ok {
+		return State{}, false
+	}
+	c.recent.MoveToFront(e)
+	return e.Value.(*cachedState).state, true
+}
+
+// put caches the state for the block hash.
+func (c *stateCache) put(hash string, state State) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.mainChain[hash] {
+		c.snapshots[hash] = state
+		return
+	}
+	if e, ok := c.entries[hash]; ok {
+		c.recent.MoveToFront(e)
+		return
+	}
+	c.putRecentLocked(hash, state)
+}
+
+// putRecentLocked adds a state to the front of the recent states. It must be
+// locked before calling!
+func (c *stateCache) putRecentLocked(hash string, state State) {
+	entry := &cachedState{hash: hash, state: state, size: state.size()}
+	c.entries[hash] = c.recent.PushFront(entry)
+	c.size += entry.size
+	c.evictLocked()
+}
+
+// setMainChain sets whether a block whose BlockNum is a multiple of
+// SnapshotInterval is on the main chain. Its state becomes a snapshot when it
+// joins the main chain, and goes back to the recent states when a reorg moves
+// it onto a fork so it can be evicted.
+func (c *stateCache) setMainChain(hash string, onMainChain bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !onMainChain {
+		delete(c.mainChain, hash)
+		if state, ok := c.snapshots[hash]; ok {
+			delete(c.snapshots, hash)
+			c.putRecentLocked(hash, state)
+		}
+		return
+	}
+
+	c.mainChain[hash] = true
+	if e, ok := c.entries[hash]; ok {
+		entry := c.recent.Remove(e).(*cachedState)
+		delete(c.entries, hash)
+		c.size -= entry.size
+		c.snapshots[hash] = entry.state
+	}
+}
+
+// evictLocked removes the least recently used states until the cache fits in
+// maxSize. The most recently used state is always kept. It must be locked
+// before calling!
+func (c *stateCache) evictLocked() {
+	for c.size > c.maxSize && c.recent.Len() > 1 {
+		entry := c.recent.Remove(c.recent.Back()).(*cachedState)
+		delete(c.entries, entry.hash)
+		c.size -= entry.size
+	}
+}
+
+func (c *stateCache) setMaxSize(maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxSize = maxSize
+	c.evictLocked()
+}
+
+// len returns the number of snapshots and recent states.
+func (c *stateCache) len() (snapshots, recent int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.snapshots), c.recent.Len()
+}
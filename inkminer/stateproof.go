@@ -0,0 +1,55 @@
+package inkminer
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"../blockartlib"
+)
+
+// proof returns the proof of the key in the map of the state, see
+// blockartlib.StateProof. The header is left for the caller.
+func (s State) proof(m blockartlib.StateMap, key string) (blockartlib.StateProof, bool) {
+	value, path, ok := s.stateMap(m).proof(key)
+	if !ok {
+		return blockartlib.StateProof{}, false
+	}
+	proof := blockartlib.StateProof{
+		Map:   m,
+		Key:   key,
+		Value: blockartlib.EncodeStateValue(value),
+		Path:  path,
+	}
+	for j := blockartlib.StateMap(0); j < blockartlib.NumStateMaps; j++ {
+		proof.MapRoots = append(proof.MapRoots, hex.EncodeToString(s.stateMap(j).rootHash()))
+	}
+	return proof, true
+}
+
+// GetStateProof returns a proof of the value of a key in the canvas state
+// after a block. Art nodes check it with blockartlib.VerifyInkProof or
+// blockartlib.VerifyShapeProof.
+func (i *InkMinerRPC) GetStateProof(req blockartlib.GetStateProofRequest, resp *blockartlib.StateProof) error {
+	if req.Map < 0 || req.Map >= blockartlib.NumStateMaps {
+		return fmt.Errorf("invalid state map: %d", req.Map)
+	}
+	block, ok := i.i.GetBlock(req.BlockHash)
+	if !ok {
+		return blockartlib.InvalidBlockHashError(req.BlockHash)
+	}
+	state, err := i.i.CalculateState(block)
+	if err != nil {
+		return err
+	}
+
+	proof, ok := state.proof(req.Map, req.Key)
+	if !ok {
+		if req.Map == blockartlib.StateShapes {
+			return blockartlib.InvalidShapeHashError(req.Key)
+		}
+		return fmt.Errorf("%q isn't in the state after block %s", req.Key, req.BlockHash)
+	}
+	proof.Header = block.BlockHeader
+	*resp = proof
+	return nil
+}
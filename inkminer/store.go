@@ -0,0 +1,468 @@
+package inkminer
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"../blockartlib"
+)
+
+// BlockStore keeps validated blocks across restarts. Blocks are appended after
+// their parent so replaying them in order rebuilds the blockchain. A miner
+// that fast synced stores the snapshot it started from too, and its blocks
+// are replayed on top of it.
+type BlockStore interface {
+	// Append stores a block.
+	Append(block blockartlib.Block) error
+	// Blocks returns every stored block in the order they were appended.
+	Blocks() ([]blockartlib.Block, error)
+	// SetSnapshot stores the snapshot, replacing any stored before.
+	SetSnapshot(snapshot GetSnapshotResponse) error
+	// Snapshot returns the stored snapshot. It has no headers if there isn't
+	// one.
+	Snapshot() (GetSnapshotResponse, error)
+	Close() error
+}
+
+// SetBlockStore sets where blocks are stored. Stored blocks are loaded by
+// Listen. It must be called before Listen.
+func (i *InkMiner) SetBlockStore(store BlockStore) {
+	i.store = store
+}
+
+// restoreBlocks adds the blocks in the store to the blockchain and installs
+// the snapshot in it. They're validated again since the settings could have
+// changed. Blocks that aren't valid any more are skipped and logged.
+func (i *InkMiner) restoreBlocks() error {
+	blocks, err := i.store.Blocks()
+	if err != nil {
+		return err
+	}
+	snapshot, err := i.store.Snapshot()
+	if err != nil {
+		return err
+	}
+
+	restored := 0
+	if len(snapshot.Headers) > 0 {
+		// Blocks from before a fast sync are restored first so the snapshot
+		// doesn't replace them with their headers. The ones on top of the
+		// snapshot are restored after it.
+		var after []blockartlib.Block
+		for _, block := range blocks {
+			if err := i.restoreBlock(block); err != nil {
+				after = append(after, block)
+				continue
+			}
+			restored++
+		}
+		blocks = after
+
+		hashes, state, err := i.verifySnapshot(snapshot)
+		if err != nil {
+			i.log.Printf("skipping stored snapshot: %s", err)
+		} else {
+			i.installSnapshot(snapshot.Headers, hashes, state)
+			i.log.Printf("restored snapshot at block %d", len(snapshot.Headers))
+		}
+	}
+
+	skipped := 0
+	for _, block := range blocks {
+		if err := i.restoreBlock(block); err != nil {
+			i.log.Printf("skipping stored block: %s", err)
+			skipped++
+			continue
+		}
+		restored++
+	}
+
+	i.log.Printf("restored %d stored blocks, skipped %d invalid blocks", restored, skipped)
+	return nil
+}
+
+// restoreBlock validates a stored block and adds it to the blockchain.
+func (i *InkMiner) restoreBlock(block blockartlib.Block) error {
+	hash, err := block.Hash()
+	if err != nil {
+		return err
+	}
+	state, err := i.validateBlock(block)
+	if err != nil {
+		return fmt.Errorf("block %s: %s", hash, err)
+	}
+	ops, err := indexOps(block)
+	if err != nil {
+		return fmt.Errorf("block %s: %s", hash, err)
+	}
+
+	i.mu.Lock()
+	i.addBlockLocked(hash, block, state, ops)
+	i.mu.Unlock()
+	return nil
+}
+
+type memoryBlockStore struct {
+	mu       sync.Mutex
+	blocks   []blockartlib.Block
+	snapshot GetSnapshotResponse
+}
+
+// NewMemoryBlockStore returns a BlockStore that keeps blocks in memory.
+func NewMemoryBlockStore() BlockStore {
+	return &memoryBlockStore{}
+}
+
+func (s *memoryBlockStore) Append(block blockartlib.Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.blocks = append(s.blocks, block)
+	return nil
+}
+
+func (s *memoryBlockStore) Blocks() ([]blockartlib.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]blockartlib.Block(nil), s.blocks...), nil
+}
+
+func (s *memoryBlockStore) SetSnapshot(snapshot GetSnapshotResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.snapshot = snapshot
+	return nil
+}
+
+func (s *memoryBlockStore) Snapshot() (GetSnapshotResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.snapshot, nil
+}
+
+func (s *memoryBlockStore) Close() error {
+	return nil
+}
+
+// MaxStoredBlockSize is the largest block record in a block log. Anything
+// larger is treated as corruption.
+const MaxStoredBlockSize = 64 << 20
+
+// recordHeaderSize is the size of the length and checksum before each record.
+const recordHeaderSize = 8
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// fileBlockStore is an append only log of blocks. Each record is the length
+// and CRC-32C checksum of the block, followed by the block encoded as JSON.
+// The snapshot is kept next to it in its own file, which is replaced whole.
+type fileBlockStore struct {
+	mu   sync.Mutex
+	f    *os.File
+	size int64
+	// snapshotPath is where the snapshot is stored.
+	snapshotPath string
+}
+
+// OpenFileBlockStore opens the block log at path, creating it if it doesn't
+// exist. If the miner crashed while appending, the log ends with a partial or
+// corrupt record. The log is truncated to the last good record so appends
+// continue after it. Corrupt records anywhere else are an error. The snapshot
+// is stored at path with ".snapshot" appended.
+func OpenFileBlockStore(path string) (BlockStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	_, size, err := readBlockLog(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(size); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &fileBlockStore{f: f, size: size, snapshotPath: path + ".snapshot"}, nil
+}
+
+func (s *fileBlockStore) Append(block blockartlib.Block) error {
+	payload, err := encodeStoredBlock(block)
+	if err != nil {
+		return err
+	}
+	if len(payload) > MaxStoredBlockSize {
+		return fmt.Errorf("block is too large to store: %d bytes", len(payload))
+	}
+
+	record := make([]byte, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, crcTable))
+	copy(record[recordHeaderSize:], payload)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return errors.New("block store is closed")
+	}
+	if _, err := s.f.Write(record); err != nil {
+		// Drop the partial record so the next append isn't lost behind it.
+		s.f.Truncate(s.size)
+		s.f.Seek(s.size, io.SeekStart)
+		return err
+	}
+	if err := s.f.Sync(); err != nil {
+		return err
+	}
+	s.size += int64(len(record))
+	return nil
+}
+
+func (s *fileBlockStore) Blocks() ([]blockartlib.Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil, errors.New("block store is closed")
+	}
+	blocks, _, err := readBlockLog(io.NewSectionReader(s.f, 0, s.size))
+	return blocks, err
+}
+
+// SetSnapshot writes the snapshot to a temporary file and renames it over the
+// old one, so a crash leaves either the old or the new snapshot.
+func (s *fileBlockStore) SetSnapshot(snapshot GetSnapshotResponse) error {
+	stored := storedSnapshot{Maps: snapshot.Maps}
+	for _, header := range snapshot.Headers {
+		stored.Headers = append(stored.Headers, newStoredBlock(blockartlib.Block{BlockHeader: header}))
+	}
+	data, err := json.Marshal(stored)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tmp := s.snapshotPath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.snapshotPath)
+}
+
+func (s *fileBlockStore) Snapshot() (GetSnapshotResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := ioutil.ReadFile(s.snapshotPath)
+	if os.IsNotExist(err) {
+		return GetSnapshotResponse{}, nil
+	} else if err != nil {
+		return GetSnapshotResponse{}, err
+	}
+	var stored storedSnapshot
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return GetSnapshotResponse{}, fmt.Errorf("stored snapshot: %s", err)
+	}
+
+	snapshot := GetSnapshotResponse{Maps: stored.Maps}
+	for _, h := range stored.Headers {
+		block, err := h.block()
+		if err != nil {
+			return GetSnapshotResponse{}, fmt.Errorf("stored snapshot: %s", err)
+		}
+		snapshot.Headers = append(snapshot.Headers, block.BlockHeader)
+	}
+	return snapshot, nil
+}
+
+func (s *fileBlockStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	err := s.f.Close()
+	s.f = nil
+	return err
+}
+
+// readBlockLog reads the blocks in a block log and returns the size of the log
+// up to the last good record. A partial or corrupt record at the end of the
+// log is left from a crash while appending and is ignored, but one with more
+// records after it means the log has been damaged so an error is returned
+// rather than dropping the blocks after it.
+func readBlockLog(r io.Reader) ([]blockartlib.Block, int64, error) {
+	var blocks []blockartlib.Block
+	var size int64
+	header := make([]byte, recordHeaderSize)
+	// corrupt returns an error unless the bad record at size is the last one,
+	// which it is if there are at most unread bytes of it left in the log.
+	corrupt := func(unread int64, reason string) error {
+		rest, err := io.Copy(ioutil.Discard, r)
+		if err != nil {
+			return err
+		}
+		if rest <= unread {
+			return nil
+		}
+		return fmt.Errorf("block log is corrupt at offset %d: %s", size, reason)
+	}
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return blocks, size, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if length > MaxStoredBlockSize {
+			if err := corrupt(int64(length), fmt.Sprintf("record is %d bytes", length)); err != nil {
+				return nil, 0, err
+			}
+			return blocks, size, nil
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(r, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return blocks, size, nil
+		} else if err != nil {
+			return nil, 0, err
+		}
+		if crc32.Checksum(payload, crcTable) != checksum {
+			if err := corrupt(0, "checksum mismatch"); err != nil {
+				return nil, 0, err
+			}
+			return blocks, size, nil
+		}
+		block, err := decodeStoredBlock(payload)
+		if err != nil {
+			if err := corrupt(0, err.Error()); err != nil {
+				return nil, 0, err
+			}
+			return blocks, size, nil
+		}
+
+		blocks = append(blocks, block)
+		size += int64(recordHeaderSize) + int64(length)
+	}
+}
+
+// storedBlock is how a block is encoded in the block log. JSON can't decode
+// the elliptic curves of the public keys so they're stored by name. Curves[0]
+// is the curve of the block's key and Curves[j+1] is the curve of Records[j].
+type storedBlock struct {
+	Block  blockartlib.Block
+	Curves []string
+}
+
+// storedSnapshot is how a snapshot is encoded. The headers are stored as
+// blocks without records.
+type storedSnapshot struct {
+	Headers []storedBlock
+	Maps    [][]SnapshotEntry
+}
+
+var storedCurves = []elliptic.Curve{elliptic.P224(), elliptic.P256(), elliptic.P384(), elliptic.P521()}
+
+func curveName(curve elliptic.Curve) string {
+	if curve == nil {
+		return ""
+	}
+	return curve.Params().Name
+}
+
+func curveByName(name string) (elliptic.Curve, error) {
+	if name == "" {
+		return nil, nil
+	}
+	for _, c := range storedCurves {
+		if c.Params().Name == name {
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown curve %q", name)
+}
+
+// newStoredBlock returns the block with the curves of its keys taken out.
+func newStoredBlock(block blockartlib.Block) storedBlock {
+	stored := storedBlock{Block: block}
+	stored.Block.Records = append([]blockartlib.Operation(nil), block.Records...)
+
+	stored.Curves = append(stored.Curves, curveName(block.PubKey.Curve))
+	stored.Block.PubKey.Curve = nil
+	for j := range stored.Block.Records {
+		op := &stored.Block.Records[j]
+		stored.Curves = append(stored.Curves, curveName(op.PubKey.Curve))
+		op.PubKey.Curve = nil
+	}
+	return stored
+}
+
+// block returns the stored block with the curves of its keys put back.
+func (stored storedBlock) block() (blockartlib.Block, error) {
+	block := stored.Block
+	if len(stored.Curves) != len(block.Records)+1 {
+		return blockartlib.Block{}, errors.New("stored block has the wrong number of curves")
+	}
+
+	var err error
+	if block.PubKey.Curve, err = curveByName(stored.Curves[0]); err != nil {
+		return blockartlib.Block{}, err
+	}
+	for j := range block.Records {
+		if block.Records[j].PubKey.Curve, err = curveByName(stored.Curves[j+1]); err != nil {
+			return blockartlib.Block{}, err
+		}
+	}
+	return block, nil
+}
+
+func encodeStoredBlock(block blockartlib.Block) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(newStoredBlock(block)); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeStoredBlock(payload []byte) (blockartlib.Block, error) {
+	var stored storedBlock
+	if err := json.Unmarshal(payload, &stored); err != nil {
+		return blockartlib.Block{}, err
+	}
+	return stored.block()
+}
@@ -0,0 +1,290 @@
+package inkminer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"../blockartlib"
+)
+
+// testChain mines a chain of blocks on the genesis block. The second block has
+// an operation so the keys of operations are stored too.
+func testChain(t *testing.T, im *InkMiner, n int) ([]blockartlib.Block, []string) {
+	var blocks []blockartlib.Block
+	var hashes []string
+	prev := im.settings.GenesisBlockHash
+	for j := 1; j <= n; j++ {
+		block := blockartlib.Block{
+			BlockHeader: blockartlib.BlockHeader{
+				PrevBlock: prev,
+				BlockNum:  j,
+				PubKey:    im.privKey.PublicKey,
+			},
+		}
+		if j == 2 {
+			op := blockartlib.Operation{
+				OpType: blockartlib.ADD,
+				Id:     1,
+				PubKey: im.privKey.PublicKey,
+			}
+			op.ADD.Shape = blockartlib.TestShape(5, 0)
+			op, err := op.Sign(*im.privKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block.Records = append(block.Records, op)
+		}
+		block = im.TestMine(t, block)
+		hash, err := block.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		blocks = append(blocks, block)
+		hashes = append(hashes, hash)
+		prev = hash
+	}
+	return blocks, hashes
+}
+
+func storedHashes(t *testing.T, store BlockStore) []string {
+	blocks, err := store.Blocks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for _, block := range blocks {
+		hash, err := block.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash)
+	}
+	return hashes
+}
+
+func expectHashes(t *testing.T, got, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %d blocks; wanted %d", len(got), len(want))
+	}
+	for j := range want {
+		if got[j] != want[j] {
+			t.Fatalf("block %d = %q; wanted %q", j, got[j], want[j])
+		}
+	}
+}
+
+func TestFileBlockStore(t *testing.T) {
+	im := generateTestInkMiner(t)
+	blocks, hashes := testChain(t, im, 3)
+
+	dir, err := ioutil.TempDir("", "inkminer-TestFileBlockStore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocks.log")
+
+	store, err := OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range blocks {
+		if err := store.Append(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The blocks are read back with the same hashes so their keys survived.
+	store, err = OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHashes(t, storedHashes(t, store), hashes)
+	store.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := info.Size()
+
+	// A crash halfway through an append leaves a partial record.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte{0, 0, 1, 0, 1, 2, 3, 4, '{', '"'}); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	store, err = OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHashes(t, storedHashes(t, store), hashes)
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != size {
+		t.Fatalf("log size = %d; expected the partial record to be truncated to %d", info.Size(), size)
+	}
+
+	// Appends continue after the last good record.
+	extra, extraHashes := testChain(t, im, 1)
+	if err := store.Append(extra[0]); err != nil {
+		t.Fatal(err)
+	}
+	expectHashes(t, storedHashes(t, store), append(hashes, extraHashes...))
+	store.Close()
+
+	// A corrupt last record is left from a crash too and is truncated.
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := append([]byte(nil), data...)
+	last[len(last)-2] ^= 0xff
+	if err := ioutil.WriteFile(path, last, 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, err = OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHashes(t, storedHashes(t, store), hashes)
+	store.Close()
+
+	// A corrupt record before the end isn't from a crash, so rather than
+	// dropping the blocks after it the log isn't opened.
+	data[size-2] ^= 0xff
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenFileBlockStore(path); err == nil {
+		t.Fatal("expected an error opening a log with a corrupt record in the middle")
+	}
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != int64(len(data)) {
+		t.Fatalf("log size = %d; expected it to be left at %d", info.Size(), len(data))
+	}
+}
+
+func TestRestoreBlocks(t *testing.T) {
+	im := generateTestInkMiner(t)
+	store := NewMemoryBlockStore()
+	im.SetBlockStore(store)
+
+	blocks, hashes := testChain(t, im, 3)
+	for _, block := range blocks {
+		if _, err := im.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectHashes(t, storedHashes(t, store), hashes)
+
+	// A restarted miner with the same store rebuilds the chain and head.
+	restarted := generateTestInkMiner(t)
+	restarted.SetBlockStore(store)
+	if err := restarted.restoreBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	if n := restarted.BlockPoolSize(); n != len(blocks) {
+		t.Fatalf("BlockPoolSize() = %d; wanted %d", n, len(blocks))
+	}
+	if head, _, _ := restarted.BlockWithLongestChain(); head != hashes[2] {
+		t.Fatalf("head = %q; wanted %q", head, hashes[2])
+	}
+	// Restoring doesn't store the blocks again.
+	expectHashes(t, storedHashes(t, store), hashes)
+
+	// Blocks from another network are skipped.
+	other := generateTestInkMiner(t)
+	other.settings.GenesisBlockHash = "other genesis"
+	other.SetBlockStore(store)
+	if err := other.restoreBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	if n := other.BlockPoolSize(); n != 0 {
+		t.Fatalf("BlockPoolSize() = %d; wanted 0", n)
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	a := generateTestInkMiner(t)
+	blocks, hashes := testChain(t, a, SnapshotInterval+MaxReorgDepth+10)
+	for _, block := range blocks {
+		if _, err := a.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var snapshot GetSnapshotResponse
+	if err := a.RPC().GetSnapshot(GetSnapshotRequest{MinBlockNum: SnapshotInterval}, &snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := ioutil.TempDir("", "inkminer-TestRestoreSnapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "blocks.log")
+
+	// b has the first blocks before it fast syncs like fastSync does.
+	b := generateTestInkMiner(t)
+	store, err := OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.SetBlockStore(store)
+	for _, block := range blocks[:2] {
+		if _, err := b.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	snapshotHashes, state, err := b.verifySnapshot(snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SetSnapshot(snapshot); err != nil {
+		t.Fatal(err)
+	}
+	b.installSnapshot(snapshot.Headers, snapshotHashes, state)
+	for _, block := range blocks[SnapshotInterval:] {
+		if _, err := b.AddBlock(block); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	// A restarted miner picks up from the snapshot and the blocks after it.
+	store, err = OpenFileBlockStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if stored, err := store.Snapshot(); err != nil {
+		t.Fatal(err)
+	} else if fmt.Sprint(stored) != fmt.Sprint(snapshot) {
+		t.Fatal("stored snapshot differs")
+	}
+	restarted := generateTestInkMiner(t)
+	restarted.SetBlockStore(store)
+	if err := restarted.restoreBlocks(); err != nil {
+		t.Fatal(err)
+	}
+	if head, _, _ := restarted.BlockWithLongestChain(); head != hashes[len(hashes)-1] {
+		t.Fatalf("head = %q; wanted %q", head, hashes[len(hashes)-1])
+	}
+	// The blocks it had before fast syncing keep their bodies.
+	if block, ok := restarted.GetBlock(hashes[1]); !ok || bodyless(block) {
+		t.Fatalf("block 2 = %+v; wanted its body", block)
+	}
+}
@@ -0,0 +1,311 @@
+package inkminer
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+
+	"../blockartlib"
+)
+
+// MaxHeaders is the maximum number of headers returned by a GetHeaders call.
+const MaxHeaders = 2000
+
+// MaxLocator is the maximum number of hashes accepted in a block locator.
+const MaxLocator = 100
+
+// SyncBatchSize is the number of block bodies requested from a peer at once.
+const SyncBatchSize = 50
+
+type GetHeadersRequest struct {
+	// Locator is a list of hashes on the requester's main chain from its head
+	// back to genesis. It's dense near the head and exponentially sparser
+	// further back.
+	Locator []string
+}
+
+type GetHeadersResponse struct {
+	// Headers are checked for proof of work before their bodies are
+	// requested, see checkHeaders.
+	Headers []blockartlib.BlockHeader
+}
+
+// setMainChainLocked updates mainChain to end at the new head. Only the blocks
+// after the fork point with the old main chain are rewritten, and the state
+// cache is told which snapshots moved on or off it. It must be locked before
+// calling!
+func (i *InkMiner) setMainChainLocked(head string, depth int) {
+	for d := depth + 1; d <= len(i.mu.mainChain); d++ {
+		if d%SnapshotInterval == 0 {
+			i.states.setMainChain(i.mu.mainChain[d-1], false)
+		}
+	}
+	if len(i.mu.mainChain) > depth {
+		i.mu.mainChain = i.mu.mainChain[:depth]
+	}
+	for len(i.mu.mainChain) < depth {
+		i.mu.mainChain = append(i.mu.mainChain, "")
+	}
+
+	for d := depth; d > 0 && i.mu.mainChain[d-1] != head; d-- {
+		if d%SnapshotInterval == 0 {
+			if old := i.mu.mainChain[d-1]; old != "" {
+				i.states.setMainChain(old, false)
+			}
+			i.states.setMainChain(head, true)
+		}
+		i.mu.mainChain[d-1] = head
+		head = i.mu.blockchain[head].PrevBlock
+	}
+}
+
+// onMainChainLocked returns whether the block is on the main chain. It must be
+// locked before calling!
+func (i *InkMiner) onMainChainLocked(hash string) bool {
+	m, ok := i.mu.meta[hash]
+	return ok && m.depth <= len(i.mu.mainChain) && i.mu.mainChain[m.depth-1] == hash
+}
+
+// blockLocatorLocked returns the block locator for our main chain. It must be
+// locked before calling!
+func (i *InkMiner) blockLocatorLocked() []string {
+	var locator []string
+	step := 1
+	for d := len(i.mu.mainChain); d > 0; d -= step {
+		locator = append(locator, i.mu.mainChain[d-1])
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+	return append(locator, i.settings.GenesisBlockHash)
+}
+
+// GetHeaders returns the headers of the blocks on this miner's main chain
+// after the most recent block in the locator that is on it. It stops at the
+// first block we only have the header of so we're never asked for a body we
+// can't send.
+func (i *InkMinerRPC) GetHeaders(req GetHeadersRequest, resp *GetHeadersResponse) error {
+	if len(req.Locator) > MaxLocator {
+		return fmt.Errorf("block locator too long: %d > %d", len(req.Locator), MaxLocator)
+	}
+
+	i.i.mu.Lock()
+	defer i.i.mu.Unlock()
+
+	start := 0
+	for _, hash := range req.Locator {
+		if i.i.onMainChainLocked(hash) {
+			start = i.i.mu.meta[hash].depth
+			break
+		}
+	}
+
+	for d := start; d < len(i.i.mu.mainChain) && len(resp.Headers) < MaxHeaders; d++ {
+		block := i.i.mu.blockchain[i.i.mu.mainChain[d]]
+		if bodyless(block) {
+			break
+		}
+		resp.Headers = append(resp.Headers, block.BlockHeader)
+	}
+	return nil
+}
+
+// checkHeaders checks that the headers have valid nonces and that each one
+// follows the one before it, starting from a block we have, so bodies are
+// only requested for blocks someone did the work for. It returns their
+// hashes.
+func (i *InkMiner) checkHeaders(headers []blockartlib.BlockHeader) ([]string, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+
+	prev, prevNum := headers[0].PrevBlock, 0
+	if prev != i.settings.GenesisBlockHash {
+		parent, ok := i.GetBlock(prev)
+		if !ok {
+			return nil, fmt.Errorf("headers start after unknown block %s", prev)
+		}
+		prevNum = parent.BlockNum
+	}
+
+	hashes := make([]string, 0, len(headers))
+	for j, header := range headers {
+		if header.PrevBlock != prev {
+			return nil, fmt.Errorf("header %d follows %s, wanted %s", j, header.PrevBlock, prev)
+		}
+		if header.BlockNum != prevNum+1 {
+			return nil, fmt.Errorf("header %d has BlockNum %d, wanted %d", j, header.BlockNum, prevNum+1)
+		}
+		if err := i.isBlockNonceValid(header); err != nil {
+			return nil, err
+		}
+		hash, err := header.Hash()
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, hash)
+		prev, prevNum = hash, header.BlockNum
+	}
+	return hashes, nil
+}
+
+// peerList returns the peers that support the capability.
+func (i *InkMiner) peerList(capability string) []*peer {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var peers []*peer
+	for _, p := range i.mu.peers {
+		if p.hasCapability(capability) {
+			peers = append(peers, p)
+		}
+	}
+	return peers
+}
+
+// sync downloads blocks we're missing from our peers until none of them have
+// anything new. Only one sync runs at a time. Since each round starts from
+// our own main chain, a sync that's interrupted by a disconnect picks up
+// where it left off the next time it runs.
+func (i *InkMiner) sync() {
+	i.mu.Lock()
+	if i.mu.syncing {
+		i.mu.Unlock()
+		return
+	}
+	i.mu.syncing = true
+	i.mu.Unlock()
+
+	defer func() {
+		i.mu.Lock()
+		i.mu.syncing = false
+		i.mu.Unlock()
+	}()
+
+	if i.fastSyncEnabled() {
+		i.fastSync()
+	}
+
+	for {
+		more, err := i.syncRound()
+		if err != nil {
+			i.log.Printf("sync error: %+v", err)
+			return
+		}
+		if !more {
+			return
+		}
+	}
+}
+
+// syncRound fetches headers from the first peer that has blocks we're missing
+// and then downloads the bodies in parallel from all peers. It returns whether
+// any blocks were missing.
+func (i *InkMiner) syncRound() (bool, error) {
+	peers := i.peerList("headers")
+	if len(peers) == 0 {
+		return false, nil
+	}
+	rand.Shuffle(len(peers), func(a, b int) {
+		peers[a], peers[b] = peers[b], peers[a]
+	})
+
+	i.mu.Lock()
+	req := GetHeadersRequest{Locator: i.blockLocatorLocked()}
+	i.mu.Unlock()
+
+	var missing []string
+	// headersFrom is the peer that sent the headers, it's the only one that
+	// claimed to have the blocks.
+	var headersFrom *peer
+	for _, p := range peers {
+		var resp GetHeadersResponse
+		if err := p.rpc.Call("InkMinerRPC.GetHeaders", req, &resp); err != nil {
+			i.log.Printf("GetHeaders error (from %s): %s", p, err)
+			i.misbehaving(p.address, PenaltyTimeout, err.Error())
+			continue
+		}
+		hashes, err := i.checkHeaders(resp.Headers)
+		if err != nil {
+			i.log.Printf("invalid headers (from %s): %s", p, err)
+			i.misbehaving(p.address, PenaltyInvalid, err.Error())
+			continue
+		}
+		for _, hash := range hashes {
+			if _, ok := i.GetBlock(hash); !ok {
+				missing = append(missing, hash)
+			}
+		}
+		if len(missing) > 0 {
+			headersFrom = p
+			break
+		}
+	}
+	if len(missing) == 0 {
+		return false, nil
+	}
+
+	var batches [][]string
+	for len(missing) > 0 {
+		n := SyncBatchSize
+		if n > len(missing) {
+			n = len(missing)
+		}
+		batches = append(batches, missing[:n])
+		missing = missing[n:]
+	}
+
+	results := make([]GetBlocksResponse, len(batches))
+	from := make([]*peer, len(batches))
+	errs := make([]error, len(batches))
+	var wg sync.WaitGroup
+	for j, batch := range batches {
+		j, batch := j, batch
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			// Spread the batches over the peers and fall back to the others if
+			// one of them fails or doesn't have the blocks.
+			for k := 0; k < len(peers); k++ {
+				p := peers[(j+k)%len(peers)]
+				var resp GetBlocksResponse
+				err := p.rpc.Call("InkMinerRPC.GetBlocks", GetBlocksRequest{Hashes: batch}, &resp)
+				if err != nil {
+					i.misbehaving(p.address, PenaltyTimeout, err.Error())
+				} else if len(resp.Blocks) != len(batch) {
+					err = fmt.Errorf("missing blocks: got %d, wanted %d", len(resp.Blocks), len(batch))
+					// Only the peer that sent the headers claimed to have
+					// the blocks, the others could be on another fork or
+					// still syncing.
+					if p == headersFrom {
+						i.misbehaving(p.address, PenaltyProtocol, err.Error())
+					}
+				}
+				if err != nil {
+					errs[j] = fmt.Errorf("GetBlocks error (from %s): %s", p, err)
+					continue
+				}
+				results[j] = resp
+				from[j] = p
+				errs[j] = nil
+				return
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Add the blocks in order so parents always come first.
+	for j, resp := range results {
+		if errs[j] != nil {
+			return false, errs[j]
+		}
+		for _, block := range resp.Blocks {
+			if _, err := i.AddBlock(block); err != nil {
+				i.misbehaving(from[j].address, PenaltyInvalid, err.Error())
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
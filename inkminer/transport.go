@@ -0,0 +1,121 @@
+package inkminer
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"../crypto"
+)
+
+// SetTLS turns on TLS for all connections. Both sides of every connection
+// prove they have the private key for the public key they present: miners use
+// their own key and art nodes use the key of the miner they connect to.
+// Plaintext connections are refused. It must be called before Listen.
+func (i *InkMiner) SetTLS(enabled bool) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if !enabled {
+		i.mu.tlsConfig = nil
+		return nil
+	}
+
+	config, err := crypto.TLSConfig(i.privKey)
+	if err != nil {
+		return err
+	}
+	i.mu.tlsConfig = config
+	return nil
+}
+
+func (i *InkMiner) getTLSConfig() *tls.Config {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return i.mu.tlsConfig
+}
+
+// secureConn runs the TLS handshake on conn if TLS is on. It returns the
+// connection to use and the public key the other side proved it has, or "" if
+// TLS is off.
+func (i *InkMiner) secureConn(conn net.Conn, client bool) (net.Conn, string, error) {
+	config := i.getTLSConfig()
+	if config == nil {
+		return conn, "", nil
+	}
+
+	var tconn *tls.Conn
+	if client {
+		tconn = tls.Client(conn, config)
+	} else {
+		tconn = tls.Server(conn, config)
+	}
+	tconn.SetDeadline(time.Now().Add(i.timeout))
+	if err := tconn.Handshake(); err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	tconn.SetDeadline(time.Time{})
+
+	key, err := crypto.PeerKey(tconn.ConnectionState())
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	identity, err := crypto.MarshalPublic(key)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return tconn, identity, nil
+}
+
+// checkPeerKey checks that the key a peer proved it has is the one registered
+// with the server for the address it claims. Without the server the first key
+// seen for an address is trusted.
+func (i *InkMiner) checkPeerKey(addr, identity string) error {
+	if identity == "" {
+		return nil
+	}
+
+	key, err := crypto.UnmarshalPublic(identity)
+	if err != nil {
+		return err
+	}
+	marshalled := elliptic.Marshal(key.Curve, key.X, key.Y)
+
+	i.mu.Lock()
+	known, ok := i.mu.peerKeys[addr]
+	i.mu.Unlock()
+
+	if !ok && i.client != nil {
+		var registered []byte
+		if err := i.client.Call("RServer.GetMinerKey", addr, &registered); err != nil {
+			i.log.Printf("GetMinerKey failed: %s", err)
+		} else {
+			known, ok = registered, true
+		}
+	}
+	if ok && !bytes.Equal(known, marshalled) {
+		return fmt.Errorf("peer %s presented a key that isn't registered for it", addr)
+	}
+
+	i.mu.Lock()
+	i.mu.peerKeys[addr] = marshalled
+	i.mu.Unlock()
+	return nil
+}
+
+// authorized returns whether the caller is the owner of this miner. Over TLS
+// the caller has to have proven it has the miner's key, otherwise the public
+// key it claims is compared.
+func (i *InkMinerRPC) authorized(claimed string) bool {
+	if i.identity != "" {
+		return i.identity == i.i.publicKey
+	}
+	return claimed == i.i.publicKey
+}
@@ -1,7 +1,146 @@
 package inkminer
 
+// MaxReorgDepth is how many blocks past its ValidateNum an operation has to be
+// buried before we stop watching it for reorgs.
+const MaxReorgDepth = 50
+
 type ValidateNumWaiter struct {
 	done        chan string
 	err         chan error
 	validateNum uint8
 }
+
+// confirmation tracks an operation that an art node has waited on so we can
+// tell it if the operation gets orphaned later.
+type confirmation struct {
+	// pubKey is the key of the art node that submitted the operation.
+	pubKey      string
+	validateNum uint8
+	// blockHash is the block the operation was confirmed in or "" if it
+	// isn't confirmed on the canonical chain.
+	blockHash string
+	// reorged is whether the operation was confirmed but the block was
+	// orphaned by a reorg. It's cleared once it's confirmed again.
+	reorged bool
+}
+
+// addValidateNumWaiter registers a waiter that is notified once the operation
+// is validateNum blocks deep on the canonical chain. Multiple waiters can wait
+// on the same operation.
+func (i *InkMiner) addValidateNumWaiter(opHash string, validateNum uint8) ValidateNumWaiter {
+	validateNumWaiter := ValidateNumWaiter{
+		done:        make(chan string, 1),
+		err:         make(chan error, 1),
+		validateNum: validateNum,
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.mu.validateNumMap[opHash] = append(i.mu.validateNumMap[opHash], validateNumWaiter)
+
+	c, ok := i.mu.confirmations[opHash]
+	if !ok {
+		c.pubKey = i.mu.mempool[opHash].owner
+	}
+	if validateNum > c.validateNum {
+		c.validateNum = validateNum
+	}
+	i.mu.confirmations[opHash] = c
+
+	return validateNumWaiter
+}
+
+// ancestorLocked returns the hash of the block n blocks before hash. It must be
+// locked before calling!
+func (i *InkMiner) ancestorLocked(hash string, n int) string {
+	for j := 0; j < n; j++ {
+		hash = i.mu.blockchain[hash].PrevBlock
+	}
+	return hash
+}
+
+// updateHeadConfirmations calls updateConfirmations with the state of the
+// current head.
+func (i *InkMiner) updateHeadConfirmations() {
+	head, _, state := i.headState()
+	if head == "" || head == i.settings.GenesisBlockHash {
+		return
+	}
+	i.updateConfirmations(head, state)
+}
+
+// updateConfirmations resolves waiters for operations that are ValidateNum
+// blocks deep on the canonical chain ending at head and marks previously
+// confirmed operations that are no longer on it as reorged. Waiters stay armed
+// until their operation is confirmed on the canonical chain.
+func (i *InkMiner) updateConfirmations(head string, state State) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// The head moved while the state was being calculated, the caller that
+	// moved it will redo this.
+	if i.mu.head != head {
+		return
+	}
+
+	for opHash, c := range i.mu.confirmations {
+		n, ok := state.committedFor(opHash)
+		if !ok {
+			if c.blockHash != "" {
+				i.log.Printf("operation %s orphaned from block %s by reorg", opHash, c.blockHash)
+				c.blockHash = ""
+				c.reorged = true
+				i.mu.confirmations[opHash] = c
+			}
+			continue
+		}
+
+		blockHash := i.ancestorLocked(head, n)
+
+		var waiting []ValidateNumWaiter
+		for _, waiter := range i.mu.validateNumMap[opHash] {
+			if n < int(waiter.validateNum) {
+				waiting = append(waiting, waiter)
+				continue
+			}
+			waiter.done <- blockHash
+		}
+		if len(waiting) > 0 {
+			i.mu.validateNumMap[opHash] = waiting
+		} else {
+			delete(i.mu.validateNumMap, opHash)
+		}
+
+		switch {
+		case n >= int(c.validateNum)+MaxReorgDepth && len(waiting) == 0:
+			// Buried deep enough that it won't be reorged anymore.
+			delete(i.mu.confirmations, opHash)
+		case n >= int(c.validateNum):
+			c.blockHash = blockHash
+			c.reorged = false
+			i.mu.confirmations[opHash] = c
+		case c.blockHash != "" && c.blockHash != blockHash:
+			// Mined again in a different block but not deep enough yet.
+			i.log.Printf("operation %s orphaned from block %s by reorg", opHash, c.blockHash)
+			c.blockHash = ""
+			c.reorged = true
+			i.mu.confirmations[opHash] = c
+		}
+	}
+}
+
+// reorged returns the hashes of all operations submitted by pubKey that were
+// confirmed but have since been orphaned and not confirmed again.
+func (i *InkMiner) reorged(pubKey string) []string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var hashes []string
+	for opHash, c := range i.mu.confirmations {
+		if c.reorged && c.pubKey == pubKey {
+			hashes = append(hashes, opHash)
+		}
+	}
+	return hashes
+}
@@ -65,19 +65,92 @@ func (i *InkMiner) validateOp(operation blockartlib.Operation) error {
 }
 
 // Returns true if this block has the correct nonce
-func (i *InkMiner) isBlockNonceValid(block blockartlib.Block) error {
-	blockHash, err := block.Hash()
+func (i *InkMiner) isBlockNonceValid(header blockartlib.BlockHeader) error {
+	blockHash, err := header.Hash()
 	if err != nil {
 		return err
 	}
 
-	want := i.settings.PoWDifficultyOpBlock
-	if len(block.Records) == 0 {
-		want = i.settings.PoWDifficultyNoOpBlock
-	}
+	want := i.blockDifficulty(header)
 	zeros := uint8(numZeros(blockHash))
 	if zeros != want {
-		return fmt.Errorf("invalid block nonce: got %d zeros, wanted %d in %q, %+v", zeros, want, blockHash, block)
+		return fmt.Errorf("invalid block nonce: got %d zeros, wanted %d in %q, %+v", zeros, want, blockHash, header)
+	}
+	return nil
+}
+
+// checkBlockLimits checks the operations of a block against the consensus
+// limits in the settings. It doesn't need the operations to be valid so it's
+// done before the expensive checks.
+func (i *InkMiner) checkBlockLimits(records []blockartlib.Operation) error {
+	if max := i.settings.MaxBlockOps; max > 0 && len(records) > int(max) {
+		return fmt.Errorf("block has %d operations, the limit is %d", len(records), max)
+	}
+	size, vertices := 0, 0
+	for _, op := range records {
+		n, err := op.Size()
+		if err != nil {
+			return err
+		}
+		size += n
+		vertices += op.Vertices()
+	}
+	if max := i.settings.MaxBlockBytes; max > 0 && size > int(max) {
+		return fmt.Errorf("block operations are %d bytes, the limit is %d", size, max)
+	}
+	if max := i.settings.MaxBlockVertices; max > 0 && vertices > int(max) {
+		return fmt.Errorf("block shapes have %d vertices, the limit is %d", vertices, max)
 	}
 	return nil
 }
+
+// validateBlock checks everything about a block before it's accepted: the
+// nonce, that the parent is known, the consensus limits, that the header
+// commits to the operations, the signature and shape of every operation and
+// that the operations apply cleanly to the parent's state. It returns the
+// state after the block.
+func (i *InkMiner) validateBlock(block blockartlib.Block) (State, error) {
+	if err := i.isBlockNonceValid(block.BlockHeader); err != nil {
+		return State{}, err
+	}
+
+	if block.PrevBlock != i.settings.GenesisBlockHash {
+		if _, ok := i.GetBlock(block.PrevBlock); !ok {
+			return State{}, fmt.Errorf("unknown parent: %s", blockartlib.InvalidBlockHashError(block.PrevBlock))
+		}
+	}
+
+	if err := i.checkBlockLimits(block.Records); err != nil {
+		return State{}, err
+	}
+
+	root, err := blockartlib.MerkleRoot(block.Records)
+	if err != nil {
+		return State{}, err
+	}
+	if root != block.MerkleRoot {
+		return State{}, fmt.Errorf("block Merkle root is %q, the operations have %q", block.MerkleRoot, root)
+	}
+
+	for _, op := range block.Records {
+		if err := i.validateOp(op); err != nil {
+			return State{}, err
+		}
+	}
+
+	prev, err := i.getStateForHash(block.PrevBlock)
+	if err != nil {
+		return State{}, err
+	}
+
+	// TransformState also checks the BlockNum, ink levels, overlaps and
+	// ownership of deleted shapes.
+	state, err := i.TransformState(prev, block)
+	if err != nil {
+		return State{}, err
+	}
+	if root := state.StateRoot(); root != block.StateRoot {
+		return State{}, fmt.Errorf("block state root is %q, the operations leave %q", block.StateRoot, root)
+	}
+	return state, nil
+}
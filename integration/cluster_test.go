@@ -71,48 +71,49 @@ func TestClusterBlockPropagation(t *testing.T) {
 		}
 	}
 
+	waitForBlocks := func(want int) {
+		SucceedsSoon(t, func() error {
+			for i, im := range ts.Miners {
+				n := im.BlockPoolSize()
+				if n != want {
+					return fmt.Errorf("%d. expected %d blocks, have %d", i, want, n)
+				}
+			}
+			return nil
+		})
+	}
+
+	block1, hash1 := ts.MineBlock("genesis!", 1)
+	block2, hash2 := ts.MineBlock(hash1, 2)
+	block3, _ := ts.MineBlock(hash2, 3)
+
 	var resp inkminer.NotifyBlockResponse
 	if err := ts.Miners[0].RPC().NotifyBlock(inkminer.NotifyBlockRequest{
-		Block: blockartlib.Block{
-			BlockNum: 1,
-		},
+		Block: block1,
 	}, &resp); err != nil {
 		t.Fatal(err)
 	}
 
 	if err := ts.Miners[0].RPC().NotifyBlock(inkminer.NotifyBlockRequest{
-		Block: blockartlib.Block{
-			BlockNum: 1,
-		},
+		Block: block1,
 	}, &resp); err != nil {
 		t.Fatal(err)
 	}
+	waitForBlocks(1)
 
 	if err := ts.Miners[1].RPC().NotifyBlock(inkminer.NotifyBlockRequest{
-		Block: blockartlib.Block{
-			BlockNum: 2,
-		},
+		Block: block2,
 	}, &resp); err != nil {
 		t.Fatal(err)
 	}
+	waitForBlocks(2)
 
 	if err := ts.Miners[2].RPC().NotifyBlock(inkminer.NotifyBlockRequest{
-		Block: blockartlib.Block{
-			BlockNum: 3,
-		},
+		Block: block3,
 	}, &resp); err != nil {
 		t.Fatal(err)
 	}
-
-	SucceedsSoon(t, func() error {
-		for i, im := range ts.Miners {
-			n := im.BlockPoolSize()
-			if n != 3 {
-				return fmt.Errorf("%d. expected 3 blocks, have %d", i, n)
-			}
-		}
-		return nil
-	})
+	waitForBlocks(3)
 }
 
 func TestClusterOperationPropagation(t *testing.T) {
@@ -204,19 +205,18 @@ func TestSimpleClusterBlockPropagateOnJoin(t *testing.T) {
 	ts := NewTestCluster(t, 1)
 	defer ts.Close()
 
+	block1, hash1 := ts.MineBlock("genesis!", 1)
+	block2, _ := ts.MineBlock(hash1, 2)
+
 	var resp inkminer.NotifyBlockResponse
 	if err := ts.Miners[0].RPC().NotifyBlock(inkminer.NotifyBlockRequest{
-		Block: blockartlib.Block{
-			BlockNum: 1,
-		},
+		Block: block1,
 	}, &resp); err != nil {
 		t.Fatal(err)
 	}
 
 	if err := ts.Miners[0].RPC().NotifyBlock(inkminer.NotifyBlockRequest{
-		Block: blockartlib.Block{
-			BlockNum: 2,
-		},
+		Block: block2,
 	}, &resp); err != nil {
 		t.Fatal(err)
 	}
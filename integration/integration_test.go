@@ -58,6 +58,9 @@ type TestCluster struct {
 	Miners   []*inkminer.InkMiner
 	ArtNodes []blockartlib.Canvas
 
+	// mined are the states after the blocks mined by MineBlock.
+	mined map[string]inkminer.State
+
 	t *testing.T
 }
 
@@ -83,7 +86,8 @@ func SetBlockDelay(time time.Duration) func() {
 
 func NewTestCluster(t *testing.T, nodes int) *TestCluster {
 	ts := &TestCluster{
-		t: t,
+		mined: make(map[string]inkminer.State),
+		t:     t,
 	}
 
 	min := nodes - 1
@@ -211,3 +215,47 @@ func (ts *TestCluster) NewAddOp(op blockartlib.Operation) blockartlib.Operation
 	}
 	return op2
 }
+
+// MineBlock mines a valid empty block on top of prev with the first miner's
+// key. prev has to be genesis, a block the first miner has or one mined by
+// MineBlock.
+func (ts *TestCluster) MineBlock(prev string, blockNum int) (blockartlib.Block, string) {
+	im := ts.Miners[0]
+	block := blockartlib.Block{
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: prev,
+			BlockNum:  blockNum,
+			PubKey:    ts.Keys[0].PublicKey,
+		},
+	}
+
+	prevState, ok := ts.mined[prev]
+	if !ok && prev == "genesis!" {
+		prevState = inkminer.NewState()
+	} else if !ok {
+		prevBlock, found := im.GetBlock(prev)
+		if !found {
+			ts.t.Fatalf("MineBlock: unknown parent %s", prev)
+		}
+		var err error
+		if prevState, err = im.CalculateState(prevBlock); err != nil {
+			ts.t.Fatal(err)
+		}
+	}
+	state, err := im.TransformState(prevState, block)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	block.StateRoot = state.StateRoot()
+
+	block, err = im.MineBlock(block)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	hash, err := block.Hash()
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	ts.mined[hash] = state
+	return block, hash
+}
@@ -37,11 +37,17 @@ func TestMiningClusterOrphanBlock(t *testing.T) {
 	ts := NewTestCluster(t, 1)
 	defer ts.Close()
 
-	if _, err := ts.Miners[0].AddBlock(ts.Miners[0].TestMine(t, blockartlib.Block{
-		PrevBlock: "doesn't exist",
-		BlockNum:  1,
-		PubKey:    ts.Keys[0].PublicKey,
-	})); err != nil {
+	orphan, err := ts.Miners[0].MineBlock(blockartlib.Block{
+		BlockHeader: blockartlib.BlockHeader{
+			PrevBlock: "doesn't exist",
+			BlockNum:  1,
+			PubKey:    ts.Keys[0].PublicKey,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ts.Miners[0].AddBlock(orphan); err != nil {
 		t.Fatal(err)
 	}
 
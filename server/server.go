@@ -51,6 +51,12 @@ func (e AddressAlreadyRegisteredError) Error() string {
 	return fmt.Sprintf("BlockArt server: address already registered [%s]", string(e))
 }
 
+type UnknownAddressError string
+
+func (e UnknownAddressError) Error() string {
+	return fmt.Sprintf("BlockArt server: unknown address [%s]", string(e))
+}
+
 // Settings for a canvas in BlockArt.
 type CanvasSettings struct {
 	// Canvas dimensions
@@ -98,6 +104,13 @@ type MinerNetSettings struct {
 	PoWDifficultyOpBlock   uint8 `json:"pow-difficulty-op-block"`
 	PoWDifficultyNoOpBlock uint8 `json:"pow-difficulty-no-op-block"`
 
+	// Consensus limits on each block: the number of operations, the total
+	// size of their encodings and the total number of vertices in their
+	// shapes. Blocks over any of them are invalid. 0 means no limit.
+	MaxBlockOps      uint32 `json:"max-block-ops"`
+	MaxBlockBytes    uint32 `json:"max-block-bytes"`
+	MaxBlockVertices uint32 `json:"max-block-vertices"`
+
 	// Canvas settings
 	CanvasSettings CanvasSettings `json:"canvas-settings"`
 }
@@ -320,6 +333,25 @@ func (s *RServer) GetNodes(key ecdsa.PublicKey, addrSet *[]net.Addr) error {
 	return nil
 }
 
+// Returns the public key registered for the miner at addr, marshalled with
+// elliptic.Marshal. Miners use it to check that a peer proving a key owns the
+// address it claims.
+//
+// Returns:
+// - UnknownAddressError if no miner is registered at addr.
+func (s *RServer) GetMinerKey(addr string, key *[]byte) error {
+	s.s.allMiners.RLock()
+	defer s.s.allMiners.RUnlock()
+
+	for k, miner := range s.s.allMiners.all {
+		if miner.Address.String() == addr {
+			*key = []byte(k)
+			return nil
+		}
+	}
+	return UnknownAddressError(addr)
+}
+
 // The server also listens for heartbeats from known miners. A miner must
 // send a heartbeat to the server every HeartBeat milliseconds
 // (specified in settings from server) after calling Register, otherwise